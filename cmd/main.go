@@ -3,34 +3,133 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
-	"net/http"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/albertb/putarr/internal"
 	"github.com/putdotio/go-putio"
 	"golang.org/x/oauth2"
 	"golift.io/starr"
+	"golift.io/starr/lidarr"
 	"golift.io/starr/radarr"
+	"golift.io/starr/readarr"
 	"golift.io/starr/sonarr"
 )
 
-func run(addr string, config *internal.Config) error {
-	ctx := context.Background()
+// How often to check whether the config file was modified.
+const configWatchInterval = 5 * time.Second
+
+// Runs Putarr until the context is done, then shuts it down gracefully.
+func run(ctx context.Context, addr, configPath string, config *internal.Config) error {
+	liveConfig := internal.NewLiveConfig(config, func() (*internal.Config, error) {
+		return loadConfig(configPath)
+	})
 
 	putioClient := newPutioClient(ctx, config)
-	arrClient := newArrClient(config)
+	arrClient := internal.NewArrClient(newImporters(config)...)
+	liveConfig.OnReload(func(config *internal.Config) {
+		arrClient.SetImporters(newImporters(config)...)
+	})
+
+	store, state, err := openStore(ctx, config, putioClient)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		// Unregister on the way out so the instance can be restarted right away.
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.Server.ShutdownTimeout)
+			defer cancel()
+			if err := state.Unregister(ctx); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
 
-	putioProxy := internal.NewPutioProxy(config, putioClient)
+	putioProxy := internal.NewPutioProxy(liveConfig, putioClient, store)
 
 	janitor := internal.NewPutioJanitor(arrClient, putioProxy)
-	janitor.RunAtInterval(ctx, config.Putio.JanitorInterval)
+	background := []func(ctx context.Context){
+		func(ctx context.Context) {
+			janitor.RunAtInterval(ctx, func() time.Duration { return liveConfig.Current().Putio.JanitorInterval })
+		},
+	}
+
+	var downloader *internal.Downloader
+	if config.Downloader.Dir != "" {
+		downloader = internal.NewDownloader(liveConfig, putioClient, putioProxy)
+		background = append(background, func(ctx context.Context) {
+			downloader.RunAtInterval(ctx, func() time.Duration { return liveConfig.Current().Downloader.Interval })
+		})
+	}
 
+	liveConfig.WatchFile(ctx, configPath, configWatchInterval)
+	reloadOnSIGHUP(liveConfig)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
 	log.Println("listening on", addr)
 
-	s := internal.NewServer(config, "whatever", putioProxy)
-	return http.ListenAndServe(addr, s)
+	s := internal.NewServer(liveConfig, putioProxy, downloader)
+	return internal.Serve(ctx, listener, s, config.Server.ShutdownTimeout, background...)
+}
+
+// Reloads the config whenever the process receives a SIGHUP.
+func reloadOnSIGHUP(liveConfig *internal.LiveConfig) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := liveConfig.Reload(); err != nil {
+				log.Println("failed to reload config:", err)
+			}
+		}
+	}()
+}
+
+// Reads the config file, and sets the defaults that depend on its path.
+func loadConfig(path string) (*internal.Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	config, err := internal.ReadConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if config.Store.Path == "" {
+		config.Store.Path = filepath.Join(filepath.Dir(path), "transfers.json")
+	}
+	return &config, nil
+}
+
+// Opens the store of the configured backend. With the putio backend, this also registers the instance with the others
+// sharing the Put.io account, and returns its shared state.
+func openStore(ctx context.Context, config *internal.Config, putioClient *putio.Client) (*internal.Store, *internal.PutioState, error) {
+	if config.Store.Backend != "putio" {
+		store, err := internal.OpenStore(config.Store.Path)
+		return store, nil, err
+	}
+	state, err := internal.NewPutioState(config, putioClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := state.Register(ctx); err != nil {
+		return nil, nil, err
+	}
+	state.RunAtInterval(ctx)
+	store, err := internal.OpenPutioStore(ctx, state)
+	return store, state, err
 }
 
 func newPutioClient(ctx context.Context, config *internal.Config) *putio.Client {
@@ -39,16 +138,24 @@ func newPutioClient(ctx context.Context, config *internal.Config) *putio.Client
 	return putio.NewClient(oauthClient)
 }
 
-func newArrClient(config *internal.Config) *internal.ArrClient {
-	var radarrClient *radarr.Radarr
-	if config.Radarr != nil {
-		radarrClient = radarr.New(starr.New(config.Radarr.APIKey, config.Radarr.URL, 0))
+func newImporters(config *internal.Config) []internal.Importer {
+	var importers []internal.Importer
+	for _, c := range config.Radarr {
+		importers = append(importers, internal.NewRadarrImporter(c.Name, radarr.New(starr.New(c.APIKey, c.URL, 0))))
+	}
+	for _, c := range config.Sonarr {
+		importers = append(importers, internal.NewSonarrImporter(c.Name, sonarr.New(starr.New(c.APIKey, c.URL, 0))))
 	}
-	var sonarrClient *sonarr.Sonarr
-	if config.Sonarr != nil {
-		sonarrClient = sonarr.New(starr.New(config.Sonarr.APIKey, config.Sonarr.URL, 0))
+	for _, c := range config.Lidarr {
+		importers = append(importers, internal.NewLidarrImporter(c.Name, lidarr.New(starr.New(c.APIKey, c.URL, 0))))
 	}
-	return internal.NewArrClient(config, radarrClient, sonarrClient)
+	for _, c := range config.Readarr {
+		importers = append(importers, internal.NewReadarrImporter(c.Name, readarr.New(starr.New(c.APIKey, c.URL, 0))))
+	}
+	for _, c := range config.Whisparr {
+		importers = append(importers, internal.NewWhisparrImporter(c.Name, radarr.New(starr.New(c.APIKey, c.URL, 0))))
+	}
+	return importers
 }
 
 func main() {
@@ -65,19 +172,19 @@ func main() {
 
 	flag.Parse()
 
-	file, err := os.Open(*configPath)
-	if err != nil {
-		log.Fatalln("failed to open config file:", err)
-	}
-	defer file.Close()
-
-	config, err := internal.ReadConfig(file)
+	config, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatalln("failed to read config file:", err)
-
 	}
 
-	if err := run(*addr, &config); err != nil {
+	// The first SIGINT or SIGTERM shuts Putarr down gracefully, and a second one kills it right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := run(ctx, *addr, *configPath, config); err != nil {
 		log.Fatalln("failed to run server:", err)
 	}
 }
@@ -6,6 +6,7 @@ require (
 	github.com/google/go-cmp v0.7.0
 	github.com/jackpal/bencode-go v1.0.2
 	github.com/putdotio/go-putio v1.7.2
+	golang.org/x/crypto v0.36.0
 	golang.org/x/oauth2 v0.28.0
 	golift.io/starr v1.1.0
 	gopkg.in/yaml.v3 v3.0.1
@@ -18,4 +19,7 @@ require (
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
 
-require golang.org/x/net v0.38.0 // indirect
+require (
+	golang.org/x/net v0.38.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+)
@@ -2,181 +2,276 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
 
 	"golift.io/starr"
+	"golift.io/starr/lidarr"
 	"golift.io/starr/radarr"
+	"golift.io/starr/readarr"
 	"golift.io/starr/sonarr"
 )
 
+// ArrClient queries the import status of the transfers from all the importers.
 type ArrClient struct {
-	config       *Config
-	radarrClient *radarr.Radarr
-	sonarrClient *sonarr.Sonarr
+	mu        sync.RWMutex
+	importers []Importer
 }
 
-func NewArrClient(config *Config, radarrClient *radarr.Radarr, sonarrClient *sonarr.Sonarr) *ArrClient {
-	return &ArrClient{
-		config:       config,
-		radarrClient: radarrClient,
-		sonarrClient: sonarrClient,
-	}
+func NewArrClient(importers ...Importer) *ArrClient {
+	return &ArrClient{importers: importers}
 }
 
-type RadarrStatus struct {
-	StatusByMovieID map[int64]*RadarrItemStatus
+// SetImporters replaces the importers, e.g., after the *arr endpoints were reloaded. Queries in progress finish with
+// the previous importers.
+func (c *ArrClient) SetImporters(importers ...Importer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.importers = importers
 }
 
-type RadarrItemStatus struct {
-	PendingRecord *radarr.QueueRecord
-	ImportRecord  *radarr.HistoryRecord
-}
+// GetImportVerdictsByDownloadID queries the importers concurrently, and returns the combined verdict of the importers
+// that know about each transfer, keyed by its download ID. The errors of all the failed importers are joined together.
+func (c *ArrClient) GetImportVerdictsByDownloadID(ctx context.Context) (map[string]ImportVerdict, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	result := map[string]ImportVerdict{}
+
+	c.mu.RLock()
+	importers := c.importers
+	c.mu.RUnlock()
+
+	for _, importer := range importers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			verdicts, err := importer.GetImportVerdicts(ctx)
 
-type SonarrStatus struct {
-	StatusByEpisodeID map[int64]*SonarrItemStatus
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			for downloadID, verdict := range verdicts {
+				result[downloadID] = combineImportVerdicts(result[downloadID], verdict)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return result, errors.Join(errs...)
 }
 
-type SonarrItemStatus struct {
-	PendingRecord *sonarr.QueueRecord
-	ImportRecord  *sonarr.HistoryRecord
+// Queue records in these states are stuck until the user intervenes.
+func isFailedDownload(trackedDownloadStatus, trackedDownloadState string) bool {
+	return trackedDownloadStatus == "error" || trackedDownloadState == "importFailed" ||
+		trackedDownloadState == "failedPending" || trackedDownloadState == "failed"
 }
 
-func (c *ArrClient) GetRadarrImportStatusByTransferID(ctx context.Context) (map[int64]*RadarrStatus, error) {
-	result := map[int64]*RadarrStatus{}
-	if c.radarrClient == nil {
-		return result, nil
-	}
+// arrImporter queries the queue and history of an *arr instance. The *arrs share the same API, but starr has distinct
+// types for each of them, so each importer fetches its records with its own client and keeps only what it needs.
+type arrImporter struct {
+	name    string
+	queue   func(ctx context.Context) ([]arrRecord, error)
+	history func(ctx context.Context) ([]arrRecord, error)
+}
 
-	// Get the most recent queue records, this will include in-progress imports.
-	queue, err := c.radarrClient.GetQueuePageContext(ctx, &starr.PageReq{
-		PageSize: 1000,
-		SortKey:  "date",
-		SortDir:  "descending",
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to get queue from Radarr: %w", err)
-	}
+// arrRecord is a queue or history record for an item, e.g., a movie or an episode, of a download.
+type arrRecord struct {
+	DownloadID            string
+	ItemID                int64
+	TrackedDownloadStatus string
+	TrackedDownloadState  string
+}
 
-	// Get the most recent history records for imported items.
-	history, err := c.radarrClient.GetHistoryPageContext(ctx, &starr.PageReq{
+// Returns a request for the most recent records, filtered by event type for the history.
+func recentRecords(filter starr.Filtering) *starr.PageReq {
+	return &starr.PageReq{
 		PageSize: 1000,
 		SortKey:  "date",
 		SortDir:  "descending",
-		Filter:   radarr.FilterDownloadFolderImported,
-	})
-	if err != nil {
-		return result, fmt.Errorf("failed to get history from Radarr: %w", err)
+		Filter:   filter,
 	}
+}
 
-	for _, record := range queue.Records {
-		id, err := ParseTorrentHash(record.DownloadID)
-		if err != nil {
-			continue
-		}
+func NewRadarrImporter(name string, client *radarr.Radarr) Importer {
+	return newRadarrImporter(fmt.Sprintf("Radarr instance %q", name), client)
+}
 
-		status, ok := result[id]
-		if !ok {
-			status = &RadarrStatus{StatusByMovieID: map[int64]*RadarrItemStatus{}}
-			result[id] = status
-		}
+// NewWhisparrImporter returns an importer for Whisparr, which is a fork of Radarr and exposes the same API.
+func NewWhisparrImporter(name string, client *radarr.Radarr) Importer {
+	return newRadarrImporter(fmt.Sprintf("Whisparr instance %q", name), client)
+}
 
-		item, ok := status.StatusByMovieID[record.MovieID]
-		if !ok {
-			item = &RadarrItemStatus{}
-			status.StatusByMovieID[record.MovieID] = item
-		}
-		item.PendingRecord = record
+func newRadarrImporter(name string, client *radarr.Radarr) Importer {
+	return &arrImporter{
+		name: name,
+		queue: func(ctx context.Context) ([]arrRecord, error) {
+			queue, err := client.GetQueuePageContext(ctx, recentRecords(0))
+			if err != nil {
+				return nil, err
+			}
+			var records []arrRecord
+			for _, record := range queue.Records {
+				records = append(records, arrRecord{record.DownloadID, record.MovieID,
+					record.TrackedDownloadStatus, record.TrackedDownloadState})
+			}
+			return records, nil
+		},
+		history: func(ctx context.Context) ([]arrRecord, error) {
+			history, err := client.GetHistoryPageContext(ctx, recentRecords(radarr.FilterDownloadFolderImported))
+			if err != nil {
+				return nil, err
+			}
+			var records []arrRecord
+			for _, record := range history.Records {
+				records = append(records, arrRecord{DownloadID: record.DownloadID, ItemID: record.MovieID})
+			}
+			return records, nil
+		},
 	}
+}
 
-	for _, record := range history.Records {
-		id, err := ParseTorrentHash(record.DownloadID)
-		if err != nil {
-			continue
-		}
-
-		status, ok := result[id]
-		if !ok {
-			status = &RadarrStatus{StatusByMovieID: map[int64]*RadarrItemStatus{}}
-			result[id] = status
-		}
-
-		item, ok := status.StatusByMovieID[record.MovieID]
-		if !ok {
-			item = &RadarrItemStatus{}
-			status.StatusByMovieID[record.MovieID] = item
-		}
-		item.ImportRecord = record
+func NewSonarrImporter(name string, client *sonarr.Sonarr) Importer {
+	return &arrImporter{
+		name: fmt.Sprintf("Sonarr instance %q", name),
+		queue: func(ctx context.Context) ([]arrRecord, error) {
+			queue, err := client.GetQueuePageContext(ctx, recentRecords(0))
+			if err != nil {
+				return nil, err
+			}
+			var records []arrRecord
+			for _, record := range queue.Records {
+				records = append(records, arrRecord{record.DownloadID, record.EpisodeID,
+					record.TrackedDownloadStatus, record.TrackedDownloadState})
+			}
+			return records, nil
+		},
+		history: func(ctx context.Context) ([]arrRecord, error) {
+			history, err := client.GetHistoryPageContext(ctx, recentRecords(sonarr.FilterDownloadFolderImported))
+			if err != nil {
+				return nil, err
+			}
+			var records []arrRecord
+			for _, record := range history.Records {
+				records = append(records, arrRecord{DownloadID: record.DownloadID, ItemID: record.EpisodeID})
+			}
+			return records, nil
+		},
 	}
+}
 
-	return result, nil
+func NewLidarrImporter(name string, client *lidarr.Lidarr) Importer {
+	return &arrImporter{
+		name: fmt.Sprintf("Lidarr instance %q", name),
+		queue: func(ctx context.Context) ([]arrRecord, error) {
+			queue, err := client.GetQueuePageContext(ctx, recentRecords(0))
+			if err != nil {
+				return nil, err
+			}
+			var records []arrRecord
+			for _, record := range queue.Records {
+				// starr doesn't decode the tracked download state of Lidarr queue records, so only failures reported
+				// through the tracked download status are noticed.
+				records = append(records, arrRecord{DownloadID: record.DownloadID, ItemID: record.AlbumID,
+					TrackedDownloadStatus: record.TrackedDownloadStatus})
+			}
+			return records, nil
+		},
+		history: func(ctx context.Context) ([]arrRecord, error) {
+			// Lidarr records a single download imported event per album, along with one event per imported track.
+			history, err := client.GetHistoryPageContext(ctx, recentRecords(lidarr.FilterDownloadImported))
+			if err != nil {
+				return nil, err
+			}
+			var records []arrRecord
+			for _, record := range history.Records {
+				records = append(records, arrRecord{DownloadID: record.DownloadID, ItemID: record.AlbumID})
+			}
+			return records, nil
+		},
+	}
 }
 
-func (c *ArrClient) GetSonarrImportStatusByTransferID(ctx context.Context) (map[int64]*SonarrStatus, error) {
-	result := map[int64]*SonarrStatus{}
-	if c.radarrClient == nil {
-		return result, nil
+func NewReadarrImporter(name string, client *readarr.Readarr) Importer {
+	return &arrImporter{
+		name: fmt.Sprintf("Readarr instance %q", name),
+		queue: func(ctx context.Context) ([]arrRecord, error) {
+			queue, err := client.GetQueuePageContext(ctx, recentRecords(0))
+			if err != nil {
+				return nil, err
+			}
+			var records []arrRecord
+			for _, record := range queue.Records {
+				records = append(records, arrRecord{record.DownloadID, record.BookID,
+					record.TrackedDownloadStatus, record.TrackedDownloadState})
+			}
+			return records, nil
+		},
+		history: func(ctx context.Context) ([]arrRecord, error) {
+			history, err := client.GetHistoryPageContext(ctx, recentRecords(readarr.FilterDownloadImported))
+			if err != nil {
+				return nil, err
+			}
+			var records []arrRecord
+			for _, record := range history.Records {
+				records = append(records, arrRecord{DownloadID: record.DownloadID, ItemID: record.BookID})
+			}
+			return records, nil
+		},
 	}
+}
 
+func (i *arrImporter) Name() string {
+	return i.name
+}
+
+// GetImportVerdicts combines the verdicts of the items of each download. Items with queue records are in progress, or
+// failed, whatever their history, while items with only import records in the history are imported.
+func (i *arrImporter) GetImportVerdicts(ctx context.Context) (map[string]ImportVerdict, error) {
 	// Get the most recent queue records, this will include in-progress imports.
-	queue, err := c.sonarrClient.GetQueuePageContext(ctx, &starr.PageReq{
-		PageSize: 1000,
-		SortKey:  "date",
-		SortDir:  "descending",
-	})
+	queue, err := i.queue(ctx)
 	if err != nil {
-		return result, fmt.Errorf("failed to get queue from Sonarr: %w", err)
+		return nil, fmt.Errorf("failed to get queue from %s: %w", i.name, err)
 	}
 
 	// Get the most recent history records for imported items.
-	history, err := c.sonarrClient.GetHistoryPageContext(ctx, &starr.PageReq{
-		PageSize: 1000,
-		SortKey:  "date",
-		SortDir:  "descending",
-		Filter:   sonarr.FilterDownloadFolderImported,
-	})
+	history, err := i.history(ctx)
 	if err != nil {
-		return result, fmt.Errorf("failed to get history from Sonarr: %w", err)
+		return nil, fmt.Errorf("failed to get history from %s: %w", i.name, err)
 	}
 
-	for _, record := range queue.Records {
-		id, err := ParseTorrentHash(record.DownloadID)
-		if err != nil {
-			continue
-		}
-
-		status, ok := result[id]
+	itemsByDownloadID := map[string]map[int64]ImportVerdict{}
+	items := func(record arrRecord) map[int64]ImportVerdict {
+		// Download IDs are the hashes the transfers were reported with, which clients sometimes make uppercase.
+		downloadID := strings.ToLower(record.DownloadID)
+		items, ok := itemsByDownloadID[downloadID]
 		if !ok {
-			status = &SonarrStatus{StatusByEpisodeID: map[int64]*SonarrItemStatus{}}
-			result[id] = status
+			items = map[int64]ImportVerdict{}
+			itemsByDownloadID[downloadID] = items
 		}
-
-		item, ok := status.StatusByEpisodeID[record.EpisodeID]
-		if !ok {
-			item = &SonarrItemStatus{}
-			status.StatusByEpisodeID[record.EpisodeID] = item
-		}
-		item.PendingRecord = record
+		return items
 	}
-
-	for _, record := range history.Records {
-		id, err := ParseTorrentHash(record.DownloadID)
-		if err != nil {
-			continue
-		}
-
-		status, ok := result[id]
-		if !ok {
-			status = &SonarrStatus{StatusByEpisodeID: map[int64]*SonarrItemStatus{}}
-			result[id] = status
-		}
-
-		item, ok := status.StatusByEpisodeID[record.EpisodeID]
-		if !ok {
-			item = &SonarrItemStatus{}
-			status.StatusByEpisodeID[record.EpisodeID] = item
+	for _, record := range history {
+		items(record)[record.ItemID] = ImportImported
+	}
+	for _, record := range queue {
+		verdict := ImportPending
+		if isFailedDownload(record.TrackedDownloadStatus, record.TrackedDownloadState) {
+			verdict = ImportFailed
 		}
-		item.ImportRecord = record
+		items(record)[record.ItemID] = verdict
 	}
 
+	result := map[string]ImportVerdict{}
+	for downloadID, items := range itemsByDownloadID {
+		result[downloadID] = combineImportVerdicts(slices.Collect(maps.Values(items))...)
+	}
 	return result, nil
 }
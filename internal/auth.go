@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Returns the users that can authenticate with the APIs: the one configured with username and password, if any, and
+// the ones listed in users.
+func (c TransmissionConfig) users() []UserConfig {
+	users := slices.Clone(c.Users)
+	if c.Username != "" {
+		users = append([]UserConfig{{Name: c.Username, Password: c.Password}}, users...)
+	}
+	return users
+}
+
+// Returns whether the user can call the Transmission RPC method.
+func (u UserConfig) allowsMethod(method string) bool {
+	return len(u.Methods) == 0 || slices.Contains(u.Methods, method)
+}
+
+// Returns whether the user can add transfers to the download directory, and see the transfers in it.
+func (u UserConfig) allowsDir(dir string) bool {
+	if len(u.DownloadDirs) == 0 {
+		return true
+	}
+	dir = path.Clean(dir)
+	for _, prefix := range u.DownloadDirs {
+		prefix = path.Clean(prefix)
+		if dir == prefix || strings.HasPrefix(dir, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// bcrypt hash, at the default cost, of a random password that was thrown away, so no password ever matches it.
+	dummyPasswordHash = "$2a$10$yVqWMahJcvDFBt8To59V1eTMP7S5T1jAjKpaQ1pDZXB5iKnYanY.q"
+
+	// How long a successfully checked password is remembered.
+	verifiedPasswordTTL = 10 * time.Minute
+
+	// Maximum number of successfully checked passwords remembered at once.
+	maxVerifiedPasswords = 1024
+)
+
+// authenticator checks the credentials of the users. Clients send their credentials with every request, and checking
+// a bcrypt or argon2 hash takes tens of milliseconds on purpose, so the passwords that were checked successfully are
+// remembered for a while, keyed by a hash of both the configured and the given password.
+type authenticator struct {
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time // Expiry of the successful checks.
+}
+
+func newAuthenticator() *authenticator {
+	return &authenticator{verified: map[[sha256.Size]byte]time.Time{}}
+}
+
+// Returns the user with the credentials, if any. Every user name is compared, and the password is checked against a
+// dummy bcrypt hash when the user doesn't exist, or when the password of a user with a plain text password is wrong, so
+// the time it takes to reject the credentials doesn't reveal which users exist.
+func (a *authenticator) authenticate(transmission TransmissionConfig, name, password string) (UserConfig, bool) {
+	users := transmission.users()
+	if len(users) == 0 {
+		return UserConfig{}, false
+	}
+
+	var user UserConfig
+	found := false
+	for _, candidate := range users {
+		if constantTimeEqual(name, candidate.Name) {
+			user, found = candidate, true
+		}
+	}
+	if !found {
+		a.verifyPassword(dummyPasswordHash, password)
+		return UserConfig{}, false
+	}
+	if !a.verifyPassword(user.Password, password) {
+		if !isPasswordHash(user.Password) {
+			a.verifyPassword(dummyPasswordHash, password)
+		}
+		return UserConfig{}, false
+	}
+	return user, true
+}
+
+// Compares the strings in constant time. They're hashed first so the time doesn't reveal their length either.
+func constantTimeEqual(a, b string) bool {
+	hashA, hashB := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(hashA[:], hashB[:]) == 1
+}
+
+// Returns whether the password matches the configured one, which is either a bcrypt hash, an argon2id hash in the PHC
+// format, or plain text.
+func (a *authenticator) verifyPassword(configured, password string) bool {
+	key := sha256.Sum256([]byte(configured + "\x00" + password))
+	now := time.Now()
+	a.mu.Lock()
+	expiry, cached := a.verified[key]
+	a.mu.Unlock()
+	if cached && now.Before(expiry) {
+		return true
+	}
+
+	var ok bool
+	switch {
+	case isBcryptHash(configured):
+		ok = bcrypt.CompareHashAndPassword([]byte(configured), []byte(password)) == nil
+	case strings.HasPrefix(configured, "$argon2id$"):
+		hash, err := parseArgon2Hash(configured)
+		ok = err == nil && hash.verify(password)
+	default:
+		ok = constantTimeEqual(configured, password)
+	}
+	if ok {
+		a.remember(key, now)
+	}
+	return ok
+}
+
+// Remembers the successful check, making room for it by forgetting the expired ones, or all of them when there are
+// still too many.
+func (a *authenticator) remember(key [sha256.Size]byte, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.verified) >= maxVerifiedPasswords {
+		for k, expiry := range a.verified {
+			if !now.Before(expiry) {
+				delete(a.verified, k)
+			}
+		}
+		if len(a.verified) >= maxVerifiedPasswords {
+			clear(a.verified)
+		}
+	}
+	a.verified[key] = now.Add(verifiedPasswordTTL)
+}
+
+// Returns an error when the configured password looks like a hash, but can't be parsed.
+func checkPasswordHash(configured string) error {
+	switch {
+	case isBcryptHash(configured):
+		_, err := bcrypt.Cost([]byte(configured))
+		return err
+	case strings.HasPrefix(configured, "$argon2id$"):
+		_, err := parseArgon2Hash(configured)
+		return err
+	}
+	return nil
+}
+
+// Returns whether the configured password is a bcrypt or argon2id hash, rather than plain text.
+func isPasswordHash(s string) bool {
+	return isBcryptHash(s) || strings.HasPrefix(s, "$argon2id$")
+}
+
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// argon2Hash is an argon2id hash in the PHC string format, e.g., $argon2id$v=19$m=65536,t=3,p=4$salt$hash, as output
+// by the argon2 CLI.
+type argon2Hash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(s string) (argon2Hash, error) {
+	var hash argon2Hash
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 {
+		return hash, fmt.Errorf("invalid argon2id hash: expected 5 fields, got %d", len(parts)-1)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return hash, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return hash, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.memory, &hash.time, &hash.threads); err != nil {
+		return hash, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	var err error
+	if hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return hash, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	if hash.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return hash, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	return hash, nil
+}
+
+func (h argon2Hash) verify(password string) bool {
+	key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+type userContextKey struct{}
+
+// Returns a context that carries the authenticated user.
+func withUser(ctx context.Context, user UserConfig) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// Returns the user who made the request. Requests that aren't made by a user, e.g., to the SABnzbd API which uses an
+// API key, get a user without a name or restrictions.
+func userFor(ctx context.Context) UserConfig {
+	user, _ := ctx.Value(userContextKey{}).(UserConfig)
+	return user
+}
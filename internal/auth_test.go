@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albertb/putarr/internal/fakes"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	argon2Hash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("hunter2"), salt, 1, 1024, 1, 32)))
+
+	for _, tt := range []struct {
+		explanation string
+		configured  string
+		password    string
+		valid       bool
+	}{
+		{"plain text password", "hunter2", "hunter2", true},
+		{"wrong plain text password", "hunter2", "hunter3", false},
+		{"bcrypt hash", string(bcryptHash), "hunter2", true},
+		{"wrong password for bcrypt hash", string(bcryptHash), "hunter3", false},
+		{"argon2id hash", argon2Hash, "hunter2", true},
+		{"wrong password for argon2id hash", argon2Hash, "hunter3", false},
+		{"the hash isn't a password", string(bcryptHash), string(bcryptHash), false},
+	} {
+		t.Run(tt.explanation, func(t *testing.T) {
+			auth := newAuthenticator()
+			// Check twice, since successful checks are remembered.
+			for range 2 {
+				if got, want := auth.verifyPassword(tt.configured, tt.password), tt.valid; got != want {
+					t.Fatalf("got valid %v, want %v", got, want)
+				}
+			}
+		})
+	}
+
+	if err := checkPasswordHash("$argon2id$v=19$m=1024$salt"); err == nil {
+		t.Error("got no error for a truncated argon2id hash")
+	}
+
+	// Unknown users are checked against a bcrypt hash, whatever the passwords of the other users, so they take as long
+	// to reject as the users with hashed passwords.
+	auth := newAuthenticator()
+	if err := checkPasswordHash(dummyPasswordHash); err != nil {
+		t.Fatalf("invalid dummy hash: %s", err)
+	}
+	if auth.verifyPassword(dummyPasswordHash, "hunter2") {
+		t.Error("the dummy hash matches the password")
+	}
+	transmission := TransmissionConfig{Users: []UserConfig{
+		{Name: "sonarr", Password: "hunter2"},
+		{Name: "radarr", Password: string(bcryptHash)},
+	}}
+	if _, ok := auth.authenticate(transmission, "lidarr", "hunter2"); ok {
+		t.Error("authenticated an unknown user")
+	}
+	if _, ok := auth.authenticate(transmission, "sonarr", "hunter3"); ok {
+		t.Error("authenticated a user with the wrong password")
+	}
+	if _, ok := auth.authenticate(transmission, "radarr", "hunter2"); !ok {
+		t.Error("failed to authenticate a known user")
+	}
+}
+
+func TestAuthenticator_RemembersPasswordsForAWhile(t *testing.T) {
+	auth := newAuthenticator()
+	now := time.Now()
+	for i := range maxVerifiedPasswords + 1 {
+		auth.remember(sha256.Sum256([]byte(fmt.Sprint(i))), now)
+	}
+	if got := len(auth.verified); got > maxVerifiedPasswords {
+		t.Errorf("got %d remembered passwords, want at most %d", got, maxVerifiedPasswords)
+	}
+
+	auth.verified[sha256.Sum256([]byte("hunter2\x00hunter3"))] = now.Add(-time.Second)
+	if auth.verifyPassword("hunter2", "hunter3") {
+		t.Error("an expired check was remembered")
+	}
+}
+
+func TestTransmissionRPC_UserRestrictions(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("radarr-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    "admin",
+			Password:    "hunter2",
+			DownloadDir: "/putarr",
+			Users: []UserConfig{
+				{Name: "radarr", Password: string(bcryptHash), DownloadDirs: []string{"/putarr/movies"}},
+				{Name: "dashboard", Password: "dashboard-password", Methods: []string{"session-get", "torrent-get"}},
+			},
+		}}
+	as := func(name, password string) *Config {
+		user := *config
+		user.Transmission.Username, user.Transmission.Password = name, password
+		return &user
+	}
+	admin, radarr, dashboard := config, as("radarr", "radarr-password"), as("dashboard", "dashboard-password")
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "transfers.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	server := httptest.NewServer(NewServer(config, NewPutioProxy(config, fakePutio.NewClient(), store), nil))
+	defer server.Close()
+
+	doRPCAndExpectCode[any](t, as("radarr", "hunter2"), server.URL, "session-get", nil, http.StatusUnauthorized)
+
+	// Users can only add torrents to their download directories, and the user is recorded with the transfer.
+	movie := doRPCAndExpectOK[map[string]Torrent](t, radarr, server.URL, "torrent-add", map[string]any{
+		"filename":     "magnet:?xt=urn:btih:AAA&dn=movie",
+		"download-dir": "/putarr/movies"})["torrent-added"]
+	if metadata, _ := store.Get(int64(movie.ID)); metadata.User != "radarr" {
+		t.Errorf("got user %q in the metadata of the transfer, want %q", metadata.User, "radarr")
+	}
+	doRPCAndExpectResult(t, radarr, server.URL, "torrent-add", map[string]any{
+		"filename":     "magnet:?xt=urn:btih:BBB&dn=show",
+		"download-dir": "/putarr/moviesandtv"}, "user `radarr` isn't allowed to add torrents to /putarr/moviesandtv")
+	show := doRPCAndExpectOK[map[string]Torrent](t, admin, server.URL, "torrent-add", map[string]any{
+		"filename":     "magnet:?xt=urn:btih:BBB&dn=show",
+		"download-dir": "/putarr/tv"})["torrent-added"]
+
+	// Users only see, and change, the transfers in their download directories.
+	torrentNames := func(config *Config) string {
+		t.Helper()
+		var names []string
+		for _, torrent := range doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)["torrents"] {
+			names = append(names, torrent.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	if got, want := torrentNames(radarr), "movie"; got != want {
+		t.Errorf("got torrents %q for radarr, want %q", got, want)
+	}
+	if got, want := torrentNames(dashboard), "movie,show"; got != want {
+		t.Errorf("got torrents %q for the dashboard, want %q", got, want)
+	}
+	doRPCAndExpectResult(t, radarr, server.URL, "torrent-remove", map[string]any{
+		"ids":               []any{*show.HashString},
+		"delete-local-data": false,
+	}, fmt.Sprintf("user `radarr` isn't allowed to change the torrent with ID `%d`", show.ID))
+
+	// Users can only call their methods.
+	doRPCAndExpectResult(t, dashboard, server.URL, "torrent-remove", map[string]any{
+		"ids":               []any{*movie.HashString},
+		"delete-local-data": false,
+	}, "user `dashboard` isn't allowed to call torrent-remove")
+	doRPCAndExpectOK[any](t, radarr, server.URL, "torrent-remove", map[string]any{
+		"ids":               []any{*movie.HashString},
+		"delete-local-data": false,
+	})
+	if got, want := torrentNames(admin), "show"; got != want {
+		t.Errorf("got torrents %q for the admin, want %q", got, want)
+	}
+}
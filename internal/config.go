@@ -4,95 +4,341 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"regexp"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
+	Server       ServerConfig       `yaml:"server"`
 	Downloader   DownloaderConfig   `yaml:"downloader"`
 	Transmission TransmissionConfig `yaml:"transmission"`
 	Putio        PutioConfig        `yaml:"putio"`
-	Radarr       *RadarrConfig      `yaml:"radarr"`
-	Sonarr       *SonarrConfig      `yaml:"sonarr"`
+	Store        StoreConfig        `yaml:"store"`
+	SABnzbd      *SABnzbdConfig     `yaml:"sabnzbd"`
+	Radarr       ArrConfigs         `yaml:"radarr"`
+	Sonarr       ArrConfigs         `yaml:"sonarr"`
+	Lidarr       ArrConfigs         `yaml:"lidarr"`
+	Readarr      ArrConfigs         `yaml:"readarr"`
+	Whisparr     ArrConfigs         `yaml:"whisparr"`
+}
+
+type ServerConfig struct {
+	// How long to wait for the requests in flight and the background tasks to finish when shutting down. Defaults to 30s.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// Reverse proxies in front of Putarr, as IP addresses or CIDR ranges, whose X-Forwarded-For header is trusted to
+	// identify the clients.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// Number of failed logins in a row after which a client IP is locked out. Before that, each failure after the first
+	// makes the client wait before its next attempt, from 1s and twice as long after every failure. Defaults to 10.
+	LoginAttempts int `yaml:"login_attempts"`
+	// How long a client IP stays locked out, and how long its failed logins are remembered. Defaults to 15m.
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+
+	// Number of torrents each user can add per minute, on average. Unset for no limit.
+	AddsPerMinute int `yaml:"adds_per_minute"`
+	// Number of torrents each user can add at once, before the limit above kicks in. Defaults to adds_per_minute.
+	AddBurst int `yaml:"add_burst"`
 }
 
 type DownloaderConfig struct {
 	// Download directory from the point-of-view of Putarr. Leave this unset to disable local downloading.
-	Dir string `yaml:"dir"`
+	Dir      string        `yaml:"dir"`
+	Interval time.Duration `yaml:"interval"` // How often to look for completed transfers to download. Defaults to 1m.
+	Segments int           `yaml:"segments"` // How many segments of a file to download in parallel. Defaults to 4.
 }
 
 type TransmissionConfig struct {
 	Username    string `yaml:"username"`     // Username clients must use to communicate with this server.
 	Password    string `yaml:"password"`     // Password clients must use to communicate with this server.
 	DownloadDir string `yaml:"download_dir"` // Download directory to report to clients; this is the directory from the point-of-view of the *arrs.
+
+	// How often the session ID clients must send with their requests is rotated. It's also rotated on every restart.
+	// Defaults to 1h.
+	SessionRotation time.Duration `yaml:"session_rotation"`
+	// How long the previous session ID is still accepted after a rotation. Defaults to 1m.
+	SessionOverlap time.Duration `yaml:"session_overlap"`
+
+	// Additional users, e.g., one for each *arr, with their own credentials and optional restrictions. Either these or
+	// the username and password above are required.
+	Users []UserConfig `yaml:"users"`
+}
+
+// UserConfig is a client of the APIs, with its own credentials. The restrictions are optional, and apply to the
+// qBittorrent API as well as to the Transmission RPC.
+type UserConfig struct {
+	Name         string   `yaml:"name"`
+	Password     string   `yaml:"password"`      // Plain text, or a bcrypt or argon2id hash.
+	DownloadDirs []string `yaml:"download_dirs"` // Download directories the user can add to and see transfers in.
+	Methods      []string `yaml:"methods"`       // Transmission RPC methods the user can call, e.g., torrent-get.
 }
 
 type PutioConfig struct {
 	OAuthToken      string        `yaml:"oauth_token"`      // Token to authenticate with Put.io.
 	ParentDirID     int64         `yaml:"parent_dir_id"`    // Parent directory for new transfers on Put.io. Unset for default.
-	JanitorInterval time.Duration `yaml:"janitor_interval"` // How often to run the janitor to remove completed transfers and files.
+	JanitorInterval time.Duration `yaml:"janitor_interval"` // How often to run the janitor to remove completed transfers and files. Defaults to 1h.
 
 	// When multiple instances of Putiarr are using a single Put.io account, the friend token is used to disambiguate
 	// transfer ownership. When this is left unset, all Putiarr initiated transfers on the Put.io account are assumed to
 	// belong to a single instance.
 	FriendToken string `yaml:"friend_token"`
+
+	// Torrents that are uploaded to Put.io as is, rather than converted to magnet links.
+	UploadTorrents UploadTorrentsConfig `yaml:"upload_torrents"`
 }
 
-type RadarrConfig struct {
-	APIKey string `yaml:"api_key"`
-	URL    string `yaml:"url"`
+// UploadTorrentsConfig selects the torrent files to upload to Put.io as is. Private trackers need this, since their
+// announce URLs carry a passkey that magnet links lose. Uploaded transfers are tracked in the store.
+type UploadTorrentsConfig struct {
+	DownloadDirs []string `yaml:"download_dirs"` // Download directories, as seen by the *arrs, including sub-directories.
+	Labels       []string `yaml:"labels"`        // Labels, or qBittorrent tags, of the torrents.
+}
+
+type StoreConfig struct {
+	// Where the metadata of transfers is persisted: "file", the default, or "putio" to keep it in the config service of
+	// the Put.io account, where it's shared with the other instances using the account.
+	Backend string `yaml:"backend"`
+
+	// File where the metadata of transfers is persisted. Defaults to transfers.json next to the config file.
+	Path string `yaml:"path"`
+
+	// Name of this instance among the ones sharing the Put.io account, with the putio backend. Defaults to putarr.
+	Instance string `yaml:"instance"`
 }
 
-type SonarrConfig struct {
+// Names of the instances are part of the keys of the Put.io config service.
+var instanceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// SABnzbdConfig enables the SABnzbd API, so Put.io URL transfers can be used as a Usenet download client.
+type SABnzbdConfig struct {
+	APIKey string `yaml:"api_key"` // API key clients must use to communicate with this server.
+}
+
+// ArrConfig is the configuration of a single *arr instance.
+type ArrConfig struct {
+	Name   string `yaml:"name"` // Name of the instance, required when there are multiple instances of the same *arr.
 	APIKey string `yaml:"api_key"`
 	URL    string `yaml:"url"`
 }
 
+// ArrConfigs lists the instances of an *arr. A single instance can also be configured as a mapping rather than a list.
+type ArrConfigs []ArrConfig
+
+func (c *ArrConfigs) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		var instance ArrConfig
+		if err := node.Decode(&instance); err != nil {
+			return err
+		}
+		*c = ArrConfigs{instance}
+		return nil
+	}
+
+	var instances []ArrConfig
+	if err := node.Decode(&instances); err != nil {
+		return err
+	}
+	*c = instances
+	return nil
+}
+
+// ReadConfig reads the config file, interpolates the environment variables it references, applies the PUTARR_*
+// environment overrides, and validates the result. See envPrefix for the precedence of the sources. The config file
+// can be empty when the whole config comes from the environment.
 func ReadConfig(reader io.Reader) (Config, error) {
 	var config Config
-	if err := yaml.NewDecoder(reader).Decode(&config); err != nil {
+	var node yaml.Node
+	sources := configSources{}
+	if err := yaml.NewDecoder(reader).Decode(&node); err != nil && !errors.Is(err, io.EOF) {
+		return config, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := interpolateEnv(&node, "", sources); err != nil {
 		return config, fmt.Errorf("failed to read config file: %w", err)
 	}
-	return validate(config)
+	if !node.IsZero() {
+		if err := node.Decode(&config); err != nil {
+			return config, fmt.Errorf("failed to read config file: %w", err)
+		}
+	}
+	if err := applyEnvOverrides(&config, sources); err != nil {
+		return config, fmt.Errorf("failed to read environment: %w", err)
+	}
+	return validate(config, sources)
 }
 
-func validate(config Config) (Config, error) {
-	if config.Transmission.Username == "" {
-		return config, errors.New("transmission.username is required")
+func validate(config Config, sources configSources) (Config, error) {
+	if len(config.Transmission.Users) == 0 || config.Transmission.Username != "" {
+		if config.Transmission.Username == "" {
+			return config, errors.New("transmission.username is required")
+		}
+		if config.Transmission.Password == "" {
+			return config, errors.New("transmission.password is required")
+		}
 	}
-	if config.Transmission.Password == "" {
-		return config, errors.New("transmission.password is required")
+	if err := checkPasswordHash(config.Transmission.Password); err != nil {
+		return config, sources.errorf("transmission.password", "transmission.password: %s", err)
+	}
+	userNames := map[string]bool{config.Transmission.Username: true}
+	for i, user := range config.Transmission.Users {
+		field := fmt.Sprintf("transmission.users[%d]", i)
+		if user.Name == "" {
+			return config, fmt.Errorf("%s.name is required", field)
+		}
+		if userNames[user.Name] {
+			return config, sources.errorf(field+".name", "duplicate user name `%s`", user.Name)
+		}
+		userNames[user.Name] = true
+		if user.Password == "" {
+			return config, fmt.Errorf("%s.password is required", field)
+		}
+		if err := checkPasswordHash(user.Password); err != nil {
+			return config, sources.errorf(field+".password", "%s.password: %s", field, err)
+		}
 	}
 	if config.Transmission.DownloadDir == "" {
 		return config, errors.New("transmission.download_dir is required")
 	}
 
+	if config.Transmission.SessionRotation == 0 {
+		config.Transmission.SessionRotation = time.Hour
+	}
+	if config.Transmission.SessionRotation < 0 {
+		return config, sources.errorf("transmission.session_rotation", "transmission.session_rotation must be positive")
+	}
+	if config.Transmission.SessionOverlap == 0 {
+		config.Transmission.SessionOverlap = time.Minute
+	}
+	if config.Transmission.SessionOverlap < 0 {
+		return config, sources.errorf("transmission.session_overlap", "transmission.session_overlap must be positive")
+	}
+
+	if config.Server.ShutdownTimeout == 0 {
+		config.Server.ShutdownTimeout = 30 * time.Second
+	}
+	if config.Server.ShutdownTimeout < 0 {
+		return config, sources.errorf("server.shutdown_timeout", "server.shutdown_timeout must be positive")
+	}
+	if _, err := parseTrustedProxies(config.Server.TrustedProxies); err != nil {
+		return config, sources.errorf("server.trusted_proxies", "invalid server.trusted_proxies: %s", err)
+	}
+	if config.Server.LoginAttempts == 0 {
+		config.Server.LoginAttempts = 10
+	}
+	if config.Server.LoginAttempts < 0 {
+		return config, sources.errorf("server.login_attempts", "server.login_attempts must be positive")
+	}
+	if config.Server.LockoutDuration == 0 {
+		config.Server.LockoutDuration = 15 * time.Minute
+	}
+	if config.Server.LockoutDuration < 0 {
+		return config, sources.errorf("server.lockout_duration", "server.lockout_duration must be positive")
+	}
+	if config.Server.AddsPerMinute < 0 {
+		return config, sources.errorf("server.adds_per_minute", "server.adds_per_minute must be positive")
+	}
+	if config.Server.AddBurst == 0 {
+		config.Server.AddBurst = config.Server.AddsPerMinute
+	}
+	if config.Server.AddBurst < 0 {
+		return config, sources.errorf("server.add_burst", "server.add_burst must be positive")
+	}
+
+	if config.Downloader.Dir != "" {
+		if config.Downloader.Interval == 0 {
+			config.Downloader.Interval = time.Minute
+		}
+		if config.Downloader.Interval < 0 {
+			return config, sources.errorf("downloader.interval", "downloader.interval must be positive")
+		}
+		if config.Downloader.Segments == 0 {
+			config.Downloader.Segments = 4
+		}
+		if config.Downloader.Segments < 0 {
+			return config, sources.errorf("downloader.segments", "downloader.segments must be positive")
+		}
+	}
+
 	if config.Putio.OAuthToken == "" {
 		return config, errors.New("putio.oauth_token is required")
 	}
+	if config.Putio.JanitorInterval == 0 {
+		config.Putio.JanitorInterval = time.Hour
+	}
+	if config.Putio.JanitorInterval < 0 {
+		return config, sources.errorf("putio.janitor_interval", "putio.janitor_interval must be positive")
+	}
 
-	if config.Radarr == nil && config.Sonarr == nil {
-		return config, errors.New("at least one of radarr or sonarr is required")
+	switch config.Store.Backend {
+	case "", "file":
+		config.Store.Backend = "file"
+	case "putio":
+		if config.Store.Instance == "" {
+			config.Store.Instance = "putarr"
+		}
+		if !instanceNamePattern.MatchString(config.Store.Instance) {
+			return config, sources.errorf("store.instance",
+				"store.instance must only have lowercase letters, digits and dashes")
+		}
+	default:
+		return config, sources.errorf("store.backend", "store.backend must be file or putio, got `%s`",
+			config.Store.Backend)
 	}
 
-	if c := config.Radarr; c != nil {
+	if c := config.SABnzbd; c != nil {
 		if c.APIKey == "" {
-			return config, errors.New("radarr.api_key is required")
+			return config, errors.New("sabnzbd.api_key is required")
 		}
-		if c.URL == "" {
-			return config, errors.New("radarr.url is required")
+	}
+
+	if len(config.Radarr) == 0 && len(config.Sonarr) == 0 && len(config.Lidarr) == 0 && len(config.Readarr) == 0 &&
+		len(config.Whisparr) == 0 {
+		return config, errors.New("at least one of radarr, sonarr, lidarr, readarr or whisparr is required")
+	}
+
+	for _, arr := range []struct {
+		name    string
+		configs ArrConfigs
+	}{
+		{"radarr", config.Radarr},
+		{"sonarr", config.Sonarr},
+		{"lidarr", config.Lidarr},
+		{"readarr", config.Readarr},
+		{"whisparr", config.Whisparr},
+	} {
+		if err := validateArrConfigs(arr.name, arr.configs, sources); err != nil {
+			return config, err
 		}
 	}
 
-	if c := config.Sonarr; c != nil {
+	return config, nil
+}
+
+// Validates the instances of an *arr, and names the instance after the *arr when there's only one.
+func validateArrConfigs(arr string, configs ArrConfigs, sources configSources) error {
+	names := map[string]bool{}
+	for i := range configs {
+		c := &configs[i]
+		if c.Name == "" {
+			if len(configs) > 1 {
+				return fmt.Errorf("%s[%d].name is required when there are multiple instances", arr, i)
+			}
+			c.Name = arr
+		}
+		if names[c.Name] {
+			field := fmt.Sprintf("%s[%d].name", arr, i)
+			return sources.errorf(field, "%s %q is used by another instance", field, c.Name)
+		}
+		names[c.Name] = true
+
 		if c.APIKey == "" {
-			return config, errors.New("sonarr.api_key is required")
+			return fmt.Errorf("%s[%d].api_key is required", arr, i)
 		}
 		if c.URL == "" {
-			return config, errors.New("sonarr.url is required")
+			return fmt.Errorf("%s[%d].url is required", arr, i)
 		}
 	}
-
-	return config, nil
+	return nil
 }
@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Every field of the config can be overridden by an environment variable named after its path in the config file,
+// e.g., PUTARR_PUTIO_OAUTH_TOKEN for putio.oauth_token, or PUTARR_RADARR_0_API_KEY for the first Radarr instance. The
+// variable with a _FILE suffix reads the value from a file instead, e.g., a Docker or Kubernetes secret.
+//
+// The precedence is, from highest to lowest: the environment variable, the _FILE variable, the config file with its
+// ${VAR} references interpolated, and the defaults. Setting both the variable and its _FILE variant is an error.
+const envPrefix = "PUTARR"
+
+// References to environment variables in the config file. $${VAR} escapes a literal ${VAR}.
+var envReferencePattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// configSources records where the values of the config came from, keyed by their path in the config file, e.g.,
+// radarr[0].api_key. The values that aren't in there came straight from the config file, or are defaults.
+type configSources map[string]string
+
+// Returns a description of where the value of the field came from.
+func (s configSources) describe(field string) string {
+	if source, ok := s[field]; ok {
+		return source
+	}
+	return "the config file"
+}
+
+// Returns an error about the value of the field, which names where the value came from.
+func (s configSources) errorf(field, format string, args ...any) error {
+	return fmt.Errorf("%s (set by %s)", fmt.Sprintf(format, args...), s.describe(field))
+}
+
+// Replaces the ${VAR} references in the scalar values of the config file with the value of the environment
+// variables. Referencing a variable that isn't set is an error, rather than silently leaving a setting empty.
+func interpolateEnv(node *yaml.Node, path string, sources configSources) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for i, child := range node.Content {
+			childPath := path
+			if node.Kind == yaml.SequenceNode {
+				childPath = fmt.Sprintf("%s[%d]", path, i)
+			}
+			if err := interpolateEnv(child, childPath, sources); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			childPath := node.Content[i].Value
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+			// A single *arr instance can be configured as a mapping, but it's still the first instance.
+			if path == "" && node.Content[i+1].Kind == yaml.MappingNode && isArrField(childPath) {
+				childPath += "[0]"
+			}
+			if err := interpolateEnv(node.Content[i+1], childPath, sources); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		var errs []string
+		var names []string
+		node.Value = envReferencePattern.ReplaceAllStringFunc(node.Value, func(reference string) string {
+			if strings.HasPrefix(reference, "$$") {
+				return reference[1:]
+			}
+			name := envReferencePattern.FindStringSubmatch(reference)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				errs = append(errs, name)
+			}
+			names = append(names, "${"+name+"}")
+			return value
+		})
+		if len(errs) > 0 {
+			return fmt.Errorf("%s references environment variable %s, which isn't set", path, errs[0])
+		}
+		if len(names) > 0 {
+			sources[path] = "the config file via " + strings.Join(names, ", ")
+			// Let YAML resolve the type of the interpolated value, e.g., an integer, unless it was quoted.
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	}
+	return nil
+}
+
+// Returns whether the top-level field of the config lists the instances of an *arr.
+func isArrField(field string) bool {
+	t := reflect.TypeFor[Config]()
+	for i := range t.NumField() {
+		if yamlName(t.Field(i)) == field {
+			return t.Field(i).Type == reflect.TypeFor[ArrConfigs]()
+		}
+	}
+	return false
+}
+
+// Overrides the fields of the config with the PUTARR_* environment variables.
+func applyEnvOverrides(config *Config, sources configSources) error {
+	return overrideFromEnv(reflect.ValueOf(config).Elem(), "", envPrefix, sources)
+}
+
+func overrideFromEnv(value reflect.Value, path, env string, sources configSources) error {
+	switch {
+	case value.Kind() == reflect.Struct:
+		for i := range value.NumField() {
+			field := value.Type().Field(i)
+			name := yamlName(field)
+			if name == "" || !field.IsExported() {
+				continue
+			}
+			childPath := name
+			if path != "" {
+				childPath = path + "." + name
+			}
+			if err := overrideFromEnv(value.Field(i), childPath, env+"_"+strings.ToUpper(name), sources); err != nil {
+				return err
+			}
+		}
+		return nil
+	case value.Kind() == reflect.Pointer && value.Type().Elem().Kind() == reflect.Struct:
+		// Optional sections, like sabnzbd, are enabled by setting any of their fields.
+		if value.IsNil() {
+			if !hasEnvWithPrefix(env + "_") {
+				return nil
+			}
+			value.Set(reflect.New(value.Type().Elem()))
+		}
+		return overrideFromEnv(value.Elem(), path, env, sources)
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct:
+		// Instances are overridden by index, and the variables of the next index add an instance.
+		for i := 0; ; i++ {
+			elemEnv := fmt.Sprintf("%s_%d", env, i)
+			if i == value.Len() {
+				if !hasEnvWithPrefix(elemEnv + "_") {
+					return nil
+				}
+				value.Set(reflect.Append(value, reflect.New(value.Type().Elem()).Elem()))
+			}
+			if err := overrideFromEnv(value.Index(i), fmt.Sprintf("%s[%d]", path, i), elemEnv, sources); err != nil {
+				return err
+			}
+		}
+	}
+
+	raw, source, ok, err := lookupEnvOrFile(env)
+	if err != nil || !ok {
+		return err
+	}
+	if err := setFromString(value, raw); err != nil {
+		return fmt.Errorf("%s: invalid value for %s: %w", source, path, err)
+	}
+	sources[path] = source
+	return nil
+}
+
+// Returns the value of the environment variable, or the content of the file named by its _FILE variant, along with a
+// description of where it came from.
+func lookupEnvOrFile(env string) (value, source string, ok bool, err error) {
+	value, ok = os.LookupEnv(env)
+	path, fileOK := os.LookupEnv(env + "_FILE")
+	switch {
+	case ok && fileOK:
+		return "", "", false, fmt.Errorf("only one of %s and %s_FILE can be set", env, env)
+	case ok:
+		return value, env, true, nil
+	case fileOK:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", false, fmt.Errorf("failed to read %s_FILE: %w", env, err)
+		}
+		// Secrets files usually end with a newline that isn't part of the secret.
+		return strings.TrimRight(string(data), "\r\n"), fmt.Sprintf("the file %s from %s_FILE", path, env), true, nil
+	}
+	return "", "", false, nil
+}
+
+// Returns whether any environment variable starts with the prefix.
+func hasEnvWithPrefix(prefix string) bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses the string into the field, which is one of the types used by the config. Lists are comma-separated.
+func setFromString(value reflect.Value, raw string) error {
+	switch {
+	case value.Type() == reflect.TypeFor[time.Duration]():
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+	case value.Kind() == reflect.String:
+		value.SetString(raw)
+	case value.Kind() == reflect.Int || value.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(n)
+	case value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+// Returns the name of the field in the config file.
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	return name
+}
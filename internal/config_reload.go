@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigSource provides the current configuration. A *Config is a source of itself that never changes, while a
+// *LiveConfig is swapped when the config file is reloaded.
+type ConfigSource interface {
+	Current() *Config
+}
+
+// Current returns the config itself.
+func (c *Config) Current() *Config {
+	return c
+}
+
+// LiveConfig holds the configuration while it's reloaded from the config file. The config is swapped atomically, so
+// readers always see a complete one; requests take a snapshot when they start so they see a consistent one too.
+type LiveConfig struct {
+	current atomic.Pointer[Config]
+	load    func() (*Config, error)
+
+	mu       sync.Mutex // Serializes reloads.
+	modTime  time.Time
+	onReload []func(config *Config)
+}
+
+// NewLiveConfig returns a live config that starts with the given config, and loads new ones with the load function,
+// e.g., ReadConfig with the defaults that depend on the path of the config file.
+func NewLiveConfig(config *Config, load func() (*Config, error)) *LiveConfig {
+	c := &LiveConfig{load: load}
+	c.current.Store(config)
+	return c
+}
+
+// Current returns the current config, which must not be modified.
+func (c *LiveConfig) Current() *Config {
+	return c.current.Load()
+}
+
+// OnReload registers a function that's called with the new config after every successful reload, e.g., to recreate
+// what was built from the previous one.
+func (c *LiveConfig) OnReload(fn func(config *Config)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onReload = append(c.onReload, fn)
+}
+
+// Reload loads and validates the config, and swaps it in. When the new config is invalid, or changes settings that
+// can't change while Putarr runs, the error is returned and the previous config is kept.
+func (c *LiveConfig) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	config, err := c.load()
+	if err != nil {
+		return fmt.Errorf("keeping the previous config: %w", err)
+	}
+	if changed := restartOnlySettingsChanged(c.current.Load(), config); len(changed) > 0 {
+		return fmt.Errorf("keeping the previous config: restart Putarr to change %s", strings.Join(changed, ", "))
+	}
+	c.current.Store(config)
+	for _, fn := range c.onReload {
+		fn(config)
+	}
+	log.Println("reloaded config")
+	return nil
+}
+
+// Returns the names of the settings that only take effect on restart, and differ between the configs.
+func restartOnlySettingsChanged(previous, config *Config) []string {
+	var changed []string
+	for _, setting := range []struct {
+		name    string
+		changed bool
+	}{
+		{"putio.oauth_token", previous.Putio.OAuthToken != config.Putio.OAuthToken},
+		{"putio.friend_token", previous.Putio.FriendToken != config.Putio.FriendToken},
+		{"store", previous.Store != config.Store},
+		{"downloader.dir", previous.Downloader.Dir != config.Downloader.Dir},
+		{"server.shutdown_timeout", previous.Server.ShutdownTimeout != config.Server.ShutdownTimeout},
+	} {
+		if setting.changed {
+			changed = append(changed, setting.name)
+		}
+	}
+	return changed
+}
+
+// WatchFile reloads the config whenever the file at the given path is modified, checking every interval until the
+// context is done. Polling rather than relying on file system events also catches the config maps of Kubernetes,
+// which are swapped by symlink.
+func (c *LiveConfig) WatchFile(ctx context.Context, path string, interval time.Duration) {
+	c.modTime = configModTime(path)
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			modTime := configModTime(path)
+			if modTime.IsZero() || modTime.Equal(c.modTime) {
+				continue
+			}
+			c.modTime = modTime
+			if err := c.Reload(); err != nil {
+				log.Println("failed to reload config:", err)
+			}
+		}
+	}()
+}
+
+// Returns the modification time of the file, or zero if it can't be read, e.g., while it's replaced.
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+type configContextKey struct{}
+
+// Returns a copy of the context that carries the config snapshot of a request.
+func withConfig(ctx context.Context, config *Config) context.Context {
+	return context.WithValue(ctx, configContextKey{}, config)
+}
+
+// Returns the config snapshot of the request the context belongs to, or the current config of the source outside of
+// requests.
+func configFor(ctx context.Context, source ConfigSource) *Config {
+	if config, ok := ctx.Value(configContextKey{}).(*Config); ok {
+		return config
+	}
+	return source.Current()
+}
+
+// Takes a snapshot of the config for each request, so the config doesn't change halfway through.
+func configSnapshotMiddleware(source ConfigSource, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withConfig(r.Context(), source.Current())))
+	})
+}
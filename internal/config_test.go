@@ -0,0 +1,419 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albertb/putarr/internal/fakes"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testConfigPreamble = `
+transmission:
+  username: username
+  password: password
+  download_dir: /putarr
+putio:
+  oauth_token: token
+`
+
+func TestReadConfig_ArrInstances(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		yaml    string
+		want    ArrConfigs
+		wantErr string
+	}{
+		{
+			name: "single instance",
+			yaml: `
+radarr:
+  url: http://radarr
+  api_key: 123
+`,
+			want: ArrConfigs{{Name: "radarr", URL: "http://radarr", APIKey: "123"}},
+		},
+		{
+			name: "named instances",
+			yaml: `
+radarr:
+  - name: hd
+    url: http://radarr
+    api_key: 123
+  - name: 4k
+    url: http://radarr4k
+    api_key: 456
+`,
+			want: ArrConfigs{
+				{Name: "hd", URL: "http://radarr", APIKey: "123"},
+				{Name: "4k", URL: "http://radarr4k", APIKey: "456"},
+			},
+		},
+		{
+			name: "unnamed instances",
+			yaml: `
+radarr:
+  - url: http://radarr
+    api_key: 123
+  - url: http://radarr4k
+    api_key: 456
+`,
+			wantErr: "radarr[0].name is required when there are multiple instances",
+		},
+		{
+			name: "duplicate names",
+			yaml: `
+radarr:
+  - name: hd
+    url: http://radarr
+    api_key: 123
+  - name: hd
+    url: http://radarr4k
+    api_key: 456
+`,
+			wantErr: `radarr[1].name "hd" is used by another instance (set by the config file)`,
+		},
+		{
+			name: "missing url",
+			yaml: `
+radarr:
+  - name: hd
+    api_key: 123
+`,
+			wantErr: "radarr[0].url is required",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := ReadConfig(strings.NewReader(testConfigPreamble + tc.yaml))
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read config: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, config.Radarr); diff != "" {
+				t.Fatalf("unexpected radarr instances (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReadConfig_Environment(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "oauth_token")
+	if err := os.WriteFile(secret, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("failed to write secret: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		yaml    string
+		env     map[string]string
+		want    func(config *Config)
+		wantErr string
+	}{
+		{
+			name: "interpolation",
+			yaml: testConfigPreamble + `
+radarr:
+  url: http://${RADARR_HOST}:7878
+  api_key: $${literal}
+`,
+			env: map[string]string{"RADARR_HOST": "radarr"},
+			want: func(config *Config) {
+				config.Radarr = ArrConfigs{{Name: "radarr", URL: "http://radarr:7878", APIKey: "${literal}"}}
+			},
+		},
+		{
+			name:    "interpolation of a missing variable",
+			yaml:    testConfigPreamble + "radarr:\n  url: http://radarr\n  api_key: ${RADARR_API_KEY}\n",
+			wantErr: "failed to read config file: radarr[0].api_key references environment variable RADARR_API_KEY, which isn't set",
+		},
+		{
+			name: "overrides",
+			yaml: testConfigPreamble + "radarr:\n  url: http://radarr\n  api_key: 123\n",
+			env: map[string]string{
+				"PUTARR_PUTIO_OAUTH_TOKEN_FILE":       secret,
+				"PUTARR_PUTIO_JANITOR_INTERVAL":       "2h",
+				"PUTARR_PUTIO_UPLOAD_TORRENTS_LABELS": "private, tracker",
+				"PUTARR_RADARR_0_NAME":                "hd",
+				"PUTARR_RADARR_0_API_KEY":             "456",
+				"PUTARR_RADARR_1_NAME":                "4k",
+				"PUTARR_RADARR_1_URL":                 "http://radarr4k",
+				"PUTARR_RADARR_1_API_KEY":             "789",
+				"PUTARR_SABNZBD_API_KEY":              "abc",
+				"PUTARR_TRANSMISSION_DOWNLOAD_DIR":    "/downloads",
+			},
+			want: func(config *Config) {
+				config.Putio.OAuthToken = "from-file"
+				config.Putio.JanitorInterval = 2 * time.Hour
+				config.Putio.UploadTorrents.Labels = []string{"private", "tracker"}
+				config.Radarr = ArrConfigs{
+					{Name: "hd", URL: "http://radarr", APIKey: "456"},
+					{Name: "4k", URL: "http://radarr4k", APIKey: "789"},
+				}
+				config.SABnzbd = &SABnzbdConfig{APIKey: "abc"}
+				config.Transmission.DownloadDir = "/downloads"
+			},
+		},
+		{
+			name: "variable and file",
+			yaml: testConfigPreamble + "radarr:\n  url: http://radarr\n  api_key: 123\n",
+			env: map[string]string{
+				"PUTARR_PUTIO_OAUTH_TOKEN":      "token",
+				"PUTARR_PUTIO_OAUTH_TOKEN_FILE": secret,
+			},
+			wantErr: "failed to read environment: only one of PUTARR_PUTIO_OAUTH_TOKEN and PUTARR_PUTIO_OAUTH_TOKEN_FILE can be set",
+		},
+		{
+			name:    "invalid value",
+			yaml:    testConfigPreamble + "radarr:\n  url: http://radarr\n  api_key: 123\n",
+			env:     map[string]string{"PUTARR_DOWNLOADER_SEGMENTS": "many"},
+			wantErr: `failed to read environment: PUTARR_DOWNLOADER_SEGMENTS: invalid value for downloader.segments: strconv.ParseInt: parsing "many": invalid syntax`,
+		},
+		{
+			name: "validation error names the source",
+			yaml: testConfigPreamble + `
+downloader:
+  dir: /downloads
+  segments: ${SEGMENTS}
+radarr:
+  url: http://radarr
+  api_key: 123
+`,
+			env:     map[string]string{"SEGMENTS": "-1"},
+			wantErr: "downloader.segments must be positive (set by the config file via ${SEGMENTS})",
+		},
+		{
+			name:    "negative interval",
+			yaml:    testConfigPreamble + "radarr:\n  url: http://radarr\n  api_key: 123\n",
+			env:     map[string]string{"PUTARR_PUTIO_JANITOR_INTERVAL": "-1m"},
+			wantErr: "putio.janitor_interval must be positive (set by PUTARR_PUTIO_JANITOR_INTERVAL)",
+		},
+		{
+			name:    "validation error names the variable",
+			yaml:    testConfigPreamble + "radarr:\n  url: http://radarr\n  api_key: 123\n",
+			env:     map[string]string{"PUTARR_STORE_BACKEND": "s3"},
+			wantErr: "store.backend must be file or putio, got `s3` (set by PUTARR_STORE_BACKEND)",
+		},
+		{
+			name: "users",
+			yaml: testConfigPreamble + "radarr:\n  url: http://radarr\n  api_key: 123\n",
+			env: map[string]string{
+				"PUTARR_TRANSMISSION_USERS_0_NAME":          "radarr",
+				"PUTARR_TRANSMISSION_USERS_0_PASSWORD":      "hunter2",
+				"PUTARR_TRANSMISSION_USERS_0_DOWNLOAD_DIRS": "/putarr/movies",
+				"PUTARR_TRANSMISSION_USERS_1_NAME":          "dashboard",
+				"PUTARR_TRANSMISSION_USERS_1_PASSWORD":      "hunter3",
+				"PUTARR_TRANSMISSION_USERS_1_METHODS":       "session-get,torrent-get",
+			},
+			want: func(config *Config) {
+				config.Transmission.Users = []UserConfig{
+					{Name: "radarr", Password: "hunter2", DownloadDirs: []string{"/putarr/movies"}},
+					{Name: "dashboard", Password: "hunter3", Methods: []string{"session-get", "torrent-get"}},
+				}
+			},
+		},
+		{
+			name: "duplicate user",
+			yaml: testConfigPreamble + "radarr:\n  url: http://radarr\n  api_key: 123\n",
+			env: map[string]string{
+				"PUTARR_TRANSMISSION_USERS_0_NAME":     "username",
+				"PUTARR_TRANSMISSION_USERS_0_PASSWORD": "hunter2",
+			},
+			wantErr: "duplicate user name `username` (set by PUTARR_TRANSMISSION_USERS_0_NAME)",
+		},
+		{
+			name: "invalid password hash",
+			yaml: `
+transmission:
+  download_dir: /putarr
+  users:
+    - name: radarr
+      password: $2b$10$tooshort
+putio:
+  oauth_token: token
+radarr:
+  url: http://radarr
+  api_key: 123
+`,
+			wantErr: "transmission.users[0].password: crypto/bcrypt: hashedSecret too short to be a bcrypted password (set by the config file)",
+		},
+		{
+			name: "empty config file",
+			env: map[string]string{
+				"PUTARR_TRANSMISSION_USERNAME":     "username",
+				"PUTARR_TRANSMISSION_PASSWORD":     "password",
+				"PUTARR_TRANSMISSION_DOWNLOAD_DIR": "/putarr",
+				"PUTARR_PUTIO_OAUTH_TOKEN":         "token",
+				"PUTARR_SONARR_0_URL":              "http://sonarr",
+				"PUTARR_SONARR_0_API_KEY":          "123",
+			},
+			want: func(config *Config) {
+				config.Radarr = nil
+				config.Sonarr = ArrConfigs{{Name: "sonarr", URL: "http://sonarr", APIKey: "123"}}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+			config, err := ReadConfig(strings.NewReader(tc.yaml))
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read config: %s", err)
+			}
+
+			want := Config{
+				Server: ServerConfig{
+					ShutdownTimeout: 30 * time.Second,
+					LoginAttempts:   10,
+					LockoutDuration: 15 * time.Minute,
+				},
+				Transmission: TransmissionConfig{
+					Username:        "username",
+					Password:        "password",
+					DownloadDir:     "/putarr",
+					SessionRotation: time.Hour,
+					SessionOverlap:  time.Minute,
+				},
+				Putio:  PutioConfig{OAuthToken: "token", JanitorInterval: time.Hour},
+				Store:  StoreConfig{Backend: "file"},
+				Radarr: ArrConfigs{{Name: "radarr", URL: "http://radarr", APIKey: "123"}},
+			}
+			tc.want(&want)
+			if diff := cmp.Diff(want, config); diff != "" {
+				t.Fatalf("unexpected config (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLiveConfig_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(yaml string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+			t.Fatalf("failed to write config: %s", err)
+		}
+	}
+	load := func() (*Config, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		config, err := ReadConfig(file)
+		return &config, err
+	}
+
+	writeConfig(testConfigPreamble + "radarr:\n  url: http://radarr\n  api_key: 123\n")
+	initial, err := load()
+	if err != nil {
+		t.Fatalf("failed to read config: %s", err)
+	}
+	liveConfig := NewLiveConfig(initial, load)
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	server := httptest.NewServer(NewServer(liveConfig,
+		NewPutioProxy(liveConfig, fakePutio.NewClient(), nil), nil))
+	defer server.Close()
+
+	// The credentials and the download directory are swapped.
+	writeConfig(`
+transmission:
+  username: username
+  password: hunter2
+  download_dir: /downloads
+putio:
+  oauth_token: token
+radarr:
+  url: http://radarr
+  api_key: 123
+`)
+	if err := liveConfig.Reload(); err != nil {
+		t.Fatalf("failed to reload config: %s", err)
+	}
+	doRPCAndExpectCode[any](t, initial, server.URL, "session-get", nil, http.StatusUnauthorized)
+	session := doRPCAndExpectOK[Session](t, liveConfig.Current(), server.URL, "session-get", nil)
+	if got, want := session.DownloadDir, "/downloads"; got != want {
+		t.Errorf("got download dir %q after reloading, want %q", got, want)
+	}
+
+	// The OAuth token only changes on restart, so a config that changes it is rejected.
+	reloaded := liveConfig.Current()
+	writeConfig(`
+transmission:
+  username: other
+  password: hunter2
+  download_dir: /downloads
+putio:
+  oauth_token: other
+radarr:
+  url: http://radarr
+  api_key: 123
+`)
+	if err := liveConfig.Reload(); err == nil || !strings.Contains(err.Error(), "restart Putarr to change putio.oauth_token") {
+		t.Fatalf("got error %v reloading a config with another OAuth token, want one naming putio.oauth_token", err)
+	}
+	if got, want := liveConfig.Current(), reloaded; got != want {
+		t.Fatal("the previous config wasn't kept after changing the OAuth token")
+	}
+
+	// An invalid config is reported, and the previous one is kept.
+	writeConfig(testConfigPreamble)
+	if err := liveConfig.Reload(); err == nil {
+		t.Fatal("reloading an invalid config succeeded")
+	}
+	if got, want := liveConfig.Current(), reloaded; got != want {
+		t.Fatal("the previous config wasn't kept after reloading an invalid config")
+	}
+	doRPCAndExpectOK[Session](t, reloaded, server.URL, "session-get", nil)
+}
+
+func TestLiveConfig_RequestSnapshot(t *testing.T) {
+	first := &Config{Transmission: TransmissionConfig{DownloadDir: "/first"}}
+	second := &Config{Transmission: TransmissionConfig{DownloadDir: "/second"}}
+	liveConfig := NewLiveConfig(first, func() (*Config, error) { return second, nil })
+
+	var reloads int
+	liveConfig.OnReload(func(config *Config) { reloads++ })
+
+	// A request in flight keeps the config it started with, even when the config is reloaded halfway through.
+	var dirs []string
+	handler := configSnapshotMiddleware(liveConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dirs = append(dirs, configFor(r.Context(), liveConfig).Transmission.DownloadDir)
+		if err := liveConfig.Reload(); err != nil {
+			t.Fatalf("failed to reload config: %s", err)
+		}
+		dirs = append(dirs, configFor(r.Context(), liveConfig).Transmission.DownloadDir)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if got, want := dirs, []string{"/first", "/first"}; !cmp.Equal(got, want) {
+		t.Fatalf("got download dirs %v during the request, want %v", got, want)
+	}
+	if got, want := configFor(context.Background(), liveConfig), second; got != want {
+		t.Fatalf("got download dir %q after the request, want %q", got.Transmission.DownloadDir,
+			want.Transmission.DownloadDir)
+	}
+	if got, want := reloads, 1; got != want {
+		t.Fatalf("got %d reload callbacks, want %d", got, want)
+	}
+}
@@ -0,0 +1,664 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/putdotio/go-putio"
+)
+
+const (
+	// Files smaller than this are downloaded in fewer segments.
+	defaultMinSegmentSize = 8 << 20
+
+	// How often the progress of a download is persisted to its checkpoint manifest.
+	checkpointInterval = 5 * time.Second
+
+	// Suffix of files that are still downloading.
+	partialFileSuffix = ".part"
+
+	// Directory, relative to the local download directory, where checkpoint manifests are kept.
+	manifestDir = ".putarr"
+
+	// How many times files that fail integrity verification are downloaded before giving up.
+	maxVerifyAttempts = 3
+)
+
+// LocalDownload is the progress of downloading the files of a completed Put.io transfer to the local download
+// directory.
+type LocalDownload struct {
+	Path       string // Local path of the downloaded file or folder.
+	Size       int64  // Total size of the files to download.
+	Downloaded int64  // Number of bytes downloaded so far.
+	Verifying  bool   // Whether the downloaded files are being verified against their Put.io checksums.
+	Done       bool   // Whether all the files are downloaded and verified.
+	Err        error  // The error that interrupted the download, if any.
+}
+
+// Downloader downloads the files of completed Put.io transfers to the local download directory, preserving the
+// Put.io folder layout. Files are downloaded in parallel segments using HTTP Range requests, and the progress is
+// checkpointed to disk so downloads can resume where they left off after a restart or a dropped connection. Once
+// downloaded, files are verified against their Put.io checksums and the corrupt ones are downloaded again.
+type Downloader struct {
+	config      ConfigSource
+	putioClient *putio.Client
+	putioProxy  *PutioProxy
+	httpClient  *http.Client
+
+	minSegmentSize int64
+
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	downloads map[int64]*localDownload
+}
+
+type localDownload struct {
+	LocalDownload
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once the download stops.
+}
+
+// A file to download from Put.io, with its path relative to the local directory of the transfer.
+type remoteFile struct {
+	ID    int64  `json:"id"`
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	CRC32 string `json:"crc32"`
+}
+
+// downloadManifest is the checkpoint of a local download, persisted to disk so the download can resume after a
+// restart. It's keyed by transfer ID.
+type downloadManifest struct {
+	TransferID int64          `json:"transfer_id"`
+	Path       string         `json:"path"`
+	Files      []manifestFile `json:"files"`
+	Done       bool           `json:"done"`
+}
+
+type manifestFile struct {
+	remoteFile
+	Segments []manifestSegment `json:"segments"`
+	Done     bool              `json:"done"`
+	Verified bool              `json:"verified"`
+}
+
+// A byte range [Start, End) of a file, of which the first Written bytes are on disk.
+type manifestSegment struct {
+	Start   int64 `json:"start"`
+	End     int64 `json:"end"`
+	Written int64 `json:"written"`
+}
+
+func NewDownloader(config ConfigSource, putioClient *putio.Client, putioProxy *PutioProxy) *Downloader {
+	return &Downloader{
+		config:         config,
+		putioClient:    putioClient,
+		putioProxy:     putioProxy,
+		httpClient:     http.DefaultClient,
+		minSegmentSize: defaultMinSegmentSize,
+		downloads:      map[int64]*localDownload{},
+	}
+}
+
+// RunAtInterval looks for newly completed transfers to download at the interval returned by the interval function,
+// which is called again after every run so a reloaded config takes effect. Once the context is done, the downloads in
+// progress are cancelled, and it returns after they've checkpointed their progress so they resume on the next start.
+func (d *Downloader) RunAtInterval(ctx context.Context, interval func() time.Duration) {
+	runAtInterval(ctx, interval, func() {
+		if _, err := d.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Println("failed to run downloader:", err)
+		}
+	})
+	d.Wait()
+}
+
+// RunOnce starts downloading the completed transfers that aren't downloaded yet, and returns their IDs. Failed
+// downloads are resumed. The downloads continue in the background; use Wait to wait for them to finish.
+func (d *Downloader) RunOnce(ctx context.Context) ([]int64, error) {
+	startedTransferIDs := []int64{}
+
+	transfers, err := d.putioProxy.GetTransfers(ctx)
+	if err != nil {
+		return startedTransferIDs, fmt.Errorf("failed to get transfers from Put.io: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Forget about the downloads of transfers that no longer exist, e.g., because the janitor cleaned them up.
+	exists := map[int64]bool{}
+	for _, transfer := range transfers {
+		exists[transfer.ID] = true
+	}
+	for id, download := range d.downloads {
+		if !exists[id] {
+			download.cancel()
+			delete(d.downloads, id)
+			go func() {
+				<-download.done
+				if err := d.removeManifest(id); err != nil {
+					log.Println("failed to remove download manifest:", err)
+				}
+			}()
+		}
+	}
+
+	for _, transfer := range transfers {
+		if !isTransferCompleted(transfer) {
+			continue
+		}
+		// Stopped transfers aren't downloaded until they're started again, when they resume from their manifest.
+		if metadata := transfer.Metadata; metadata != nil && metadata.Stopped {
+			if download, ok := d.downloads[transfer.ID]; ok {
+				download.cancel()
+				delete(d.downloads, transfer.ID)
+			}
+			continue
+		}
+		if download, ok := d.downloads[transfer.ID]; ok && download.Err == nil {
+			continue
+		}
+
+		downloadCtx, cancel := context.WithCancel(ctx)
+		download := &localDownload{
+			LocalDownload: LocalDownload{Size: int64(transfer.Size)},
+			cancel:        cancel,
+			done:          make(chan struct{}),
+		}
+		d.downloads[transfer.ID] = download
+		startedTransferIDs = append(startedTransferIDs, transfer.ID)
+
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			defer close(download.done)
+			defer cancel()
+			err := d.download(downloadCtx, transfer, download)
+
+			d.mu.Lock()
+			if err != nil {
+				log.Printf("failed to download Put.io transfer with ID `%d`: %s", transfer.ID, err)
+				download.Err = err
+			} else {
+				download.Done = true
+			}
+			state := LocalState{Path: download.Path, Size: download.Size, Done: download.Done}
+			d.mu.Unlock()
+
+			// Removed downloads are cancelled, and there's no point in recording their state.
+			if downloadCtx.Err() != nil {
+				return
+			}
+			if err != nil {
+				state.Error = err.Error()
+			}
+			d.putioProxy.setLocalState(transfer.ID, state)
+		}()
+	}
+
+	return startedTransferIDs, nil
+}
+
+// Wait blocks until all the downloads in progress are finished.
+func (d *Downloader) Wait() {
+	d.wg.Wait()
+}
+
+// AnnotateTransfers attaches the local download progress to the completed transfers. Completed transfers that aren't
+// downloading yet are reported as not downloaded at all, so clients don't import them before they're on local disk.
+func (d *Downloader) AnnotateTransfers(transfers []Transfer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, transfer := range transfers {
+		if !isTransferCompleted(transfer) {
+			continue
+		}
+		local := LocalDownload{Size: int64(transfer.Size)}
+		if download, ok := d.downloads[transfer.ID]; ok {
+			local = download.LocalDownload
+		} else if metadata := transfer.Metadata; metadata != nil && metadata.Local != nil && metadata.Local.Done {
+			// The download finished before a restart, and hasn't been picked up again yet.
+			local = LocalDownload{
+				Path:       metadata.Local.Path,
+				Size:       metadata.Local.Size,
+				Downloaded: metadata.Local.Size,
+				Done:       true,
+			}
+		}
+		transfers[i].Local = &local
+	}
+}
+
+// Remove stops downloading the transfer with the given ID, and optionally deletes the files downloaded so far.
+func (d *Downloader) Remove(id int64, removeFiles bool) error {
+	d.mu.Lock()
+	download, ok := d.downloads[id]
+	delete(d.downloads, id)
+	d.mu.Unlock()
+
+	var path string
+	if ok {
+		// Wait for the download to stop so it doesn't write a checkpoint after the files are removed.
+		download.cancel()
+		<-download.done
+		path = download.Path
+	} else if manifest, err := d.loadManifest(id); err == nil {
+		// The download might be from before a restart.
+		path = manifest.Path
+	}
+
+	if removeFiles && path != "" {
+		// Remove both the complete and the partial files, since the transfer could be a single file.
+		for _, path := range []string{path, path + partialFileSuffix} {
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("failed to delete local files of transfer with ID `%d`: %w", id, err)
+			}
+		}
+	}
+	return d.removeManifest(id)
+}
+
+func (d *Downloader) download(ctx context.Context, transfer Transfer, download *localDownload) error {
+	manifest, err := d.loadManifest(transfer.ID)
+	if errors.Is(err, fs.ErrNotExist) {
+		manifest, err = d.newManifest(ctx, transfer)
+		if err != nil {
+			return err
+		}
+		if err := d.saveManifest(manifest); err != nil {
+			return err
+		}
+		log.Println("starting local download of Put.io transfer with ID:", transfer.ID)
+	} else if err != nil {
+		return err
+	} else if !manifest.Done {
+		log.Println("resuming local download of Put.io transfer with ID:", transfer.ID)
+	}
+
+	d.mu.Lock()
+	download.Path = manifest.Path
+	download.Size = 0
+	download.Downloaded = 0
+	for _, file := range manifest.Files {
+		download.Size += file.Size
+		for _, segment := range file.Segments {
+			download.Downloaded += segment.Written
+		}
+	}
+	d.mu.Unlock()
+
+	if manifest.Done {
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		for i := range manifest.Files {
+			if manifest.Files[i].Done {
+				continue
+			}
+			if err := d.downloadFile(ctx, manifest, &manifest.Files[i], download); err != nil {
+				return err
+			}
+		}
+
+		failed, err := d.verify(ctx, manifest, download)
+		if err != nil {
+			return err
+		}
+		if failed == 0 {
+			break
+		}
+		if attempt == maxVerifyAttempts {
+			return fmt.Errorf("%d file(s) failed integrity verification after %d attempts", failed, attempt)
+		}
+	}
+
+	d.mu.Lock()
+	manifest.Done = true
+	d.mu.Unlock()
+	if err := d.saveManifest(manifest); err != nil {
+		return err
+	}
+	log.Println("finished local download of Put.io transfer with ID:", transfer.ID)
+	return nil
+}
+
+// Lists the files of the transfer on Put.io and splits them into segments to download.
+func (d *Downloader) newManifest(ctx context.Context, transfer Transfer) (*downloadManifest, error) {
+	dir, err := d.localDir(transfer.DownloadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := d.putioClient.Files.Get(ctx, transfer.FileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file with ID `%d`: %w", transfer.FileID, err)
+	}
+
+	files, err := listPutioFiles(ctx, d.putioClient, root, root.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &downloadManifest{
+		TransferID: transfer.ID,
+		Path:       filepath.Join(dir, root.Name),
+	}
+	for _, file := range files {
+		file.Path = filepath.Join(dir, file.Path)
+		manifest.Files = append(manifest.Files, manifestFile{
+			remoteFile: file,
+			Segments:   d.splitSegments(file.Size),
+		})
+	}
+	return manifest, nil
+}
+
+// Splits a file of the given size into the configured number of segments, without making segments smaller than the
+// minimum segment size.
+func (d *Downloader) splitSegments(size int64) []manifestSegment {
+	count := int64(max(d.config.Current().Downloader.Segments, 1))
+	count = max(min(count, size/d.minSegmentSize), 1)
+
+	segments := []manifestSegment{}
+	segmentSize := size / count
+	for i := range count {
+		segment := manifestSegment{Start: i * segmentSize, End: (i + 1) * segmentSize}
+		if i == count-1 {
+			segment.End = size
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+// Downloads the missing segments of a file in parallel into a partial file, then moves it to its final path.
+func (d *Downloader) downloadFile(ctx context.Context, manifest *downloadManifest, file *manifestFile, download *localDownload) error {
+	fileURL, err := d.putioClient.Files.URL(ctx, file.ID, false)
+	if err != nil {
+		return fmt.Errorf("failed to get download URL for file with ID `%d`: %w", file.ID, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+		return fmt.Errorf("failed to create local directory: %w", err)
+	}
+	partPath := file.Path + partialFileSuffix
+	out, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer out.Close()
+	if err := out.Truncate(file.Size); err != nil {
+		return fmt.Errorf("failed to allocate local file: %w", err)
+	}
+
+	// Periodically persist the progress until all the segments are done.
+	checkpointDone := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(checkpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := d.checkpoint(manifest, out); err != nil {
+					log.Println("failed to checkpoint download:", err)
+				}
+			case <-checkpointDone:
+				return
+			}
+		}
+	}()
+
+	// A failed segment doesn't cancel the others: they keep the bytes they receive, which would otherwise be dropped
+	// mid-response and downloaded again after a restart.
+	var wg sync.WaitGroup
+	errs := make([]error, len(file.Segments))
+	for i := range file.Segments {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = d.downloadSegment(ctx, fileURL, out, &file.Segments[i], download)
+		}()
+	}
+	wg.Wait()
+	close(checkpointDone)
+
+	// Checkpoint whatever was downloaded, even when a segment failed, so it doesn't have to be downloaded again.
+	if err := d.checkpoint(manifest, out); err != nil {
+		return err
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to download file with ID `%d`: %w", file.ID, err)
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, file.Path); err != nil {
+		return fmt.Errorf("failed to move downloaded file: %w", err)
+	}
+
+	d.mu.Lock()
+	file.Done = true
+	d.mu.Unlock()
+	return d.saveManifest(manifest)
+}
+
+// Downloads the rest of a segment with a Range request, and writes it at its offset in the file.
+func (d *Downloader) downloadSegment(ctx context.Context, fileURL string, out *os.File, segment *manifestSegment, download *localDownload) error {
+	d.mu.Lock()
+	offset := segment.Start + segment.Written
+	d.mu.Unlock()
+	if offset >= segment.End {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, segment.End-1))
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unexpected status %s for range request", resp.Status)
+	}
+
+	buf := make([]byte, 256<<10)
+	for offset < segment.End {
+		n, err := resp.Body.Read(buf[:min(int64(len(buf)), segment.End-offset)])
+		if n > 0 {
+			if _, err := out.WriteAt(buf[:n], offset); err != nil {
+				return fmt.Errorf("failed to write local file: %w", err)
+			}
+			offset += int64(n)
+
+			d.mu.Lock()
+			segment.Written += int64(n)
+			download.Downloaded += int64(n)
+			d.mu.Unlock()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if offset < segment.End {
+		return fmt.Errorf("unexpected end of segment at offset %d, want %d", offset, segment.End)
+	}
+	return nil
+}
+
+// Verifies the downloaded files against their Put.io checksums, and returns how many failed. The files that fail are
+// reset so they're downloaded again.
+func (d *Downloader) verify(ctx context.Context, manifest *downloadManifest, download *localDownload) (int, error) {
+	d.mu.Lock()
+	download.Verifying = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		download.Verifying = false
+		d.mu.Unlock()
+	}()
+
+	failed := 0
+	for i := range manifest.Files {
+		file := &manifest.Files[i]
+		if file.Verified {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return failed, err
+		}
+
+		ok, err := verifyChecksum(file.Path, file.CRC32)
+		if err != nil {
+			return failed, err
+		}
+		if ok {
+			d.mu.Lock()
+			file.Verified = true
+			d.mu.Unlock()
+			continue
+		}
+
+		log.Printf("file `%s` failed integrity verification; downloading it again", file.Path)
+		failed++
+		if err := os.Remove(file.Path); err != nil {
+			return failed, fmt.Errorf("failed to remove corrupt file: %w", err)
+		}
+
+		d.mu.Lock()
+		file.Done = false
+		for j := range file.Segments {
+			file.Segments[j].Written = 0
+		}
+		download.Downloaded -= file.Size
+		d.mu.Unlock()
+	}
+
+	return failed, d.saveManifest(manifest)
+}
+
+// Returns whether the file matches the CRC32 checksum from Put.io. Files without a checksum are assumed to be valid.
+func verifyChecksum(path string, expected string) (bool, error) {
+	if expected == "" {
+		return true, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open file to verify: %w", err)
+	}
+	defer file.Close()
+
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, file); err != nil {
+		return false, fmt.Errorf("failed to read file to verify: %w", err)
+	}
+	return strings.EqualFold(fmt.Sprintf("%08x", hash.Sum32()), expected), nil
+}
+
+// Flushes the file to disk before persisting the manifest, so the manifest never claims more than what's on disk.
+func (d *Downloader) checkpoint(manifest *downloadManifest, out *os.File) error {
+	d.mu.Lock()
+	data, err := json.Marshal(manifest)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to flush local file: %w", err)
+	}
+	return d.writeManifest(manifest.TransferID, data)
+}
+
+func (d *Downloader) manifestPath(id int64) string {
+	return filepath.Join(d.config.Current().Downloader.Dir, manifestDir, strconv.FormatInt(id, 10)+".json")
+}
+
+func (d *Downloader) loadManifest(id int64) (*downloadManifest, error) {
+	data, err := os.ReadFile(d.manifestPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var manifest downloadManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to read download manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+func (d *Downloader) saveManifest(manifest *downloadManifest) error {
+	d.mu.Lock()
+	data, err := json.Marshal(manifest)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return d.writeManifest(manifest.TransferID, data)
+}
+
+// Writes the manifest to a temporary file first so a crash never leaves a truncated manifest behind.
+func (d *Downloader) writeManifest(id int64, data []byte) error {
+	path := d.manifestPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write download manifest: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (d *Downloader) removeManifest(id int64) error {
+	err := os.Remove(d.manifestPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Treat the download directory as relative to the configured download path, and return the corresponding local
+// directory.
+func (d *Downloader) localDir(downloadDir string) (string, error) {
+	config := d.config.Current()
+	subpath, ok := cutDownloadDir(downloadDir, config.Transmission.DownloadDir)
+	if !ok {
+		return "", fmt.Errorf("download directory must be a subdirectory of `%s`", config.Transmission.DownloadDir)
+	}
+
+	dir := filepath.Join(config.Downloader.Dir, subpath)
+	rel, err := filepath.Rel(config.Downloader.Dir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("download directory escapes the local download directory: " + downloadDir)
+	}
+	return dir, nil
+}
+
+func isTransferCompleted(transfer Transfer) bool {
+	status := strings.ToUpper(transfer.Status)
+	return (status == "COMPLETED" || status == "SEEDING") && transfer.FileID != 0
+}
@@ -0,0 +1,403 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/albertb/putarr/internal/fakes"
+	"github.com/google/go-cmp/cmp"
+	"github.com/putdotio/go-putio"
+)
+
+func TestDownloader(t *testing.T) {
+	var (
+		username = "azure"
+		password = "hunter2"
+		localDir = t.TempDir()
+	)
+
+	ctx := context.Background()
+	config := &Config{
+		Downloader: DownloaderConfig{Dir: localDir},
+		Transmission: TransmissionConfig{
+			Username:    username,
+			Password:    password,
+			DownloadDir: "/putarr",
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), nil)
+	downloader := NewDownloader(config, fakePutio.NewClient(), putioProxy)
+
+	server := httptest.NewServer(NewServer(config, putioProxy, downloader))
+	defer server.Close()
+
+	transfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:AAA&dn=movie", "/putarr/movies", TransferMetadata{})
+	if err != nil {
+		t.Fatalf("failed to add transfer: %s", err)
+	}
+
+	// Nothing to download while the transfer is in progress.
+	ids, err := downloader.RunOnce(ctx)
+	if err != nil {
+		t.Fatalf("failed to run downloader: %s", err)
+	}
+	if got, want := len(ids), 0; got != want {
+		t.Fatalf("got len(started downloads) %d, want %d", got, want)
+	}
+
+	// Complete the transfer with a folder that holds a movie and a sub-folder of subtitles.
+	folder, _ := fakePutio.CreateFolder(0, "Movie (2020)")
+	subs, _ := fakePutio.CreateFolder(folder.ID, "Subs")
+	files := map[string]string{
+		"Movie (2020)/movie.mkv":   "not really a movie",
+		"Movie (2020)/Subs/en.srt": "not really subtitles",
+	}
+	if _, err := fakePutio.CreateFile(folder.ID, "movie.mkv", []byte(files["Movie (2020)/movie.mkv"])); err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+	if _, err := fakePutio.CreateFile(subs.ID, "en.srt", []byte(files["Movie (2020)/Subs/en.srt"])); err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+	if err := fakePutio.SetTransferCompletedWithFile(transfer.ID, folder.ID); err != nil {
+		t.Fatalf("failed to complete transfer: %s", err)
+	}
+
+	// The transfer is completed on Put.io, but it must not be reported as finished until it's on local disk.
+	torrents := doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
+	if got, want := len(torrents["torrents"]), 1; got != want {
+		t.Fatalf("got %d torrents, want %d", got, want)
+	}
+	if got, want := torrents["torrents"][0].IsFinished, false; got != want {
+		t.Fatalf("got IsFinished %v before the local download, want %v", got, want)
+	}
+	if got, want := torrents["torrents"][0].Status, TorrentStatusDownloading; got != want {
+		t.Fatalf("got Status %v before the local download, want %v", got, want)
+	}
+
+	ids, err = downloader.RunOnce(ctx)
+	if err != nil {
+		t.Fatalf("failed to run downloader: %s", err)
+	}
+	if got, want := ids, []int64{transfer.ID}; !cmp.Equal(got, want) {
+		t.Fatalf("got started downloads %v, want %v", got, want)
+	}
+	downloader.Wait()
+
+	// The files are in the local directory that corresponds to the transfer's download directory.
+	var size int64
+	for path, content := range files {
+		data, err := os.ReadFile(filepath.Join(localDir, "movies", path))
+		if err != nil {
+			t.Fatalf("failed to read downloaded file: %s", err)
+		}
+		if got, want := string(data), content; got != want {
+			t.Errorf("got content %q for %s, want %q", got, path, want)
+		}
+		size += int64(len(content))
+	}
+
+	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
+	torrent := torrents["torrents"][0]
+	if got, want := torrent.IsFinished, true; got != want {
+		t.Fatalf("got IsFinished %v after the local download, want %v", got, want)
+	}
+	if got, want := torrent.TotalSize, size; got != want {
+		t.Errorf("got TotalSize %d, want %d", got, want)
+	}
+	if got, want := torrent.LeftUntilDone, int64(0); got != want {
+		t.Errorf("got LeftUntilDone %d, want %d", got, want)
+	}
+
+	// Running again doesn't download the transfer again.
+	ids, err = downloader.RunOnce(ctx)
+	if err != nil {
+		t.Fatalf("failed to run downloader: %s", err)
+	}
+	if got, want := len(ids), 0; got != want {
+		t.Fatalf("got len(started downloads) %d, want %d", got, want)
+	}
+
+	// Removing the torrent with its data also deletes the local files.
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-remove", map[string]any{
+		"delete-local-data": true,
+		"ids":               []string{*torrent.HashString},
+	})
+	if _, err := os.Stat(filepath.Join(localDir, "movies", "Movie (2020)")); !os.IsNotExist(err) {
+		t.Fatalf("got err %v for the removed download, want not exist", err)
+	}
+}
+
+func TestDownloader_ResumeAfterRestart(t *testing.T) {
+	localDir := t.TempDir()
+
+	ctx := context.Background()
+	config := &Config{
+		Downloader: DownloaderConfig{
+			Dir:      localDir,
+			Segments: 4,
+		},
+		Transmission: TransmissionConfig{
+			DownloadDir: "/putarr",
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), nil)
+
+	transfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:AAA&dn=remux", "/putarr", TransferMetadata{})
+	if err != nil {
+		t.Fatalf("failed to add transfer: %s", err)
+	}
+
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	file, _ := fakePutio.CreateFile(0, "remux.mkv", content)
+	if err := fakePutio.SetTransferCompletedWithFile(transfer.ID, file.ID); err != nil {
+		t.Fatalf("failed to complete transfer: %s", err)
+	}
+
+	// The connection drops after part of the file is downloaded.
+	fakePutio.SetDownloadBudget(400)
+
+	downloader := NewDownloader(config, fakePutio.NewClient(), putioProxy)
+	downloader.minSegmentSize = 100
+	if _, err := downloader.RunOnce(ctx); err != nil {
+		t.Fatalf("failed to run downloader: %s", err)
+	}
+	downloader.Wait()
+
+	transfers := []Transfer{{Transfer: &putio.Transfer{ID: transfer.ID, Status: "COMPLETED", FileID: file.ID}}}
+	downloader.AnnotateTransfers(transfers)
+	if local := transfers[0].Local; local.Done || local.Err == nil {
+		t.Fatalf("got local download %+v, want an interrupted download", local)
+	}
+	// Every byte served before the connection dropped was kept.
+	if got, want := transfers[0].Local.Downloaded, fakePutio.GetBytesServed(); got != want {
+		t.Fatalf("got %d bytes downloaded, want the %d bytes served", got, want)
+	}
+
+	// Only the partial file is on disk.
+	if _, err := os.Stat(filepath.Join(localDir, "remux.mkv")); !os.IsNotExist(err) {
+		t.Fatalf("got err %v for the final file, want not exist", err)
+	}
+	if _, err := os.Stat(filepath.Join(localDir, "remux.mkv.part")); err != nil {
+		t.Fatalf("missing partial file: %s", err)
+	}
+
+	// After a restart, the download resumes without downloading any of the same bytes again.
+	fakePutio.SetDownloadBudget(-1)
+
+	downloader = NewDownloader(config, fakePutio.NewClient(), putioProxy)
+	downloader.minSegmentSize = 100
+	if _, err := downloader.RunOnce(ctx); err != nil {
+		t.Fatalf("failed to run downloader: %s", err)
+	}
+	downloader.Wait()
+
+	downloader.AnnotateTransfers(transfers)
+	if local := transfers[0].Local; !local.Done || local.Err != nil {
+		t.Fatalf("got local download %+v, want a finished download", local)
+	}
+
+	data, err := os.ReadFile(filepath.Join(localDir, "remux.mkv"))
+	if err != nil {
+		t.Fatalf("failed to read downloaded file: %s", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("got corrupted content after resuming the download")
+	}
+	if got, want := fakePutio.GetBytesServed(), int64(len(content)); got != want {
+		t.Fatalf("got %d bytes served, want %d", got, want)
+	}
+
+	// Once finished, a restart doesn't download anything again.
+	downloader = NewDownloader(config, fakePutio.NewClient(), putioProxy)
+	if _, err := downloader.RunOnce(ctx); err != nil {
+		t.Fatalf("failed to run downloader: %s", err)
+	}
+	downloader.Wait()
+
+	downloader.AnnotateTransfers(transfers)
+	if local := transfers[0].Local; !local.Done {
+		t.Fatalf("got local download %+v, want a finished download", local)
+	}
+	if got, want := fakePutio.GetBytesServed(), int64(len(content)); got != want {
+		t.Fatalf("got %d bytes served, want %d", got, want)
+	}
+}
+
+func TestDownloader_VerifyChecksums(t *testing.T) {
+	localDir := t.TempDir()
+
+	ctx := context.Background()
+	config := &Config{
+		Downloader: DownloaderConfig{Dir: localDir},
+		Transmission: TransmissionConfig{
+			DownloadDir: "/putarr",
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), nil)
+
+	addCompletedTransfer := func(name string) (Transfer, putio.File, putio.File) {
+		transfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:AAA&dn="+name, "/putarr", TransferMetadata{})
+		if err != nil {
+			t.Fatalf("failed to add transfer: %s", err)
+		}
+		folder, _ := fakePutio.CreateFolder(0, name)
+		good, _ := fakePutio.CreateFile(folder.ID, "good.mkv", []byte("the good file"))
+		bad, _ := fakePutio.CreateFile(folder.ID, "bad.mkv", []byte("the file that gets corrupted"))
+		if err := fakePutio.SetTransferCompletedWithFile(transfer.ID, folder.ID); err != nil {
+			t.Fatalf("failed to complete transfer: %s", err)
+		}
+		return transfer, good, bad
+	}
+
+	// The first download of one of the files gets corrupted.
+	transfer, good, bad := addCompletedTransfer("flaky")
+	fakePutio.CorruptDownloads(bad.ID, 1)
+
+	downloader := NewDownloader(config, fakePutio.NewClient(), putioProxy)
+	if _, err := downloader.RunOnce(ctx); err != nil {
+		t.Fatalf("failed to run downloader: %s", err)
+	}
+	downloader.Wait()
+
+	transfers := []Transfer{{Transfer: &putio.Transfer{ID: transfer.ID, Status: "COMPLETED", FileID: 1}}}
+	downloader.AnnotateTransfers(transfers)
+	if local := transfers[0].Local; !local.Done || local.Err != nil {
+		t.Fatalf("got local download %+v, want a finished download", local)
+	}
+
+	data, err := os.ReadFile(filepath.Join(localDir, "flaky", "bad.mkv"))
+	if err != nil {
+		t.Fatalf("failed to read downloaded file: %s", err)
+	}
+	if got, want := string(data), "the file that gets corrupted"; got != want {
+		t.Fatalf("got content %q, want %q", got, want)
+	}
+
+	// Only the corrupted file was downloaded again.
+	if got, want := fakePutio.GetBytesServed(), good.Size+2*bad.Size; got != want {
+		t.Fatalf("got %d bytes served, want %d", got, want)
+	}
+
+	// When a file keeps getting corrupted, the download fails and is never reported as finished.
+	transfer, _, bad = addCompletedTransfer("broken")
+	fakePutio.CorruptDownloads(bad.ID, maxVerifyAttempts)
+
+	if _, err := downloader.RunOnce(ctx); err != nil {
+		t.Fatalf("failed to run downloader: %s", err)
+	}
+	downloader.Wait()
+
+	transfers = []Transfer{{Transfer: &putio.Transfer{ID: transfer.ID, Status: "COMPLETED", FileID: 1}}}
+	downloader.AnnotateTransfers(transfers)
+	if local := transfers[0].Local; local.Done || local.Err == nil {
+		t.Fatalf("got local download %+v, want a failed download", local)
+	}
+	torrent := convertFromPutioTransfer(transfers[0])
+	if got, want := torrent.IsFinished, false; got != want {
+		t.Fatalf("got IsFinished %v with a corrupt file, want %v", got, want)
+	}
+}
+
+func TestConvertFromPutioTransfer_LocalDownload(t *testing.T) {
+	for _, tt := range []struct {
+		explanation string
+		local       LocalDownload
+		status      TorrentStatus
+		finished    bool
+	}{
+		{
+			"downloading files are reported as downloading",
+			LocalDownload{Size: 100, Downloaded: 50},
+			TorrentStatusDownloading,
+			false,
+		},
+		{
+			"files being verified are reported as checking",
+			LocalDownload{Size: 100, Downloaded: 100, Verifying: true},
+			TorrentStatusChecking,
+			false,
+		},
+		{
+			"downloaded and verified files are reported as finished",
+			LocalDownload{Size: 100, Downloaded: 100, Done: true},
+			TorrentStatusStopped,
+			true,
+		},
+	} {
+		t.Run(tt.explanation, func(t *testing.T) {
+			torrent := convertFromPutioTransfer(Transfer{
+				Transfer: &putio.Transfer{ID: 1, Status: "COMPLETED", FileID: 1},
+				Local:    &tt.local,
+			})
+			if got, want := torrent.Status, tt.status; got != want {
+				t.Errorf("got Status %v, want %v", got, want)
+			}
+			if got, want := torrent.IsFinished, tt.finished; got != want {
+				t.Errorf("got IsFinished %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDownloader_LocalDir(t *testing.T) {
+	localDir := t.TempDir()
+	config := &Config{
+		Downloader:   DownloaderConfig{Dir: localDir},
+		Transmission: TransmissionConfig{DownloadDir: "/putarr"},
+	}
+	downloader := NewDownloader(config, nil, nil)
+
+	for _, tt := range []struct {
+		explanation string
+		downloadDir string
+		want        string
+	}{
+		{"the download directory maps to the local directory", "/putarr", localDir},
+		{"sub-directories map to local sub-directories", "/putarr/movies", filepath.Join(localDir, "movies")},
+		{"directories outside the download directory are rejected", "/elsewhere/movies", ""},
+		{"directories that only share a prefix with the download directory are rejected", "/putarr-other", ""},
+		{"directories can't escape the local directory", "/putarr/../etc", ""},
+		{"a sibling with the same prefix can't be reached", "/putarr/../" + filepath.Base(localDir) + "-other", ""},
+	} {
+		t.Run(tt.explanation, func(t *testing.T) {
+			got, err := downloader.localDir(tt.downloadDir)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("got local directory %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get local directory: %s", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got local directory %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	for _, name := range []string{"", ".", "..", "../movie.mkv", "/etc/passwd"} {
+		if isValidFileName(name) {
+			t.Errorf("file name %q is valid, want it rejected", name)
+		}
+	}
+	if !isValidFileName("Movie (2020)..mkv") {
+		t.Error("a file name with dots is rejected")
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"sync/atomic"
 
 	"golift.io/starr"
+	"golift.io/starr/lidarr"
 	"golift.io/starr/radarr"
+	"golift.io/starr/readarr"
 	"golift.io/starr/sonarr"
 )
 
-// FakeArrs is a minimal, in-memory implementation of a Radarr and Sonarr server.
+// FakeArrs is a minimal, in-memory implementation of a Radarr, Sonarr, Lidarr, Readarr and Whisparr server.
 type FakeArrs struct {
 	server *httptest.Server
 
@@ -23,6 +25,21 @@ type FakeArrs struct {
 	sonarrQueue     map[int64]*sonarr.QueueRecord
 	sonarrHistoryID int64
 	sonarrHistory   map[int64]*sonarr.HistoryRecord
+
+	lidarrQueueID   int64
+	lidarrQueue     map[int64]*lidarr.QueueRecord
+	lidarrHistoryID int64
+	lidarrHistory   map[int64]*lidarr.HistoryRecord
+
+	readarrQueueID   int64
+	readarrQueue     map[int64]*readarr.QueueRecord
+	readarrHistoryID int64
+	readarrHistory   map[int64]*readarr.HistoryRecord
+
+	whisparrQueueID   int64
+	whisparrQueue     map[int64]*radarr.QueueRecord
+	whisparrHistoryID int64
+	whisparrHistory   map[int64]*radarr.HistoryRecord
 }
 
 func NewFakeArrs() *FakeArrs {
@@ -31,6 +48,13 @@ func NewFakeArrs() *FakeArrs {
 		radarrHistory: map[int64]*radarr.HistoryRecord{},
 		sonarrQueue:   map[int64]*sonarr.QueueRecord{},
 		sonarrHistory: map[int64]*sonarr.HistoryRecord{},
+
+		lidarrQueue:     map[int64]*lidarr.QueueRecord{},
+		lidarrHistory:   map[int64]*lidarr.HistoryRecord{},
+		readarrQueue:    map[int64]*readarr.QueueRecord{},
+		readarrHistory:  map[int64]*readarr.HistoryRecord{},
+		whisparrQueue:   map[int64]*radarr.QueueRecord{},
+		whisparrHistory: map[int64]*radarr.HistoryRecord{},
 	}
 
 	mux := http.NewServeMux()
@@ -67,6 +91,55 @@ func NewFakeArrs() *FakeArrs {
 		return result, nil
 	}))
 
+	mux.Handle("GET /lidarr/api/v1/queue", handleJSONRPC(func(r *http.Request) (lidarr.Queue, error) {
+		var result lidarr.Queue
+		for _, record := range fake.lidarrQueue {
+			result.Records = append(result.Records, record)
+		}
+		return result, nil
+	}))
+
+	mux.Handle("GET /lidarr/api/v1/history", handleJSONRPC(func(r *http.Request) (lidarr.History, error) {
+		var result lidarr.History
+		for _, record := range fake.lidarrHistory {
+			result.Records = append(result.Records, record)
+		}
+		return result, nil
+	}))
+
+	mux.Handle("GET /readarr/api/v1/queue", handleJSONRPC(func(r *http.Request) (readarr.Queue, error) {
+		var result readarr.Queue
+		for _, record := range fake.readarrQueue {
+			result.Records = append(result.Records, record)
+		}
+		return result, nil
+	}))
+
+	mux.Handle("GET /readarr/api/v1/history", handleJSONRPC(func(r *http.Request) (readarr.History, error) {
+		var result readarr.History
+		for _, record := range fake.readarrHistory {
+			result.Records = append(result.Records, *record)
+		}
+		return result, nil
+	}))
+
+	// Whisparr exposes the same API as Radarr.
+	mux.Handle("GET /whisparr/api/v3/queue", handleJSONRPC(func(r *http.Request) (radarr.Queue, error) {
+		var result radarr.Queue
+		for _, record := range fake.whisparrQueue {
+			result.Records = append(result.Records, record)
+		}
+		return result, nil
+	}))
+
+	mux.Handle("GET /whisparr/api/v3/history", handleJSONRPC(func(r *http.Request) (radarr.History, error) {
+		var result radarr.History
+		for _, record := range fake.whisparrHistory {
+			result.Records = append(result.Records, record)
+		}
+		return result, nil
+	}))
+
 	fake.server = httptest.NewServer(mux)
 	return &fake
 }
@@ -81,6 +154,21 @@ func (r *FakeArrs) NewSonarrClient() *sonarr.Sonarr {
 	return sonarr.New(config)
 }
 
+func (r *FakeArrs) NewLidarrClient() *lidarr.Lidarr {
+	config := starr.New("whatever", r.server.URL+"/lidarr", 0)
+	return lidarr.New(config)
+}
+
+func (r *FakeArrs) NewReadarrClient() *readarr.Readarr {
+	config := starr.New("whatever", r.server.URL+"/readarr", 0)
+	return readarr.New(config)
+}
+
+func (r *FakeArrs) NewWhisparrClient() *radarr.Radarr {
+	config := starr.New("whatever", r.server.URL+"/whisparr", 0)
+	return radarr.New(config)
+}
+
 func (r *FakeArrs) Close() {
 	r.server.Close()
 }
@@ -116,3 +204,51 @@ func (r *FakeArrs) AddSonarrHistoryRecord(record sonarr.HistoryRecord) int64 {
 	r.sonarrHistory[record.ID] = &record
 	return record.ID
 }
+
+func (r *FakeArrs) AddLidarrQueueRecord(record lidarr.QueueRecord) int64 {
+	record.ID = atomic.AddInt64(&r.lidarrQueueID, 1)
+	r.lidarrQueue[record.ID] = &record
+	return record.ID
+}
+
+func (r *FakeArrs) RemoveLidarrQueueRecord(id int64) {
+	delete(r.lidarrQueue, id)
+}
+
+func (r *FakeArrs) AddLidarrHistoryRecord(record lidarr.HistoryRecord) int64 {
+	record.ID = atomic.AddInt64(&r.lidarrHistoryID, 1)
+	r.lidarrHistory[record.ID] = &record
+	return record.ID
+}
+
+func (r *FakeArrs) AddReadarrQueueRecord(record readarr.QueueRecord) int64 {
+	record.ID = atomic.AddInt64(&r.readarrQueueID, 1)
+	r.readarrQueue[record.ID] = &record
+	return record.ID
+}
+
+func (r *FakeArrs) RemoveReadarrQueueRecord(id int64) {
+	delete(r.readarrQueue, id)
+}
+
+func (r *FakeArrs) AddReadarrHistoryRecord(record readarr.HistoryRecord) int64 {
+	record.ID = atomic.AddInt64(&r.readarrHistoryID, 1)
+	r.readarrHistory[record.ID] = &record
+	return record.ID
+}
+
+func (r *FakeArrs) AddWhisparrQueueRecord(record radarr.QueueRecord) int64 {
+	record.ID = atomic.AddInt64(&r.whisparrQueueID, 1)
+	r.whisparrQueue[record.ID] = &record
+	return record.ID
+}
+
+func (r *FakeArrs) RemoveWhisparrQueueRecord(id int64) {
+	delete(r.whisparrQueue, id)
+}
+
+func (r *FakeArrs) AddWhisparrHistoryRecord(record radarr.HistoryRecord) int64 {
+	record.ID = atomic.AddInt64(&r.whisparrHistoryID, 1)
+	r.whisparrHistory[record.ID] = &record
+	return record.ID
+}
@@ -1,32 +1,53 @@
 package fakes
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/albertb/putarr/internal/torrent"
 	"github.com/putdotio/go-putio"
 )
 
 // FakePutio is a minimal, in-memory implementation of a Put.io server.
 type FakePutio struct {
 	server         *httptest.Server
+	mu             sync.Mutex
 	configs        map[string]*putioConfigValue
 	fileID         int64
 	files          map[int64]*putioFile
+	contents       map[int64][]byte
+	bytesServed    int64
+	downloadBudget int64
+	corruptions    map[int64]int
 	deletedFileIDs []int64
 	transferID     int64
 	transfers      map[int64]*putioTransfer
+	torrents       map[int64][]byte
 	zipID          int64
 	zips           map[int64]putio.Zip
+	diskSize       int64
+	failure        *putioFailure
+}
+
+// putioFailure is the error response served to every API request while failures are injected.
+type putioFailure struct {
+	status    int
+	errorType string
 }
 
 type putioConfigValue struct {
@@ -62,9 +83,15 @@ func NewFakePutio() *FakePutio {
 	}
 
 	fake := FakePutio{
-		configs:   map[string]*putioConfigValue{},
-		files:     map[int64]*putioFile{0: &rootFolder},
-		transfers: map[int64]*putioTransfer{},
+		configs:     map[string]*putioConfigValue{},
+		files:       map[int64]*putioFile{0: &rootFolder},
+		contents:    map[int64][]byte{},
+		corruptions: map[int64]int{},
+		transfers:   map[int64]*putioTransfer{},
+		torrents:    map[int64][]byte{},
+
+		downloadBudget: -1,
+		diskSize:       1 << 40,
 	}
 
 	mux := http.NewServeMux()
@@ -95,6 +122,22 @@ func NewFakePutio() *FakePutio {
 		return nil, nil
 	}))
 
+	mux.Handle("DELETE /v2/config/{key}", handleJSONRPC(func(r *http.Request) (any, error) {
+		delete(fake.configs, r.PathValue("key"))
+		return nil, nil
+	}))
+
+	type configGetAll struct {
+		Config map[string]*json.RawMessage `json:"config"`
+	}
+	mux.Handle("GET /v2/config", handleJSONRPC(func(r *http.Request) (configGetAll, error) {
+		result := configGetAll{Config: map[string]*json.RawMessage{}}
+		for key, val := range fake.configs {
+			result.Config[key] = val.Value
+		}
+		return result, nil
+	}))
+
 	mux.Handle("GET /v2/files/list", handleJSONRPC(func(r *http.Request) (putioFile, error) {
 		var result putioFile
 		values := r.URL.Query()
@@ -117,8 +160,62 @@ func NewFakePutio() *FakePutio {
 		return result, nil
 	}))
 
-	mux.Handle("POST /v2/files/create-folder", handleJSONRPC(func(r *http.Request) (putioFile, error) {
-		var result putioFile
+	type fileGet struct{ File putio.File }
+	mux.Handle("GET /v2/files/{id}", handleJSONRPC(func(r *http.Request) (fileGet, error) {
+		var result fileGet
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			return result, fmt.Errorf("failed to parse ID path value in URL: %w", err)
+		}
+		file, ok := fake.files[id]
+		if !ok {
+			return result, fmt.Errorf("unknown file: %d", id)
+		}
+		result.File = file.Parent
+		return result, nil
+	}))
+
+	type fileURL struct {
+		URL string `json:"url"`
+	}
+	mux.Handle("GET /v2/files/{id}/url", handleJSONRPC(func(r *http.Request) (fileURL, error) {
+		var result fileURL
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			return result, fmt.Errorf("failed to parse ID path value in URL: %w", err)
+		}
+		if _, ok := fake.contents[id]; !ok {
+			return result, fmt.Errorf("file with ID `%d` has no content", id)
+		}
+		result.URL = fmt.Sprintf("%s/download/%d", fake.server.URL, id)
+		return result, nil
+	}))
+
+	// Serves the content of files like Put.io's download servers would, including support for Range requests.
+	mux.Handle("GET /download/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, ok := fake.contents[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if fake.corruptions[id] > 0 {
+			fake.corruptions[id]--
+			corrupted := bytes.Clone(content)
+			for i := range corrupted {
+				corrupted[i] ^= 0xff
+			}
+			content = corrupted
+		}
+		http.ServeContent(&budgetWriter{w, &fake}, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+
+	mux.Handle("POST /v2/files/create-folder", handleJSONRPC(func(r *http.Request) (fileGet, error) {
+		var result fileGet
 
 		err := r.ParseForm()
 		if err != nil {
@@ -139,7 +236,12 @@ func NewFakePutio() *FakePutio {
 			return result, fmt.Errorf("failed to parse parent_id: %w", err)
 		}
 
-		return fake.createFolder(parentID, name)
+		folder, err := fake.createFolder(parentID, name)
+		if err != nil {
+			return result, err
+		}
+		result.File = folder.Parent
+		return result, nil
 	}))
 
 	mux.Handle("POST /v2/files/delete", handleJSONRPC(func(r *http.Request) (any, error) {
@@ -165,11 +267,74 @@ func NewFakePutio() *FakePutio {
 		return nil, nil
 	}))
 
+	mux.Handle("POST /v2/files/move", handleJSONRPC(func(r *http.Request) (any, error) {
+		if err := r.ParseForm(); err != nil {
+			return nil, fmt.Errorf("failed to parse form: %w", err)
+		}
+		parentID, err := strconv.ParseInt(r.FormValue("parent_id"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parent_id: %w", err)
+		}
+		parent, ok := fake.files[parentID]
+		if !ok {
+			return nil, fmt.Errorf("unknown file: %d", parentID)
+		}
+		for _, fileID := range strings.Split(r.FormValue("file_ids"), ",") {
+			id, err := strconv.ParseInt(fileID, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse file ID `%s`: %w", fileID, err)
+			}
+			file, ok := fake.files[id]
+			if !ok {
+				return nil, fmt.Errorf("unknown file: %d", id)
+			}
+			if oldParent, ok := fake.files[file.Parent.ParentID]; ok {
+				oldParent.Files = slices.DeleteFunc(oldParent.Files, func(f *putio.File) bool { return f.ID == id })
+			}
+			file.Parent.ParentID = parentID
+			parent.Files = append(parent.Files, &file.Parent)
+		}
+		return nil, nil
+	}))
+
+	mux.Handle("POST /v2/files/rename", handleJSONRPC(func(r *http.Request) (any, error) {
+		if err := r.ParseForm(); err != nil {
+			return nil, fmt.Errorf("failed to parse form: %w", err)
+		}
+		id, err := strconv.ParseInt(r.FormValue("file_id"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse file_id: %w", err)
+		}
+		name := r.FormValue("name")
+		if name == "" {
+			return nil, errors.New("missing name form value")
+		}
+		file, ok := fake.files[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown file: %d", id)
+		}
+		file.Parent.Name = name
+		return nil, nil
+	}))
+
+	type accountInfo struct{ Info putio.AccountInfo }
+	mux.Handle("GET /v2/account/info", handleJSONRPC(func(r *http.Request) (accountInfo, error) {
+		var result accountInfo
+		result.Info.AccountActive = true
+		for _, content := range fake.contents {
+			result.Info.Disk.Used += int64(len(content))
+		}
+		result.Info.Disk.Size = fake.diskSize
+		result.Info.Disk.Avail = fake.diskSize - result.Info.Disk.Used
+		return result, nil
+	}))
+
 	type transferList struct{ Transfers []putioTransfer }
 	mux.Handle("GET /v2/transfers/list", handleJSONRPC(func(r *http.Request) (transferList, error) {
 		var result transferList
-		for _, transfer := range fake.transfers {
-			result.Transfers = append(result.Transfers, *transfer)
+		// Put.io lists the transfers in the order they were added.
+		for _, id := range slices.Sorted(maps.Keys(fake.transfers)) {
+			result.Transfers = append(result.Transfers, *fake.transfers[id])
 		}
 		return result, nil
 	}))
@@ -217,6 +382,51 @@ func NewFakePutio() *FakePutio {
 		return result, nil
 	}))
 
+	// Uploaded torrent files become transfers, without a callback URL.
+	type fileUpload struct {
+		File     *putio.File    `json:"file"`
+		Transfer *putioTransfer `json:"transfer"`
+	}
+	mux.Handle("POST /v2/files/upload", handleJSONRPC(func(r *http.Request) (fileUpload, error) {
+		var result fileUpload
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			return result, err
+		}
+		defer file.Close()
+		content, err := io.ReadAll(file)
+		if err != nil {
+			return result, err
+		}
+		parentID := int64(0)
+		if value := r.FormValue("parent_id"); value != "" {
+			if parentID, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return result, fmt.Errorf("failed to parse parent ID: %w", err)
+			}
+		}
+		if !strings.HasSuffix(header.Filename, ".torrent") {
+			return result, fmt.Errorf("only torrent files can be uploaded, got `%s`", header.Filename)
+		}
+		metainfo, err := torrent.Parse(content)
+		if err != nil {
+			return result, err
+		}
+
+		result.Transfer = &putioTransfer{
+			Transfer: putio.Transfer{
+				ID:           atomic.AddInt64(&fake.transferID, 1),
+				Name:         metainfo.Name,
+				Size:         int(metainfo.Length),
+				Status:       "DOWNLOADING",
+				SaveParentID: parentID,
+			},
+			CreatedAt: &putioTime{Time: time.Now()},
+		}
+		fake.transfers[result.Transfer.ID] = result.Transfer
+		fake.torrents[result.Transfer.ID] = content
+		return result, nil
+	}))
+
 	type transferGet struct{ Transfer putioTransfer }
 	mux.Handle("GET /v2/transfers/{id}", handleJSONRPC(func(r *http.Request) (transferGet, error) {
 		var result transferGet
@@ -236,6 +446,26 @@ func NewFakePutio() *FakePutio {
 		return result, nil
 	}))
 
+	type transferRetry struct{ Transfer putioTransfer }
+	mux.Handle("POST /v2/transfers/retry", handleJSONRPC(func(r *http.Request) (transferRetry, error) {
+		var result transferRetry
+		if err := r.ParseForm(); err != nil {
+			return result, err
+		}
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return result, fmt.Errorf("failed to parse transfer ID: %w", err)
+		}
+		transfer, ok := fake.transfers[id]
+		if !ok {
+			return result, fmt.Errorf("transfer ID not found `%d`", id)
+		}
+		transfer.Status = "IN_QUEUE"
+		transfer.ErrorMessage = ""
+		result.Transfer = *transfer
+		return result, nil
+	}))
+
 	mux.Handle("POST /v2/transfers/cancel", handleJSONRPC(func(r *http.Request) (any, error) {
 		err := r.ParseForm()
 		if err != nil {
@@ -278,7 +508,22 @@ func NewFakePutio() *FakePutio {
 		return result, nil
 	}))
 
-	fake.server = httptest.NewServer(mux)
+	// Requests are served one at a time since the fake's state isn't otherwise synchronized.
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if failure := fake.failure; failure != nil && strings.HasPrefix(r.URL.Path, "/v2/") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(failure.status)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error_type":    failure.errorType,
+				"error_message": http.StatusText(failure.status),
+				"status":        "ERROR",
+			})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
 	return &fake
 }
 
@@ -287,12 +532,27 @@ func (s *FakePutio) Close() {
 }
 
 func (s *FakePutio) NewClient() *putio.Client {
-	putioClient := putio.NewClient(http.DefaultClient)
 	serverURL, _ := url.Parse(s.server.URL)
+	putioClient := putio.NewClient(&http.Client{Transport: uploadTransport{serverURL: serverURL}})
 	putioClient.BaseURL = serverURL
 	return putioClient
 }
 
+// uploadTransport sends the requests meant for the Put.io upload server to the fake, like the other API requests.
+type uploadTransport struct {
+	serverURL *url.URL
+}
+
+func (t uploadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "upload.put.io" {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = t.serverURL.Scheme
+		req.URL.Host = t.serverURL.Host
+		req.Host = ""
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
 func (s *FakePutio) createFolder(parentID int64, name string) (putioFile, error) {
 	var folder putioFile
 	parent, ok := s.files[parentID]
@@ -316,6 +576,8 @@ func (s *FakePutio) createFolder(parentID int64, name string) (putioFile, error)
 }
 
 func (s *FakePutio) CreateFolder(parentID int64, name string) (putio.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	folder, err := s.createFolder(parentID, name)
 	if err != nil {
 		return putio.File{}, err
@@ -323,8 +585,55 @@ func (s *FakePutio) CreateFolder(parentID int64, name string) (putio.File, error
 	return folder.Parent, nil
 }
 
+// CreateFile creates a file with the given content under the given parent folder.
+func (s *FakePutio) CreateFile(parentID int64, name string, content []byte) (putio.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parent, ok := s.files[parentID]
+	if !ok {
+		return putio.File{}, fmt.Errorf("file with ID %v not found", parentID)
+	}
+
+	file := putioFile{
+		Parent: putio.File{
+			ID:          atomic.AddInt64(&s.fileID, 1),
+			ParentID:    parentID,
+			Name:        name,
+			Size:        int64(len(content)),
+			ContentType: "application/octet-stream",
+			CRC32:       fmt.Sprintf("%08x", crc32.ChecksumIEEE(content)),
+		},
+	}
+
+	parent.Files = append(parent.Files, &file.Parent)
+	s.files[file.Parent.ID] = &file
+	s.contents[file.Parent.ID] = content
+
+	return file.Parent, nil
+}
+
+// SetTransferCompletedWithFile marks the transfer with the given ID as completed with the given file or folder.
+func (s *FakePutio) SetTransferCompletedWithFile(id int64, fileID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transfer, ok := s.transfers[id]
+	if !ok {
+		return fmt.Errorf("unknown transfer ID: %d", id)
+	}
+	if _, ok := s.files[fileID]; !ok {
+		return fmt.Errorf("unknown file ID: %d", fileID)
+	}
+	transfer.FinishedAt = &putioTime{Time: time.Now()}
+	transfer.PercentDone = 100
+	transfer.Status = "COMPLETED"
+	transfer.FileID = fileID
+	return nil
+}
+
 // SetTransferCompleted marks the transfer with the given ID as completed, gives it a file ID, and returns it.
 func (s *FakePutio) SetTransferCompleted(id int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	transfer, ok := s.transfers[id]
 	if !ok {
 		return 0, fmt.Errorf("unknown transfer ID: %d", id)
@@ -336,6 +645,114 @@ func (s *FakePutio) SetTransferCompleted(id int64) (int64, error) {
 	return transfer.FileID, nil
 }
 
+// SetTransferError marks the transfer with the given ID as failed with the given error message.
+func (s *FakePutio) SetTransferError(id int64, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transfer, ok := s.transfers[id]
+	if !ok {
+		return fmt.Errorf("unknown transfer ID: %d", id)
+	}
+	transfer.Status = "ERROR"
+	transfer.ErrorMessage = message
+	return nil
+}
+
+// GetTransfer returns the transfer with the given ID, if it wasn't cancelled.
+func (s *FakePutio) GetTransfer(id int64) (putio.Transfer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transfer, ok := s.transfers[id]
+	if !ok {
+		return putio.Transfer{}, false
+	}
+	return transfer.Transfer, true
+}
+
+// GetFile returns the file or folder with the given ID.
+// GetUploadedTorrent returns the torrent file the transfer was uploaded with, if any.
+func (s *FakePutio) GetUploadedTorrent(id int64) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, ok := s.torrents[id]
+	return content, ok
+}
+
+func (s *FakePutio) GetFile(id int64) (putio.File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, ok := s.files[id]
+	if !ok {
+		return putio.File{}, false
+	}
+	return file.Parent, true
+}
+
+// FailRequests makes every API request fail with the given status and Put.io error type, until it's called with a
+// zero status.
+func (s *FakePutio) FailRequests(status int, errorType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status == 0 {
+		s.failure = nil
+		return
+	}
+	s.failure = &putioFailure{status: status, errorType: errorType}
+}
+
+// SetDiskSize sets the size of the account's disk. The used space is the size of the content of the files.
+func (s *FakePutio) SetDiskSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.diskSize = size
+}
+
+// SetDownloadBudget limits the number of bytes of file content that will be served before downloads start failing
+// mid-response, as if the connection dropped. A negative budget means no limit.
+func (s *FakePutio) SetDownloadBudget(budget int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloadBudget = budget
+}
+
+// CorruptDownloads makes the next requests for the content of the file with the given ID serve corrupted bytes.
+func (s *FakePutio) CorruptDownloads(fileID int64, requests int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.corruptions[fileID] = requests
+}
+
+// GetBytesServed returns the number of bytes of file content that were served so far.
+func (s *FakePutio) GetBytesServed() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytesServed
+}
+
+// budgetWriter counts the bytes of file content served, and drops the response once the download budget is spent.
+type budgetWriter struct {
+	http.ResponseWriter
+	fake *FakePutio
+}
+
+func (w *budgetWriter) Write(p []byte) (int, error) {
+	if budget := w.fake.downloadBudget; budget >= 0 {
+		if int64(len(p)) > budget {
+			p = p[:budget]
+		}
+		w.fake.downloadBudget -= int64(len(p))
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.fake.bytesServed += int64(n)
+	if err == nil && w.fake.downloadBudget == 0 {
+		err = errors.New("download budget exhausted")
+	}
+	return n, err
+}
+
 func (s *FakePutio) GetAllDeletedFileIDs() []int64 {
-	return s.deletedFileIDs
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.deletedFileIDs)
 }
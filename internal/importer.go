@@ -0,0 +1,59 @@
+package internal
+
+import "context"
+
+// ImportVerdict is the import status of a Put.io transfer according to an importer.
+type ImportVerdict int
+
+const (
+	// The importer doesn't know about the transfer.
+	ImportUnknown ImportVerdict = iota
+	// The importer is still waiting on the transfer, or is importing its files.
+	ImportPending
+	// The importer has imported all the files it wanted from the transfer.
+	ImportImported
+	// The importer failed to import some of the files it wanted from the transfer.
+	ImportFailed
+)
+
+func (v ImportVerdict) String() string {
+	switch v {
+	case ImportPending:
+		return "pending"
+	case ImportImported:
+		return "imported"
+	case ImportFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Importer is implemented by each *arr instance that imports files from Put.io transfers.
+type Importer interface {
+	// Name identifies the importer in logs and errors.
+	Name() string
+
+	// GetImportVerdicts returns the verdicts of the transfers the importer knows about, keyed by download ID, i.e.,
+	// the hash the transfer was reported with, in lowercase. Transfers that are missing from the result have an
+	// unknown verdict.
+	GetImportVerdicts(ctx context.Context) (map[string]ImportVerdict, error)
+}
+
+// Combines the verdicts of the items of a transfer, or of the importers that know about a transfer. Unknown verdicts
+// are ignored, and the transfer is only imported once every other verdict agrees. Failures take precedence over
+// pending imports, since a failed import won't resolve itself.
+func combineImportVerdicts(verdicts ...ImportVerdict) ImportVerdict {
+	result := ImportUnknown
+	for _, verdict := range verdicts {
+		switch {
+		case verdict == ImportFailed:
+			return ImportFailed
+		case verdict == ImportPending:
+			result = ImportPending
+		case verdict == ImportImported && result == ImportUnknown:
+			result = ImportImported
+		}
+	}
+	return result
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/albertb/putarr/internal/fakes"
+	"golift.io/starr/lidarr"
+	"golift.io/starr/radarr"
+	"golift.io/starr/readarr"
+	"golift.io/starr/sonarr"
+)
+
+func TestCombineImportVerdicts(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		verdicts []ImportVerdict
+		want     ImportVerdict
+	}{
+		{"none", nil, ImportUnknown},
+		{"unknown", []ImportVerdict{ImportUnknown}, ImportUnknown},
+		{"imported", []ImportVerdict{ImportImported, ImportImported}, ImportImported},
+		{"ignores unknown", []ImportVerdict{ImportUnknown, ImportImported}, ImportImported},
+		{"pending", []ImportVerdict{ImportImported, ImportPending}, ImportPending},
+		{"pending first", []ImportVerdict{ImportPending, ImportImported}, ImportPending},
+		{"failed", []ImportVerdict{ImportImported, ImportFailed}, ImportFailed},
+		{"failed over pending", []ImportVerdict{ImportFailed, ImportPending}, ImportFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := combineImportVerdicts(tc.verdicts...); got != tc.want {
+				t.Fatalf("got verdict %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestImporters(t *testing.T) {
+	hash := FormatTorrentHash(42)
+
+	for _, tc := range []struct {
+		name     string
+		importer func(fake *fakes.FakeArrs) Importer
+		setup    func(fake *fakes.FakeArrs)
+		want     ImportVerdict
+	}{
+		{
+			name:     "radarr unknown",
+			importer: func(fake *fakes.FakeArrs) Importer { return NewRadarrImporter("radarr", fake.NewRadarrClient()) },
+			setup:    func(fake *fakes.FakeArrs) {},
+			want:     ImportUnknown,
+		},
+		{
+			name:     "radarr pending",
+			importer: func(fake *fakes.FakeArrs) Importer { return NewRadarrImporter("radarr", fake.NewRadarrClient()) },
+			setup: func(fake *fakes.FakeArrs) {
+				fake.AddRadarrQueueRecord(radarr.QueueRecord{MovieID: 1, DownloadID: hash, TrackedDownloadState: "downloading"})
+			},
+			want: ImportPending,
+		},
+		{
+			name:     "radarr imported",
+			importer: func(fake *fakes.FakeArrs) Importer { return NewRadarrImporter("radarr", fake.NewRadarrClient()) },
+			setup: func(fake *fakes.FakeArrs) {
+				fake.AddRadarrHistoryRecord(radarr.HistoryRecord{MovieID: 1, DownloadID: hash})
+			},
+			want: ImportImported,
+		},
+		{
+			name:     "radarr failed",
+			importer: func(fake *fakes.FakeArrs) Importer { return NewRadarrImporter("radarr", fake.NewRadarrClient()) },
+			setup: func(fake *fakes.FakeArrs) {
+				fake.AddRadarrQueueRecord(radarr.QueueRecord{MovieID: 1, DownloadID: hash, TrackedDownloadState: "importFailed"})
+			},
+			want: ImportFailed,
+		},
+		{
+			name:     "sonarr partially imported",
+			importer: func(fake *fakes.FakeArrs) Importer { return NewSonarrImporter("sonarr", fake.NewSonarrClient()) },
+			setup: func(fake *fakes.FakeArrs) {
+				fake.AddSonarrHistoryRecord(sonarr.HistoryRecord{EpisodeID: 1, DownloadID: hash})
+				fake.AddSonarrQueueRecord(sonarr.QueueRecord{EpisodeID: 2, DownloadID: hash, TrackedDownloadState: "importPending"})
+			},
+			want: ImportPending,
+		},
+		{
+			name:     "sonarr imported",
+			importer: func(fake *fakes.FakeArrs) Importer { return NewSonarrImporter("sonarr", fake.NewSonarrClient()) },
+			setup: func(fake *fakes.FakeArrs) {
+				fake.AddSonarrHistoryRecord(sonarr.HistoryRecord{EpisodeID: 1, DownloadID: hash})
+				fake.AddSonarrHistoryRecord(sonarr.HistoryRecord{EpisodeID: 2, DownloadID: hash})
+			},
+			want: ImportImported,
+		},
+		{
+			name:     "lidarr failed",
+			importer: func(fake *fakes.FakeArrs) Importer { return NewLidarrImporter("lidarr", fake.NewLidarrClient()) },
+			setup: func(fake *fakes.FakeArrs) {
+				fake.AddLidarrQueueRecord(lidarr.QueueRecord{AlbumID: 1, DownloadID: hash, TrackedDownloadStatus: "error"})
+			},
+			want: ImportFailed,
+		},
+		{
+			name:     "readarr imported",
+			importer: func(fake *fakes.FakeArrs) Importer { return NewReadarrImporter("readarr", fake.NewReadarrClient()) },
+			setup: func(fake *fakes.FakeArrs) {
+				fake.AddReadarrHistoryRecord(readarr.HistoryRecord{BookID: 1, DownloadID: hash})
+			},
+			want: ImportImported,
+		},
+		{
+			name:     "whisparr pending",
+			importer: func(fake *fakes.FakeArrs) Importer { return NewWhisparrImporter("whisparr", fake.NewWhisparrClient()) },
+			setup: func(fake *fakes.FakeArrs) {
+				fake.AddWhisparrQueueRecord(radarr.QueueRecord{MovieID: 1, DownloadID: hash})
+			},
+			want: ImportPending,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := fakes.NewFakeArrs()
+			defer fake.Close()
+			tc.setup(fake)
+
+			verdicts, err := tc.importer(fake).GetImportVerdicts(context.Background())
+			if err != nil {
+				t.Fatalf("failed to get import verdicts: %s", err)
+			}
+			if got := verdicts[hash]; got != tc.want {
+				t.Fatalf("got verdict %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestArrClient_CombinesImporters(t *testing.T) {
+	fakeHD := fakes.NewFakeArrs()
+	defer fakeHD.Close()
+	fake4K := fakes.NewFakeArrs()
+	defer fake4K.Close()
+
+	// Transfer 1 is imported by both instances, transfer 2 only by one of them, and transfer 3 failed in one of them.
+	fakeHD.AddRadarrHistoryRecord(radarr.HistoryRecord{MovieID: 1, DownloadID: FormatTorrentHash(1)})
+	fake4K.AddRadarrHistoryRecord(radarr.HistoryRecord{MovieID: 1, DownloadID: FormatTorrentHash(1)})
+	fakeHD.AddRadarrHistoryRecord(radarr.HistoryRecord{MovieID: 2, DownloadID: FormatTorrentHash(2)})
+	fake4K.AddRadarrQueueRecord(radarr.QueueRecord{MovieID: 2, DownloadID: FormatTorrentHash(2)})
+	fakeHD.AddRadarrHistoryRecord(radarr.HistoryRecord{MovieID: 3, DownloadID: FormatTorrentHash(3)})
+	fake4K.AddRadarrQueueRecord(radarr.QueueRecord{MovieID: 3, DownloadID: FormatTorrentHash(3), TrackedDownloadStatus: "error"})
+
+	arrClient := NewArrClient(
+		NewRadarrImporter("hd", fakeHD.NewRadarrClient()),
+		NewRadarrImporter("4k", fake4K.NewRadarrClient()))
+
+	verdicts, err := arrClient.GetImportVerdictsByDownloadID(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get import verdicts: %s", err)
+	}
+
+	for id, want := range map[int64]ImportVerdict{1: ImportImported, 2: ImportPending, 3: ImportFailed, 4: ImportUnknown} {
+		if got := verdicts[FormatTorrentHash(id)]; got != want {
+			t.Errorf("got verdict %v for transfer %d, want %v", got, id, want)
+		}
+	}
+}
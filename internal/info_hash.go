@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Returns the info hash of the magnet link as a lowercase hex string, or an empty string if it doesn't have a valid
+// BitTorrent info hash. Magnet links carry the v1 info hash either as 40 hex characters or as 32 base32 characters. The
+// v2 info hash is only used when there's no v1 info hash, truncated like BitTorrent clients do.
+func magnetInfoHash(magnet string) string {
+	link, err := url.Parse(magnet)
+	if err != nil || link.Scheme != "magnet" {
+		return ""
+	}
+	topics := link.Query()["xt"]
+	for _, topic := range topics {
+		hash, ok := strings.CutPrefix(strings.ToLower(topic), "urn:btih:")
+		if !ok {
+			continue
+		}
+		switch len(hash) {
+		case 40:
+			if _, err := hex.DecodeString(hash); err == nil {
+				return hash
+			}
+		case 32:
+			if decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash)); err == nil {
+				return hex.EncodeToString(decoded)
+			}
+		}
+	}
+	for _, topic := range topics {
+		// The v2 info hash is a SHA-256 multihash, prefixed with 1220.
+		hash, ok := strings.CutPrefix(strings.ToLower(topic), "urn:btmh:1220")
+		if !ok || len(hash) != 64 {
+			continue
+		}
+		if _, err := hex.DecodeString(hash); err == nil {
+			return hash[:40]
+		}
+	}
+	return ""
+}
+
+// Returns the info hash of the transfer, preferring the one recorded when it was added.
+func transferInfoHash(transfer Transfer) string {
+	if transfer.InfoHash != "" {
+		return transfer.InfoHash
+	}
+	if transfer.Metadata != nil && transfer.Metadata.InfoHash != "" {
+		return transfer.Metadata.InfoHash
+	}
+	if hash := magnetInfoHash(transfer.MagnetURI); hash != "" {
+		return hash
+	}
+	if transfer.Metadata != nil {
+		return magnetInfoHash(transfer.Metadata.Source)
+	}
+	return ""
+}
+
+// Maps the info hashes reported to clients to Put.io transfer IDs, and back. It's filled as transfers are added and
+// listed, which is how clients learn about the hashes in the first place.
+type infoHashIndex struct {
+	mu     sync.Mutex
+	ids    map[string]int64
+	hashes map[int64]string
+}
+
+func newInfoHashIndex() *infoHashIndex {
+	return &infoHashIndex{ids: map[string]int64{}, hashes: map[int64]string{}}
+}
+
+// Records that the transfer is reported with the given info hash, replacing any previous mapping of either.
+func (x *infoHashIndex) add(id int64, hash string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if old, ok := x.hashes[id]; ok && old != hash {
+		delete(x.ids, old)
+	}
+	if old, ok := x.ids[hash]; ok && old != id {
+		delete(x.hashes, old)
+	}
+	x.ids[hash] = id
+	x.hashes[id] = hash
+}
+
+// Forgets the info hash of the transfer, e.g., once it's removed.
+func (x *infoHashIndex) remove(id int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if hash, ok := x.hashes[id]; ok {
+		delete(x.ids, hash)
+		delete(x.hashes, id)
+	}
+}
+
+// Returns the ID of the transfer with the given info hash, if it's known.
+func (x *infoHashIndex) id(hash string) (int64, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	id, ok := x.ids[hash]
+	return id, ok
+}
+
+// Returns whether the key looks like a hex-encoded BitTorrent v1 info hash.
+func isInfoHash(key string) bool {
+	if len(key) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
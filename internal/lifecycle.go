@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Serve serves the handler on the listener, and runs the background tasks, until the context is done, e.g., when
+// Putarr receives SIGINT or SIGTERM. It then stops accepting new requests, and waits for the requests in flight and the
+// background tasks to finish, up to the shutdown timeout. The background tasks must return once the context is done.
+// When serving fails, the background tasks are stopped the same way before returning the error.
+func Serve(ctx context.Context, listener net.Listener, handler http.Handler, shutdownTimeout time.Duration, background ...func(ctx context.Context)) error {
+	server := &http.Server{Handler: handler}
+
+	tasksCtx, cancelTasks := context.WithCancel(ctx)
+	defer cancelTasks()
+
+	var wg sync.WaitGroup
+	for _, task := range background {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task(tasksCtx)
+		}()
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	var errs []error
+	serving := true
+	select {
+	case err := <-serveErr:
+		errs = append(errs, fmt.Errorf("failed to serve: %w", err))
+		serving = false
+		log.Println("failed to serve, stopping the background tasks, waiting up to", shutdownTimeout)
+	case <-ctx.Done():
+		log.Println("shutting down, waiting up to", shutdownTimeout)
+	}
+	cancelTasks()
+
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+
+	if serving {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to drain requests: %w", err))
+		}
+	}
+
+	tasksDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(tasksDone)
+	}()
+	select {
+	case <-tasksDone:
+	case <-shutdownCtx.Done():
+		errs = append(errs, fmt.Errorf("background tasks didn't stop in time: %w", shutdownCtx.Err()))
+	}
+
+	if serving {
+		if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Calls run, then waits for the interval before calling it again, until the context is done. The interval function is
+// called after every run so a reloaded config takes effect.
+func runAtInterval(ctx context.Context, interval func() time.Duration, run func()) {
+	for {
+		run()
+		timer := time.NewTimer(interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
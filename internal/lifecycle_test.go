@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/albertb/putarr/internal/fakes"
+)
+
+func TestServe_GracefulShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+
+	taskStopped := make(chan struct{})
+	task := func(ctx context.Context) {
+		<-ctx.Done()
+		close(taskStopped)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, listener, handler, time.Minute, task)
+	}()
+
+	// Start a request, and shut down while it's in flight.
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		response <- string(body)
+	}()
+	<-started
+	cancel()
+
+	select {
+	case <-taskStopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the background task wasn't stopped")
+	}
+
+	// New connections are refused right away, while the request in flight is drained.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("the server still accepts connections after shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("the server stopped before draining the request in flight: %v", err)
+	default:
+	}
+
+	close(release)
+	if got, want := <-response, "done"; got != want {
+		t.Fatalf("got response %q for the request in flight, want %q", got, want)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("failed to shut down: %s", err)
+	}
+}
+
+func TestServe_ShutdownTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	stuck := func(ctx context.Context) {
+		<-release
+	}
+
+	// A background task that ignores the context doesn't hold up the shutdown past the timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Serve(ctx, listener, http.NotFoundHandler(), 10*time.Millisecond, stuck)
+	if got, want := err, context.DeadlineExceeded; !errors.Is(got, want) {
+		t.Fatalf("got error %v, want %v", got, want)
+	}
+}
+
+func TestServe_StopsTasksWhenServingFails(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	// The background tasks are stopped, and waited for, even though the context isn't done.
+	taskStopped := false
+	task := func(ctx context.Context) {
+		<-ctx.Done()
+		taskStopped = true
+	}
+	err = Serve(context.Background(), listener, http.NotFoundHandler(), time.Minute, task)
+	if err == nil {
+		t.Fatal("got no error serving on a closed listener")
+	}
+	if !taskStopped {
+		t.Fatal("Serve returned before the background task stopped")
+	}
+}
+
+func TestJanitor_RunAtIntervalStops(t *testing.T) {
+	config := &Config{Transmission: TransmissionConfig{DownloadDir: "/putarr"}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	janitor := NewPutioJanitor(NewArrClient(), NewPutioProxy(config, fakePutio.NewClient(), nil))
+
+	// The janitor stops while it waits for the next run, rather than after the interval.
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		janitor.RunAtInterval(ctx, func() time.Duration { return time.Hour })
+		close(stopped)
+	}()
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the janitor didn't stop when the context was done")
+	}
+}
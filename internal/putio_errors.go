@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/putdotio/go-putio"
+)
+
+// Errors returned by PutioProxy, so the APIs can tell client mistakes apart from Put.io failures and report them
+// appropriately. They're wrapped along with the underlying error, so use errors.Is to check for them.
+var (
+	// The download directory isn't under the configured download directory.
+	ErrInvalidDir = errors.New("invalid download directory")
+	// The magnet link or URL of a transfer was rejected.
+	ErrBadMagnet = errors.New("invalid magnet link or URL")
+	// The torrent file couldn't be decoded.
+	ErrInvalidTorrent = errors.New("invalid or corrupt torrent file")
+	// The transfer was already added to Put.io.
+	ErrDuplicateTorrent = errors.New("duplicate torrent")
+	// The Put.io account is out of disk space.
+	ErrQuotaExceeded = errors.New("Put.io disk quota exceeded")
+	// Put.io rejected the OAuth token.
+	ErrAuthExpired = errors.New("Put.io OAuth token expired or revoked")
+	// Put.io couldn't be reached or failed to handle the request. These failures are transient and worth retrying.
+	ErrUpstreamUnavailable = errors.New("Put.io is unavailable")
+)
+
+// Wraps the error returned by the Put.io client with the matching error above, if any. Put.io doesn't document its
+// error types, so they're matched loosely.
+func classifyPutioError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var response *putio.ErrorResponse
+	if errors.As(err, &response) && response.Response != nil {
+		status := response.Response.StatusCode
+		errorType := strings.ToUpper(response.Type)
+		switch {
+		case status == http.StatusUnauthorized || strings.Contains(errorType, "UNAUTHORIZED") ||
+			strings.Contains(errorType, "INVALID_GRANT"):
+			return fmt.Errorf("%w: %w", ErrAuthExpired, err)
+		case status == http.StatusTooManyRequests || status >= http.StatusInternalServerError:
+			return fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
+		case status == http.StatusInsufficientStorage || strings.Contains(errorType, "STORAGE") ||
+			strings.Contains(errorType, "DISK") || strings.Contains(errorType, "QUOTA"):
+			return fmt.Errorf("%w: %w", ErrQuotaExceeded, err)
+		case status == http.StatusConflict || strings.Contains(errorType, "ALREADY") ||
+			strings.Contains(errorType, "DUPLICATE"):
+			return fmt.Errorf("%w: %w", ErrDuplicateTorrent, err)
+		case strings.Contains(errorType, "URL") || strings.Contains(errorType, "MAGNET"):
+			return fmt.Errorf("%w: %w", ErrBadMagnet, err)
+		}
+		return err
+	}
+
+	// Timeouts and network failures mean Put.io couldn't be reached, unlike a request cancelled by the client.
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
+	}
+	return err
+}
+
+// Returns the Transmission RPC result string for the error. Transmission reports errors with a descriptive result
+// rather than an HTTP status, and the *arrs show it to users in their health checks.
+func transmissionResult(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return "Put.io is temporarily unavailable, try again later"
+	case errors.Is(err, ErrAuthExpired):
+		return "Put.io rejected the OAuth token, check putio.oauth_token in the Putarr configuration"
+	case errors.Is(err, ErrQuotaExceeded):
+		return "not enough free space on Put.io"
+	case errors.Is(err, ErrDuplicateTorrent):
+		return "duplicate torrent"
+	case errors.Is(err, ErrInvalidTorrent):
+		return "invalid or corrupt torrent file"
+	default:
+		return err.Error()
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -19,17 +20,14 @@ func NewPutioJanitor(arrClient *ArrClient, putioProxy *PutioProxy) *PutioJanitor
 	}
 }
 
-// RunAtInterval runs the janitor at the specified interval.
-func (j *PutioJanitor) RunAtInterval(ctx context.Context, interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	go func() {
-		for {
-			if _, err := j.RunOnce(ctx); err != nil {
-				log.Println("failed to run janitor:", err)
-			}
-			<-ticker.C
+// RunAtInterval runs the janitor at the interval returned by the interval function, which is called again after every
+// run so a reloaded config takes effect. It returns once the context is done.
+func (j *PutioJanitor) RunAtInterval(ctx context.Context, interval func() time.Duration) {
+	runAtInterval(ctx, interval, func() {
+		if _, err := j.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Println("failed to run janitor:", err)
 		}
-	}()
+	})
 }
 
 // RunOnce runs the janitor and returns the IDs of transfers that were cleaned up.
@@ -41,45 +39,35 @@ func (j *PutioJanitor) RunOnce(ctx context.Context) ([]int64, error) {
 		return completedTransferIDs, fmt.Errorf("failed to get transfers from Put.io: %w", err)
 	}
 
-	radarrStatuses, err := j.arrClient.GetRadarrImportStatusByTransferID(ctx)
-	if err != nil {
-		return completedTransferIDs, err
-	}
-	sonarrStatuses, err := j.arrClient.GetSonarrImportStatusByTransferID(ctx)
+	verdicts, err := j.arrClient.GetImportVerdictsByDownloadID(ctx)
 	if err != nil {
 		return completedTransferIDs, err
 	}
 
-	// Find transfers with successful imports and no pending queue activities.
+	// Find transfers with successful imports and no pending queue activities in every importer that knows about them.
+	// The importers know the transfers by the hash they were reported with, or by the ID they were held under.
 	for _, transfer := range transfers {
-		imported := true
-
-		// Items with queue records and/or no import records are not considered to be imported yet.
-		if status, ok := radarrStatuses[transfer.ID]; ok {
-			for _, item := range status.StatusByMovieID {
-				if item.ImportRecord == nil || item.PendingRecord != nil {
-					imported = false
-				}
-			}
-		} else if status, ok := sonarrStatuses[transfer.ID]; ok {
-			for _, item := range status.StatusByEpisodeID {
-				if item.ImportRecord == nil || item.PendingRecord != nil {
-					imported = false
-				}
-			}
-		} else {
-			log.Println("no corresponding imports for Put.io transfer with ID:", transfer.ID)
-			continue
+		var known []ImportVerdict
+		for _, hash := range transferHashes(transfer) {
+			known = append(known, verdicts[strings.ToLower(hash)])
 		}
-
-		if imported {
+		switch verdict := combineImportVerdicts(known...); verdict {
+		case ImportUnknown:
+			log.Println("no corresponding imports for Put.io transfer with ID:", transfer.ID)
+		case ImportFailed:
+			log.Println("failed imports for Put.io transfer with ID:", transfer.ID)
+		case ImportImported:
 			log.Println("found completed transfer ready for cleanup:", transfer.ID)
 			completedTransferIDs = append(completedTransferIDs, transfer.ID)
 		}
 	}
 
-	if len(completedTransferIDs) > 0 {
-		err = j.putioProxy.RemoveTransfers(ctx, true, completedTransferIDs...)
+	// When the context is done, e.g., on shutdown, stop between transfers rather than halfway through removing one.
+	for i, id := range completedTransferIDs {
+		if err := ctx.Err(); err != nil {
+			return completedTransferIDs[:i], err
+		}
+		err = j.putioProxy.RemoveTransfers(context.WithoutCancel(ctx), true, id)
 		if err != nil {
 			return completedTransferIDs, err
 		}
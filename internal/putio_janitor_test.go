@@ -3,12 +3,16 @@ package internal
 import (
 	"context"
 	"log"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/albertb/putarr/internal/fakes"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"golift.io/starr/lidarr"
 	"golift.io/starr/radarr"
+	"golift.io/starr/readarr"
 	"golift.io/starr/sonarr"
 )
 
@@ -30,13 +34,15 @@ func TestJanitor(t *testing.T) {
 	fakeArrs := fakes.NewFakeArrs()
 	defer fakeArrs.Close()
 
-	arrClient := NewArrClient(config, fakeArrs.NewRadarrClient(), fakeArrs.NewSonarrClient())
-	putioProxy := NewPutioProxy(config, fakePutio.NewClient())
+	arrClient := NewArrClient(
+		NewRadarrImporter("radarr", fakeArrs.NewRadarrClient()),
+		NewSonarrImporter("sonarr", fakeArrs.NewSonarrClient()))
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), nil)
 
 	janitor := NewPutioJanitor(arrClient, putioProxy)
 
 	// Start by adding in-progress transfers for a movie and some episodes.
-	movieTransfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:AAA&dn=movie", "/")
+	movieTransfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:AAA&dn=movie", "/", TransferMetadata{})
 	if err != nil {
 		t.Fatalf("failed to add movie transfer: %s", err)
 	}
@@ -46,7 +52,7 @@ func TestJanitor(t *testing.T) {
 		radarr.QueueRecord{MovieID: 123, DownloadID: FormatTorrentHash(movieTransfer.ID)})
 
 	// Next, add an in-progress transfer for some episodes.
-	showTransfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:BBB&dn=episodes", "/")
+	showTransfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:BBB&dn=episodes", "/", TransferMetadata{})
 	if err != nil {
 		t.Fatalf("failed to add show transfer: %s", err)
 	}
@@ -128,3 +134,215 @@ func TestJanitor(t *testing.T) {
 		t.Fatalf("got deleted files %v, want %v", got, want)
 	}
 }
+
+func TestJanitor_LidarrReadarrWhisparr(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		Transmission: TransmissionConfig{
+			DownloadDir: "/",
+		},
+	}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	fakeArrs := fakes.NewFakeArrs()
+	defer fakeArrs.Close()
+
+	arrClient := NewArrClient(
+		NewLidarrImporter("lidarr", fakeArrs.NewLidarrClient()),
+		NewReadarrImporter("readarr", fakeArrs.NewReadarrClient()),
+		NewWhisparrImporter("whisparr", fakeArrs.NewWhisparrClient()))
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), nil)
+
+	janitor := NewPutioJanitor(arrClient, putioProxy)
+
+	albumTransfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:AAA&dn=album", "/", TransferMetadata{})
+	if err != nil {
+		t.Fatalf("failed to add album transfer: %s", err)
+	}
+	bookTransfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:BBB&dn=book", "/", TransferMetadata{})
+	if err != nil {
+		t.Fatalf("failed to add book transfer: %s", err)
+	}
+	sceneTransfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:CCC&dn=scene", "/", TransferMetadata{})
+	if err != nil {
+		t.Fatalf("failed to add scene transfer: %s", err)
+	}
+
+	// The transfer contains two albums, only one of which is imported.
+	fakeArrs.AddLidarrHistoryRecord(lidarr.HistoryRecord{AlbumID: 1, DownloadID: FormatTorrentHash(albumTransfer.ID)})
+	albumQueueID := fakeArrs.AddLidarrQueueRecord(
+		lidarr.QueueRecord{AlbumID: 2, DownloadID: FormatTorrentHash(albumTransfer.ID)})
+
+	// The book and the scene are both imported.
+	fakeArrs.AddReadarrHistoryRecord(readarr.HistoryRecord{BookID: 1, DownloadID: FormatTorrentHash(bookTransfer.ID)})
+	fakeArrs.AddWhisparrHistoryRecord(radarr.HistoryRecord{MovieID: 1, DownloadID: FormatTorrentHash(sceneTransfer.ID)})
+
+	ids, err := janitor.RunOnce(ctx)
+	if err != nil {
+		t.Fatalf("failed to run janitor: %s", err)
+	}
+
+	sliceOpts := cmpopts.SortSlices(func(x, y int64) bool {
+		return x < y
+	})
+
+	if got, want := ids, []int64{bookTransfer.ID, sceneTransfer.ID}; !cmp.Equal(got, want, sliceOpts) {
+		t.Fatalf("got %v cleaned up transfers, want %v", got, want)
+	}
+
+	// Import the second album.
+	fakeArrs.RemoveLidarrQueueRecord(albumQueueID)
+	fakeArrs.AddLidarrHistoryRecord(lidarr.HistoryRecord{AlbumID: 2, DownloadID: FormatTorrentHash(albumTransfer.ID)})
+
+	ids, err = janitor.RunOnce(ctx)
+	if err != nil {
+		t.Fatalf("failed to run janitor: %s", err)
+	}
+	if got, want := ids, []int64{albumTransfer.ID}; !cmp.Equal(got, want, sliceOpts) {
+		t.Fatalf("got %v cleaned up transfers, want %v", got, want)
+	}
+}
+
+func TestJanitor_MultipleInstances(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		Transmission: TransmissionConfig{
+			DownloadDir: "/",
+		},
+	}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	// Each fake serves a separate Radarr instance.
+	fakeHD := fakes.NewFakeArrs()
+	defer fakeHD.Close()
+	fake4K := fakes.NewFakeArrs()
+	defer fake4K.Close()
+
+	arrClient := NewArrClient(
+		NewRadarrImporter("hd", fakeHD.NewRadarrClient()),
+		NewRadarrImporter("4k", fake4K.NewRadarrClient()))
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), nil)
+
+	janitor := NewPutioJanitor(arrClient, putioProxy)
+
+	// Both instances grabbed the same release, and only the HD instance has imported it so far.
+	transfer, err := putioProxy.AddTransfer(ctx, "magnet:?xt=urn:btih:AAA&dn=movie", "/", TransferMetadata{})
+	if err != nil {
+		t.Fatalf("failed to add movie transfer: %s", err)
+	}
+	fakeHD.AddRadarrHistoryRecord(radarr.HistoryRecord{MovieID: 1, DownloadID: FormatTorrentHash(transfer.ID)})
+	queueID := fake4K.AddRadarrQueueRecord(radarr.QueueRecord{MovieID: 7, DownloadID: FormatTorrentHash(transfer.ID)})
+
+	ids, err := janitor.RunOnce(ctx)
+	if err != nil {
+		t.Fatalf("failed to run janitor: %s", err)
+	}
+	if got, want := len(ids), 0; got != want {
+		t.Fatalf("got len(cleaned up transfers) %d, want %d", got, want)
+	}
+
+	// Once the 4K instance imports it too, the transfer is cleaned up.
+	fake4K.RemoveRadarrQueueRecord(queueID)
+	fake4K.AddRadarrHistoryRecord(radarr.HistoryRecord{MovieID: 7, DownloadID: FormatTorrentHash(transfer.ID)})
+
+	ids, err = janitor.RunOnce(ctx)
+	if err != nil {
+		t.Fatalf("failed to run janitor: %s", err)
+	}
+	if got, want := ids, []int64{transfer.ID}; !cmp.Equal(got, want) {
+		t.Fatalf("got %v cleaned up transfers, want %v", got, want)
+	}
+}
+
+func TestJanitor_InfoHashDownloadIDs(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		Transmission: TransmissionConfig{
+			DownloadDir: "/",
+		},
+	}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	fakeArrs := fakes.NewFakeArrs()
+	defer fakeArrs.Close()
+
+	arrClient := NewArrClient(NewRadarrImporter("radarr", fakeArrs.NewRadarrClient()))
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), nil)
+
+	janitor := NewPutioJanitor(arrClient, putioProxy)
+
+	// Radarr knows the transfer by its info hash, which it reports in uppercase.
+	transfer, err := putioProxy.AddTransfer(ctx,
+		"magnet:?xt=urn:btih:fedcba9876543210fedcba9876543210fedcba98&dn=movie", "/", TransferMetadata{})
+	if err != nil {
+		t.Fatalf("failed to add movie transfer: %s", err)
+	}
+	fakePutio.SetTransferCompleted(transfer.ID)
+	fakeArrs.AddRadarrHistoryRecord(radarr.HistoryRecord{MovieID: 1,
+		DownloadID: strings.ToUpper("fedcba9876543210fedcba9876543210fedcba98")})
+
+	ids, err := janitor.RunOnce(ctx)
+	if err != nil {
+		t.Fatalf("failed to run janitor: %s", err)
+	}
+	if got, want := ids, []int64{transfer.ID}; !cmp.Equal(got, want) {
+		t.Fatalf("got %v cleaned up transfers, want %v", got, want)
+	}
+}
+
+func TestJanitor_StartedHeldTransfer(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		Transmission: TransmissionConfig{
+			DownloadDir: "/",
+		},
+	}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	fakeArrs := fakes.NewFakeArrs()
+	defer fakeArrs.Close()
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "transfers.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	arrClient := NewArrClient(NewRadarrImporter("radarr", fakeArrs.NewRadarrClient()))
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), store)
+
+	janitor := NewPutioJanitor(arrClient, putioProxy)
+
+	// Radarr knows the paused transfer, which has no info hash, by the ID it was held under.
+	held, err := putioProxy.AddTransfer(ctx, "https://example.org/movie.torrent", "/", TransferMetadata{Paused: true})
+	if err != nil {
+		t.Fatalf("failed to add held transfer: %s", err)
+	}
+	if err := putioProxy.StartTransfers(ctx, held.ID); err != nil {
+		t.Fatalf("failed to start held transfer: %s", err)
+	}
+	transfers, err := putioProxy.GetTransfers(ctx)
+	if err != nil {
+		t.Fatalf("failed to list transfers: %s", err)
+	}
+	if got, want := len(transfers), 1; got != want {
+		t.Fatalf("got %d transfers, want %d", got, want)
+	}
+	started := transfers[0]
+	fakePutio.SetTransferCompleted(started.ID)
+	fakeArrs.AddRadarrHistoryRecord(radarr.HistoryRecord{MovieID: 1, DownloadID: FormatTorrentHash(held.ID)})
+
+	ids, err := janitor.RunOnce(ctx)
+	if err != nil {
+		t.Fatalf("failed to run janitor: %s", err)
+	}
+	if got, want := ids, []int64{started.ID}; !cmp.Equal(got, want) {
+		t.Fatalf("got %v cleaned up transfers, want %v", got, want)
+	}
+}
@@ -3,17 +3,18 @@ package internal
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/base32"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/url"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/jackpal/bencode-go"
+	"github.com/albertb/putarr/internal/torrent"
 	"github.com/putdotio/go-putio"
 )
 
@@ -21,116 +22,374 @@ import (
 type Transfer struct {
 	*putio.Transfer
 	DownloadDir string
+	InfoHash    string            // Info hash reported to clients. Empty for transfers added before Putarr reported them.
+	Local       *LocalDownload    // Progress of the local download, when local downloading is enabled.
+	Metadata    *TransferMetadata // Metadata recorded when the transfer was added, if any.
 }
 
 // PutioProxy proxies Transmission API RPCs to Put.io.
 type PutioProxy struct {
-	config      *Config
+	config      ConfigSource
 	putioClient *putio.Client
+	store       *Store
+	infoHashes  *infoHashIndex
 }
 
-func NewPutioProxy(config *Config, putioClient *putio.Client) *PutioProxy {
+// NewPutioProxy returns a proxy to Put.io. The store is optional and should be nil when transfer metadata isn't
+// persisted.
+func NewPutioProxy(config ConfigSource, putioClient *putio.Client, store *Store) *PutioProxy {
 	return &PutioProxy{
 		config:      config,
 		putioClient: putioClient,
+		store:       store,
+		infoHashes:  newInfoHashIndex(),
 	}
 }
 
-func (p *PutioProxy) AddTransfer(ctx context.Context, magnet, downloadDir string) (Transfer, error) {
+// AddTransfer adds the magnet link or URL to Put.io. The metadata is persisted to the store along with the source and
+// the download directory of the transfer. When a transfer with the same info hash was already added, it's returned
+// along with an ErrDuplicateTorrent error instead. Paused transfers are held in the store until they're started.
+func (p *PutioProxy) AddTransfer(ctx context.Context, magnet, downloadDir string, metadata TransferMetadata) (Transfer, error) {
 	var result Transfer
-	parentID, err := p.createAndReturnDirID(ctx, downloadDir)
-	if err != nil {
-		return result, fmt.Errorf("failed to create download directory on Put.io: %w", err)
+	metadata.Source = magnet
+	metadata.DownloadDir = downloadDir
+	metadata.AddedAt = time.Now()
+
+	if err := validateSource(magnet); err != nil {
+		return result, err
 	}
 
-	callbackURL, err := p.formatCallbackURL(extraState{DownloadDir: downloadDir})
-	if err != nil {
-		return result, fmt.Errorf("failed to format callback URL: %w", err)
+	if metadata.InfoHash == "" {
+		metadata.InfoHash = magnetInfoHash(magnet)
+	}
+	if metadata.InfoHash != "" {
+		existing, ok, err := p.findTransferByInfoHash(ctx, metadata.InfoHash)
+		if err != nil {
+			return result, err
+		}
+		if ok {
+			return existing, fmt.Errorf("%w: transfer with ID `%d` has info hash `%s`", ErrDuplicateTorrent, existing.ID,
+				metadata.InfoHash)
+		}
+	}
+
+	if metadata.Paused {
+		return p.holdTransfer(ctx, metadata)
 	}
+	return p.startTransfer(ctx, metadata)
+}
 
-	transfer, err := p.putioClient.Transfers.Add(ctx, magnet, parentID, callbackURL)
+// Adds the transfer described by the metadata to Put.io.
+func (p *PutioProxy) startTransfer(ctx context.Context, metadata TransferMetadata) (Transfer, error) {
+	var result Transfer
+	metadata.Paused = false
+
+	parentID, err := p.createAndReturnDirID(ctx, metadata.DownloadDir)
 	if err != nil {
-		return result, err
+		return result, fmt.Errorf("failed to create download directory: %w", err)
+	}
+
+	var transfer putio.Transfer
+	if metadata.Torrent != nil && p.uploadsTorrentFile(ctx, metadata) {
+		transfer, err = p.uploadTorrentFile(ctx, parentID, metadata)
+		if err != nil {
+			return result, err
+		}
+		metadata.Uploaded = true
+	} else {
+		callbackURL, err := p.formatCallbackURL(extraState{DownloadDir: metadata.DownloadDir, InfoHash: metadata.InfoHash})
+		if err != nil {
+			return result, fmt.Errorf("failed to format callback URL: %w", err)
+		}
+
+		transfer, err = p.putioClient.Transfers.Add(ctx, metadata.Source, parentID, callbackURL)
+		if err != nil {
+			return result, classifyPutioError(err)
+		}
 	}
 
 	result.Transfer = &transfer
-	result.DownloadDir = fmt.Sprintf("%s/%d", downloadDir, transfer.ID)
+	result.DownloadDir = fmt.Sprintf("%s/%d", metadata.DownloadDir, transfer.ID)
+	result.InfoHash = metadata.InfoHash
+	if result.InfoHash != "" {
+		p.infoHashes.add(transfer.ID, result.InfoHash)
+	}
+
+	if p.store != nil {
+		metadata.Name = transfer.Name
+		// The torrent file is only needed to add the transfer, and it would be rewritten along with every update.
+		metadata.Torrent = nil
+		// The transfer is already on Put.io, so don't fail the request when the metadata can't be saved. Unless the
+		// torrent was uploaded, since the store is then the only record that the transfer belongs to Putarr.
+		if err := p.store.Put(transfer.ID, metadata); err != nil {
+			if metadata.Uploaded {
+				return result, fmt.Errorf("failed to save metadata of uploaded transfer with ID `%d`: %w", transfer.ID, err)
+			}
+			log.Println("failed to save transfer metadata:", err)
+		}
+		result.Metadata = &metadata
+	}
 	return result, nil
 }
 
-func (p *PutioProxy) UploadTorrent(ctx context.Context, file []byte, downloadDir string) (Transfer, error) {
-	// We could upload the torrent directly to Put.io and it would work just fine, but we want to be able to add a
-	// callback URL to the transfer so we can identify it later. The Transfer API lets us add a callback URL, but it
-	// requires a magnet link instead of a torrent.
-	var transfer Transfer
+// Returns whether the torrent file of the transfer should be uploaded to Put.io as is, rather than converted to a
+// magnet link, as configured by download directory or by label.
+func (p *PutioProxy) uploadsTorrentFile(ctx context.Context, metadata TransferMetadata) bool {
+	config := configFor(ctx, p.config).Putio.UploadTorrents
+	for _, dir := range config.DownloadDirs {
+		dir = strings.TrimSuffix(dir, "/")
+		if metadata.DownloadDir == dir || strings.HasPrefix(metadata.DownloadDir, dir+"/") {
+			return true
+		}
+	}
+	for _, label := range metadata.Labels {
+		if slices.Contains(config.Labels, label) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Decode the torrent file and extract a dictionary of its fields.
-	decoded, err := bencode.Decode(bytes.NewReader(file))
+// Uploads the torrent file of the transfer to Put.io. This keeps the announce URLs of private trackers, which carry a
+// passkey that magnet links lose. Uploaded transfers can't have a callback URL, so their ownership is tracked by the
+// store instead.
+func (p *PutioProxy) uploadTorrentFile(ctx context.Context, parentID int64, metadata TransferMetadata) (putio.Transfer, error) {
+	if p.store == nil {
+		return putio.Transfer{}, errors.New("uploading torrent files requires the transfer metadata store")
+	}
+	upload, err := p.putioClient.Files.Upload(ctx, bytes.NewReader(metadata.Torrent), metadata.InfoHash+".torrent",
+		parentID)
 	if err != nil {
-		return transfer, fmt.Errorf("failed to decode torrent file: %w", err)
+		return putio.Transfer{}, classifyPutioError(err)
 	}
-	torrent, ok := decoded.(map[string]interface{})
-	if !ok {
-		return transfer, errors.New("unable to parse torrent file")
+	if upload.Transfer == nil {
+		return putio.Transfer{}, fmt.Errorf("%w: Put.io didn't start a transfer for the uploaded torrent", ErrInvalidTorrent)
+	}
+	return *upload.Transfer, nil
+}
+
+// Holds the transfer described by the metadata in the store, without adding it to Put.io.
+func (p *PutioProxy) holdTransfer(ctx context.Context, metadata TransferMetadata) (Transfer, error) {
+	if p.store == nil {
+		return Transfer{}, errors.New("paused torrents require the transfer metadata store")
+	}
+	// Fail early on an invalid download directory, rather than when the transfer is started.
+	if _, err := p.createAndReturnDirID(ctx, metadata.DownloadDir); err != nil {
+		return Transfer{}, fmt.Errorf("failed to create download directory: %w", err)
+	}
+	if metadata.Name == "" {
+		if link, err := url.Parse(metadata.Source); err == nil {
+			metadata.Name = link.Query().Get("dn")
+		}
 	}
 
-	// Calculate the info hash of the torrent and use it as the basis for the magnet link.
-	var buf bytes.Buffer
-	err = bencode.Marshal(&buf, torrent["info"])
+	id, err := p.store.Hold(metadata)
 	if err != nil {
-		return transfer, fmt.Errorf("failed to encode torrent info: %w", err)
+		return Transfer{}, fmt.Errorf("failed to save transfer metadata: %w", err)
+	}
+	if metadata.InfoHash != "" {
+		p.infoHashes.add(id, metadata.InfoHash)
+	}
+	return heldTransfer(id, metadata), nil
+}
+
+// Returns the held transfer as if it were on Put.io, with a status of its own.
+func heldTransfer(id int64, metadata TransferMetadata) Transfer {
+	transfer := &putio.Transfer{
+		ID:        id,
+		Name:      metadata.Name,
+		Status:    heldTransferStatus,
+		CreatedAt: &putio.Time{Time: metadata.AddedAt},
+	}
+	if strings.HasPrefix(metadata.Source, "magnet:") {
+		transfer.MagnetURI = metadata.Source
+	}
+	return Transfer{
+		Transfer:    transfer,
+		DownloadDir: metadata.DownloadDir,
+		InfoHash:    metadata.InfoHash,
+		Metadata:    &metadata,
 	}
-	checksum := sha1.Sum(buf.Bytes())
-	magnet := "magnet:?xt=urn:btih:" + base32.StdEncoding.EncodeToString(checksum[:])
+}
 
-	// Add the name and length of the torrent to the magnet link, if available.
-	if info, ok := torrent["info"].(map[string]interface{}); ok {
-		if name, ok := info["name"].(string); ok {
-			magnet += "&dn=" + url.QueryEscape(name)
+// Checks that the source of a transfer is something Put.io can fetch, i.e., a magnet link or an HTTP(S) URL.
+func validateSource(source string) error {
+	link, err := url.Parse(source)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadMagnet, err)
+	}
+	switch link.Scheme {
+	case "magnet":
+		if !strings.HasPrefix(link.Query().Get("xt"), "urn:") {
+			return fmt.Errorf("%w: missing exact topic", ErrBadMagnet)
 		}
-		if length, ok := info["length"].(int64); ok {
-			magnet += "&xl=" + fmt.Sprint(length)
+	case "http", "https":
+		if link.Host == "" {
+			return fmt.Errorf("%w: missing host", ErrBadMagnet)
 		}
+	default:
+		return fmt.Errorf("%w: unsupported scheme `%s`", ErrBadMagnet, link.Scheme)
 	}
+	return nil
+}
 
-	// Add the tracker to the magnet link, if available.
-	if tracker, ok := torrent["announce"].(string); ok {
-		magnet += "&tr=" + url.QueryEscape(tracker)
+func (p *PutioProxy) UploadTorrent(ctx context.Context, file []byte, downloadDir string, metadata TransferMetadata) (Transfer, error) {
+	// We could upload the torrent directly to Put.io and it would work just fine, but we want to be able to add a
+	// callback URL to the transfer so we can identify it later. The Transfer API lets us add a callback URL, but it
+	// requires a magnet link instead of a torrent. Torrents from private trackers can be configured to be uploaded
+	// anyway, see uploadsTorrentFile.
+	metainfo, err := torrent.Parse(file)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("%w: %w", ErrInvalidTorrent, err)
 	}
+	metadata.InfoHash = metainfo.InfoHash()
 
 	// Add the transfer to Put.io using the Transfer API.
-	return p.AddTransfer(ctx, magnet, downloadDir)
+	metadata.Torrent = file
+	return p.AddTransfer(ctx, metainfo.Magnet(), downloadDir, metadata)
+}
+
+// AddTorrentURL fetches the torrent file at the HTTP(S) URL with the given cookies, and uploads it. Put.io can fetch
+// URLs too, but it can't always reach private trackers, nor send the cookies they require.
+func (p *PutioProxy) AddTorrentURL(ctx context.Context, link, cookies, downloadDir string, metadata TransferMetadata) (Transfer, error) {
+	file, magnet, err := fetchTorrent(ctx, link, cookies)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if magnet != "" {
+		return p.AddTransfer(ctx, magnet, downloadDir, metadata)
+	}
+	return p.UploadTorrent(ctx, file, downloadDir, metadata)
+}
+
+// Returns the transfer with the given info hash among the ones added by Putarr, if any.
+func (p *PutioProxy) findTransferByInfoHash(ctx context.Context, hash string) (Transfer, bool, error) {
+	transfers, err := p.GetTransfers(ctx)
+	if err != nil {
+		return Transfer{}, false, fmt.Errorf("failed to list Put.io transfers: %w", err)
+	}
+	for _, transfer := range transfers {
+		if transferInfoHash(transfer) == hash {
+			return transfer, true, nil
+		}
+	}
+	return Transfer{}, false, nil
 }
 
 func (p *PutioProxy) GetTransfers(ctx context.Context) ([]Transfer, error) {
 	var result []Transfer
+	listedAt := time.Now()
 	transfers, err := p.putioClient.Transfers.List(ctx)
 	if err != nil {
-		return result, err
+		return result, classifyPutioError(err)
 	}
+	exists := map[int64]bool{}
 	for _, transfer := range transfers {
-		extra, err := p.parseCallbackURL(transfer.CallbackURL)
+		extra, err := p.transferState(transfer)
 		if err != nil {
 			log.Println("cannot parse callback URL, skipping transfer:", err)
 			continue
 		}
+		exists[transfer.ID] = true
 
 		downloadDir := extra.DownloadDir
 		result = append(result, Transfer{
 			Transfer:    &transfer,
 			DownloadDir: downloadDir,
+			InfoHash:    extra.InfoHash,
 		})
+		if extra.InfoHash != "" {
+			p.infoHashes.add(transfer.ID, extra.InfoHash)
+		}
+
+		if p.store != nil {
+			if metadata, ok := p.store.Get(transfer.ID); ok {
+				result[len(result)-1].Metadata = &metadata
+				// The callback URL can't be changed, so the download directory of moved transfers is only in the store.
+				if metadata.DownloadDir != "" {
+					result[len(result)-1].DownloadDir = metadata.DownloadDir
+				}
+				// Put.io sometimes drops the name of transfers, e.g., while it's fetching the metadata of a magnet.
+				if transfer.Name == "" {
+					result[len(result)-1].Name = metadata.Name
+				}
+			}
+		}
+	}
+
+	if p.store != nil {
+		held := p.store.Held()
+		for _, id := range slices.Sorted(maps.Keys(held)) {
+			transfer := heldTransfer(id, held[id])
+			if transfer.InfoHash != "" {
+				p.infoHashes.add(id, transfer.InfoHash)
+			}
+			result = append(result, transfer)
+		}
+	}
+
+	// Forget about the transfers that are gone from Put.io. Leave some slack for transfers added while listing.
+	if p.store != nil {
+		if err := p.store.Prune(exists, listedAt.Add(-time.Minute)); err != nil {
+			log.Println("failed to prune transfer metadata:", err)
+		}
 	}
 	return result, nil
 }
 
+// ParseTorrentHash returns the ID of the transfer with the given hash, which is either a Putarr ID or the info hash of
+// a transfer. Info hashes that weren't seen since Putarr started, e.g., when a client asks about a torrent it added
+// before a restart, are looked up by listing the transfers, whose hashes are in their callback URL or the store.
+func (p *PutioProxy) ParseTorrentHash(ctx context.Context, key string) (int64, error) {
+	// Clients (e.g., Sonarr/Radarr) sometimes make the hash uppercase.
+	key = strings.ToLower(key)
+	if !isInfoHash(key) {
+		id, err := parsePutarrID(key)
+		if err != nil {
+			return 0, err
+		}
+		return p.resolveID(id), nil
+	}
+
+	if id, ok := p.infoHashes.id(key); ok {
+		return id, nil
+	}
+	if _, err := p.GetTransfers(ctx); err != nil {
+		return 0, fmt.Errorf("failed to look up info hash %s: %w", key, err)
+	}
+	if id, ok := p.infoHashes.id(key); ok {
+		return id, nil
+	}
+	return 0, errors.New("unknown info hash: " + key)
+}
+
+// Returns the ID of the Put.io transfer the held transfer was started as, so clients can keep using the held ID they got
+// when they added it. Other IDs are returned as is.
+func (p *PutioProxy) resolveID(id int64) int64 {
+	if !isHeldTransferID(id) || p.store == nil {
+		return id
+	}
+	if metadata, ok := p.store.Get(id); ok && metadata.StartedID != 0 {
+		return metadata.StartedID
+	}
+	return id
+}
+
 func (p *PutioProxy) RemoveTransfers(ctx context.Context, removeFiles bool, ids ...int64) error {
 	for _, id := range ids {
+		// Held transfers aren't on Put.io, so there's nothing to cancel.
+		if isHeldTransferID(id) && p.store != nil {
+			if err := p.store.Delete(id); err != nil {
+				return fmt.Errorf("failed to delete held transfer with ID `%d`: %w", id, err)
+			}
+			p.infoHashes.remove(id)
+			continue
+		}
 		transfer, err := p.putioClient.Transfers.Get(ctx, id)
 		if err != nil {
-			return fmt.Errorf("failed to get transfer with ID `%d`: %w", id, err)
+			return fmt.Errorf("failed to get transfer with ID `%d`: %w", id, classifyPutioError(err))
 		}
-		_, err = p.parseCallbackURL(transfer.CallbackURL)
+		_, err = p.transferState(transfer)
 		if err != nil {
 			log.Println("cannot parse callback URL, skipping transfer:", err)
 			continue
@@ -138,25 +397,317 @@ func (p *PutioProxy) RemoveTransfers(ctx context.Context, removeFiles bool, ids
 		if removeFiles && transfer.FileID != 0 {
 			err = p.putioClient.Files.Delete(ctx, transfer.FileID)
 			if err != nil {
-				return fmt.Errorf("failed to delete file with ID `%d`: %w", transfer.FileID, err)
+				return fmt.Errorf("failed to delete file with ID `%d`: %w", transfer.FileID, classifyPutioError(err))
 			}
 		}
 		err = p.putioClient.Transfers.Cancel(ctx, transfer.ID)
 		if err != nil {
-			return fmt.Errorf("failed to cancel transfer with ID `%d`: %w", transfer.ID, err)
+			return fmt.Errorf("failed to cancel transfer with ID `%d`: %w", transfer.ID, classifyPutioError(err))
+		}
+		if p.store != nil {
+			if err := p.store.Delete(transfer.ID); err != nil {
+				log.Println("failed to delete transfer metadata:", err)
+			}
+		}
+		p.infoHashes.remove(transfer.ID)
+	}
+	return nil
+}
+
+// Returns the transfer with the given ID, or an error if it wasn't added by Putarr.
+func (p *PutioProxy) getOwnTransfer(ctx context.Context, id int64) (putio.Transfer, error) {
+	transfer, err := p.putioClient.Transfers.Get(ctx, id)
+	if err != nil {
+		return transfer, fmt.Errorf("failed to get transfer with ID `%d`: %w", id, classifyPutioError(err))
+	}
+	if _, err := p.transferState(transfer); err != nil {
+		return transfer, fmt.Errorf("transfer with ID `%d` wasn't added by Putarr: %w", id, err)
+	}
+	return transfer, nil
+}
+
+// StopTransfers marks the transfers as stopped. Put.io transfers can't be paused, so they carry on there, but they're
+// reported as stopped and aren't downloaded locally until they're started again. Held transfers are already stopped.
+func (p *PutioProxy) StopTransfers(ctx context.Context, ids ...int64) error {
+	if p.store == nil {
+		return errors.New("stopping torrents requires the transfer metadata store")
+	}
+	for _, id := range ids {
+		if isHeldTransferID(id) {
+			continue
+		}
+		if _, err := p.getOwnTransfer(ctx, id); err != nil {
+			return err
+		}
+		if err := p.store.Update(id, func(metadata *TransferMetadata) {
+			metadata.Stopped = true
+		}); err != nil {
+			return fmt.Errorf("failed to stop transfer with ID `%d`: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// StartTransfers adds the held transfers to Put.io, restarts the stopped ones, and retries the transfers that failed
+// on Put.io. The other transfers are left alone since Put.io transfers can't be paused and resumed.
+func (p *PutioProxy) StartTransfers(ctx context.Context, ids ...int64) error {
+	for _, id := range ids {
+		if isHeldTransferID(id) {
+			if err := p.startHeldTransfer(ctx, id); err != nil {
+				return err
+			}
+			continue
+		}
+		transfer, err := p.getOwnTransfer(ctx, id)
+		if err != nil {
+			return err
+		}
+		if p.store != nil {
+			if err := p.store.Update(id, func(metadata *TransferMetadata) {
+				metadata.Stopped = false
+			}); err != nil {
+				return fmt.Errorf("failed to start transfer with ID `%d`: %w", id, err)
+			}
+		}
+		if !strings.EqualFold(transfer.Status, "ERROR") {
+			continue
+		}
+		if _, err := p.putioClient.Transfers.Retry(ctx, id); err != nil {
+			return fmt.Errorf("failed to retry transfer with ID `%d`: %w", id, classifyPutioError(err))
+		}
+	}
+	return nil
+}
+
+// Adds the held transfer to Put.io. The held transfer is kept as an alias of the Put.io transfer, so its ID keeps
+// resolving until the Put.io transfer is gone.
+func (p *PutioProxy) startHeldTransfer(ctx context.Context, id int64) error {
+	if p.store == nil {
+		return fmt.Errorf("no held transfer with ID `%d`", id)
+	}
+	metadata, ok := p.store.Get(id)
+	if !ok || metadata.StartedID != 0 {
+		return fmt.Errorf("no held transfer with ID `%d`", id)
+	}
+	metadata.HeldID = id
+	transfer, err := p.startTransfer(ctx, metadata)
+	if err != nil {
+		return fmt.Errorf("failed to start held transfer with ID `%d`: %w", id, err)
+	}
+	if err := p.store.Update(id, func(metadata *TransferMetadata) {
+		metadata.StartedID = transfer.ID
+		metadata.Torrent = nil
+	}); err != nil {
+		log.Println("failed to record the started held transfer:", err)
+	}
+	return nil
+}
+
+// MoveTransfers records the new download directory of the transfers in the store. If move is set, the files of the
+// transfers are moved to the download directory on Put.io as well; otherwise they're left where they are.
+func (p *PutioProxy) MoveTransfers(ctx context.Context, downloadDir string, move bool, ids ...int64) error {
+	if p.store == nil {
+		return errors.New("moving transfers requires the transfer metadata store")
+	}
+	var parentID int64
+	if move {
+		var err error
+		if parentID, err = p.createAndReturnDirID(ctx, downloadDir); err != nil {
+			return fmt.Errorf("failed to create download directory: %w", err)
+		}
+	}
+	for _, id := range ids {
+		transfer, err := p.getOwnTransfer(ctx, id)
+		if err != nil {
+			return err
+		}
+		if move {
+			if transfer.FileID == 0 {
+				return fmt.Errorf("transfer with ID `%d` has no files to move yet", id)
+			}
+			if err := p.putioClient.Files.Move(ctx, parentID, transfer.FileID); err != nil {
+				return fmt.Errorf("failed to move file with ID `%d`: %w", transfer.FileID, classifyPutioError(err))
+			}
+		}
+		err = p.store.Update(id, func(metadata *TransferMetadata) {
+			metadata.DownloadDir = downloadDir
+			metadata.Category = categoryFromDir(downloadDir, configFor(ctx, p.config).Transmission.DownloadDir)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save transfer metadata: %w", err)
+		}
+	}
+	return nil
+}
+
+// RenameTransferPath renames the file or folder of the transfer at the given path, relative to the download directory,
+// e.g., the name of the transfer or one of its files.
+func (p *PutioProxy) RenameTransferPath(ctx context.Context, id int64, path, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid name: `%s`", name)
+	}
+	transfer, err := p.getOwnTransfer(ctx, id)
+	if err != nil {
+		return err
+	}
+	if transfer.FileID == 0 {
+		return fmt.Errorf("transfer with ID `%d` has no files to rename yet", id)
+	}
+	root, err := p.putioClient.Files.Get(ctx, transfer.FileID)
+	if err != nil {
+		return fmt.Errorf("failed to get file with ID `%d`: %w", transfer.FileID, classifyPutioError(err))
+	}
+	files, err := listPutioFiles(ctx, p.putioClient, root, root.Name)
+	if err != nil {
+		return err
+	}
+
+	// Folders aren't listed, so the root of the transfer is matched separately.
+	fileID := int64(0)
+	if path == root.Name {
+		fileID = root.ID
+	}
+	for _, file := range files {
+		if filepath.ToSlash(file.Path) == path {
+			fileID = file.ID
+		}
+	}
+	if fileID == 0 {
+		return fmt.Errorf("transfer with ID `%d` has no file at path `%s`", id, path)
+	}
+
+	if err := p.putioClient.Files.Rename(ctx, fileID, name); err != nil {
+		return fmt.Errorf("failed to rename file with ID `%d`: %w", fileID, classifyPutioError(err))
+	}
+	if fileID == root.ID && p.store != nil {
+		err := p.store.Update(id, func(metadata *TransferMetadata) {
+			metadata.Name = name
+		})
+		if err != nil {
+			log.Println("failed to save transfer metadata:", err)
 		}
 	}
 	return nil
 }
 
+// SetLabels replaces the labels of the transfer in the store.
+func (p *PutioProxy) SetLabels(id int64, labels []string) error {
+	if p.store == nil {
+		return errors.New("labels require the transfer metadata store")
+	}
+	return p.store.Update(id, func(metadata *TransferMetadata) {
+		metadata.Labels = labels
+	})
+}
+
+// SetBandwidthPriority records the bandwidth priority of the transfer in the store. Put.io doesn't prioritize
+// transfers, so the priority is only reported back to clients.
+func (p *PutioProxy) SetBandwidthPriority(id int64, priority int) error {
+	if p.store == nil {
+		return errors.New("bandwidth priorities require the transfer metadata store")
+	}
+	return p.store.Update(id, func(metadata *TransferMetadata) {
+		metadata.Priority = priority
+	})
+}
+
+// GetDiskSpace returns the available and total disk space of the Put.io account, in bytes.
+func (p *PutioProxy) GetDiskSpace(ctx context.Context) (int64, int64, error) {
+	info, err := p.putioClient.Account.Info(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get Put.io account info: %w", classifyPutioError(err))
+	}
+	return info.Disk.Avail, info.Disk.Size, nil
+}
+
+// Records the outcome of the local download of the transfer in the store, if there's one.
+func (p *PutioProxy) setLocalState(id int64, state LocalState) {
+	if p.store == nil {
+		return
+	}
+	err := p.store.Update(id, func(metadata *TransferMetadata) {
+		metadata.Local = &state
+	})
+	if err != nil {
+		log.Println("failed to save local download state:", err)
+	}
+}
+
+// GetFiles returns all the files under the given Put.io file or folder, with their paths relative to its parent.
+func (p *PutioProxy) GetFiles(ctx context.Context, fileID int64) ([]remoteFile, error) {
+	root, err := p.putioClient.Files.Get(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file with ID `%d`: %w", fileID, classifyPutioError(err))
+	}
+	return listPutioFiles(ctx, p.putioClient, root, root.Name)
+}
+
+// Walks the Put.io folder tree and returns all the files in it. The root can also be a single file.
+func listPutioFiles(ctx context.Context, putioClient *putio.Client, root putio.File, path string) ([]remoteFile, error) {
+	// The paths end up on local disk, so a name like ".." mustn't take them out of the download directory.
+	if !isValidFileName(root.Name) {
+		return nil, fmt.Errorf("invalid file name on Put.io: `%s`", root.Name)
+	}
+	if !root.IsDir() {
+		return []remoteFile{{ID: root.ID, Path: path, Size: root.Size, CRC32: root.CRC32}}, nil
+	}
+
+	children, _, err := putioClient.Files.List(ctx, root.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files on Put.io: %w", classifyPutioError(err))
+	}
+
+	var files []remoteFile
+	for _, child := range children {
+		childFiles, err := listPutioFiles(ctx, putioClient, child, filepath.Join(path, child.Name))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, childFiles...)
+	}
+	return files, nil
+}
+
+// Returns whether the name is a single path element, which stays in the directory it's joined to.
+func isValidFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsRune(name, '/') &&
+		!strings.ContainsRune(name, filepath.Separator)
+}
+
+// GetCategories returns the names of the sub-directories of the download directory on Put.io. These double as
+// categories for the clients that support them.
+func (p *PutioProxy) GetCategories(ctx context.Context) ([]string, error) {
+	children, _, err := p.putioClient.Files.List(ctx, configFor(ctx, p.config).Putio.ParentDirID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files on Put.io: %w", classifyPutioError(err))
+	}
+	categories := []string{}
+	for _, child := range children {
+		if child.IsDir() {
+			categories = append(categories, child.Name)
+		}
+	}
+	return categories, nil
+}
+
+// CreateCategory creates the sub-directory of the download directory on Put.io for the given category.
+func (p *PutioProxy) CreateCategory(ctx context.Context, category string) error {
+	if !isValidFileName(category) {
+		return fmt.Errorf("invalid category name: `%s`", category)
+	}
+	_, err := p.createAndReturnDirID(ctx, filepath.Join(configFor(ctx, p.config).Transmission.DownloadDir, category))
+	return err
+}
+
 // Treat path as relative to the configured download path. Create the missing sub-directories if necessary and returns
 // the ID of the final directory in the full path.
 func (p *PutioProxy) createAndReturnDirID(ctx context.Context, path string) (int64, error) {
-	dir := p.config.Putio.ParentDirID
+	config := configFor(ctx, p.config)
+	dir := config.Putio.ParentDirID
 
-	subpath := strings.TrimPrefix(path, p.config.Transmission.DownloadDir)
-	if subpath == path {
-		return dir, fmt.Errorf("download directory must be a subdirectory of `%s`", p.config.Transmission.DownloadDir)
+	subpath, ok := cutDownloadDir(path, config.Transmission.DownloadDir)
+	if !ok {
+		return dir, fmt.Errorf("%w `%s`: must be a subdirectory of `%s`", ErrInvalidDir, path, config.Transmission.DownloadDir)
 	}
 
 	// If there's no subpath beyond the default download directory, we're done.
@@ -164,18 +715,13 @@ func (p *PutioProxy) createAndReturnDirID(ctx context.Context, path string) (int
 		return dir, nil
 	}
 
-	// Trim off the leading slash if present to avoid an empty string when splitting later.
-	if strings.HasPrefix(subpath, string(filepath.Separator)) {
-		subpath = subpath[len(string(filepath.Separator)):]
-	}
-
 	// Split the subpath into individual directories and walk the Put.io tree to create the missing ones.
-	parts := strings.Split(subpath, string(filepath.Separator))
+	parts := strings.Split(subpath, "/")
 
 	for _, part := range parts {
 		children, _, err := p.putioClient.Files.List(ctx, dir)
 		if err != nil {
-			return dir, fmt.Errorf("failed to list files on Put.io: %w", err)
+			return dir, fmt.Errorf("failed to list files on Put.io: %w", classifyPutioError(err))
 		}
 
 		// If this directory already exists, move on to the next sub-directory.
@@ -194,18 +740,33 @@ func (p *PutioProxy) createAndReturnDirID(ctx context.Context, path string) (int
 		// Directory not found; create it before moving on to the next sub-directory.
 		created, err := p.putioClient.Files.CreateFolder(ctx, part, dir)
 		if err != nil {
-			return dir, fmt.Errorf("failed to create folder on Put.io: %w", err)
+			return dir, fmt.Errorf("failed to create folder on Put.io: %w", classifyPutioError(err))
 		}
 		dir = created.ID
 	}
 	return dir, nil
 }
 
+// Status of the held transfers, which Put.io doesn't know about yet.
+const heldTransferStatus = "PAUSED"
+
 // Holds extra state about a Put.io transfer that's required by the Transmission API. Meant to be encoded into the
-// transfer's callback URL. In theory, we could instead store this in the Put.io ConfigService, but using the callback
-// URL is more convenient since it means this extra state will have the same lifetime as the transfer itself.
+// transfer's callback URL. The store can keep the metadata of transfers in the Put.io ConfigService too, but using the
+// callback URL is more convenient since it means this extra state will have the same lifetime as the transfer itself.
 type extraState struct {
 	DownloadDir string `json:"d"`
+	InfoHash    string `json:"h,omitempty"` // Reported as the hash of the transfer instead of its Putarr ID.
+}
+
+// Returns the extra state of a transfer added by Putarr, or an error if it belongs to someone else. Uploaded torrents
+// have no callback URL, so their state comes from the store instead.
+func (p *PutioProxy) transferState(transfer putio.Transfer) (extraState, error) {
+	if transfer.CallbackURL == "" && p.store != nil {
+		if metadata, ok := p.store.Get(transfer.ID); ok && metadata.Uploaded {
+			return extraState{DownloadDir: metadata.DownloadDir, InfoHash: metadata.InfoHash}, nil
+		}
+	}
+	return p.parseCallbackURL(transfer.CallbackURL)
 }
 
 func (p *PutioProxy) formatCallbackURL(extra extraState) (string, error) {
@@ -224,8 +785,9 @@ func (p *PutioProxy) formatCallbackURL(extra extraState) (string, error) {
 		Path:     "/arr",
 		RawQuery: params.Encode(),
 	}
-	if len(p.config.Putio.FriendToken) > 0 {
-		extraURL.Fragment = p.config.Putio.FriendToken
+	// Reloads can't change the friend token, so there's no need for the config snapshot of the request.
+	if friendToken := p.config.Current().Putio.FriendToken; len(friendToken) > 0 {
+		extraURL.Fragment = friendToken
 	}
 	return extraURL.String(), nil
 }
@@ -242,8 +804,8 @@ func (p *PutioProxy) parseCallbackURL(callbackURL string) (extraState, error) {
 		return result, errors.New("unrecognized callback URL: " + callbackURL)
 	}
 
-	if len(p.config.Putio.FriendToken) > 0 {
-		if extraURL.Fragment != p.config.Putio.FriendToken {
+	if friendToken := p.config.Current().Putio.FriendToken; len(friendToken) > 0 {
+		if extraURL.Fragment != friendToken {
 			return result, errors.New("the transfer belongs to a different user, fragment=" + extraURL.Fragment)
 		}
 	}
@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/putdotio/go-putio"
+)
+
+// Keys of the shared state in the Put.io config service. Instances register under putarr.instances.<name>, the
+// metadata of their transfers is kept under putarr.transfers.<name>.<id>, and the last ID they held a transfer under
+// under putarr.held.<name>.
+const (
+	putioInstanceKeyPrefix = "putarr.instances."
+	putioTransferKeyPrefix = "putarr.transfers."
+	putioHeldIDKeyPrefix   = "putarr.held."
+)
+
+const (
+	// How often instances refresh their registration.
+	instanceHeartbeatInterval = time.Minute
+	// How long a registration is considered live without being refreshed, e.g., after an instance crashed.
+	instanceTTL = 3 * instanceHeartbeatInterval
+	// Timeout of the writes to the shared state, which aren't tied to the context of a request.
+	putioStateTimeout = 30 * time.Second
+)
+
+// ErrInstanceConflict is returned when registering an instance that would clobber the transfers of another one.
+var ErrInstanceConflict = errors.New("conflicting Putarr instance")
+
+// InstanceRegistration is what an instance tells the other instances sharing the Put.io account about itself.
+type InstanceRegistration struct {
+	Name        string    `json:"name"`
+	ID          string    `json:"id"` // Random ID of the running process, to tell it apart from another one by the same name.
+	FriendToken string    `json:"friend_token,omitempty"`
+	DownloadDir string    `json:"download_dir"`
+	SeenAt      time.Time `json:"seen_at"`
+}
+
+// PutioState keeps state shared by the Putarr instances using a Put.io account in the config service of the account,
+// under keys namespaced by instance. Unlike the local store, it survives losing the local disk.
+type PutioState struct {
+	putioClient  *putio.Client
+	registration InstanceRegistration
+}
+
+// NewPutioState returns the shared state of the instance named by the store configuration.
+func NewPutioState(config *Config, putioClient *putio.Client) (*PutioState, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate instance ID: %w", err)
+	}
+	return &PutioState{
+		putioClient: putioClient,
+		registration: InstanceRegistration{
+			Name:        config.Store.Instance,
+			ID:          hex.EncodeToString(id),
+			FriendToken: config.Putio.FriendToken,
+			DownloadDir: config.Transmission.DownloadDir,
+		},
+	}, nil
+}
+
+// Register announces the instance to the other instances. It fails with ErrInstanceConflict when a live instance has
+// the same name, or the same friend token since the ownership of their transfers couldn't be told apart.
+func (s *PutioState) Register(ctx context.Context) error {
+	instances, err := s.Instances(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.checkConflicts(instances); err != nil {
+		return err
+	}
+	for _, other := range instances {
+		if time.Since(other.SeenAt) <= instanceTTL && other.ID != s.registration.ID {
+			log.Printf("sharing the Put.io account with instance `%s`", other.Name)
+		}
+	}
+	if err := s.refresh(ctx); err != nil {
+		return err
+	}
+
+	// Another instance could have registered since the instances were listed, so check again once the registration is
+	// written. The last instance to write a name keeps it, and instances with the same friend token both back off.
+	instances, err = s.Instances(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.checkConflicts(instances); err != nil {
+		if err := s.Unregister(ctx); err != nil {
+			log.Println("failed to unregister conflicting instance:", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Returns an ErrInstanceConflict error when another live instance has the same name or friend token.
+func (s *PutioState) checkConflicts(instances []InstanceRegistration) error {
+	for _, other := range instances {
+		if time.Since(other.SeenAt) > instanceTTL || other.ID == s.registration.ID {
+			continue
+		}
+		if other.Name == s.registration.Name {
+			return fmt.Errorf("%w: instance `%s` is already running, or was stopped less than %s ago", ErrInstanceConflict,
+				other.Name, instanceTTL)
+		}
+		if other.FriendToken == s.registration.FriendToken {
+			return fmt.Errorf("%w: instance `%s` uses the same friend token", ErrInstanceConflict, other.Name)
+		}
+	}
+	return nil
+}
+
+// Unregister removes the registration of the instance, so it can be restarted right away. The registration of another
+// instance by the same name, e.g., one that took over while this one was shutting down, is left alone.
+func (s *PutioState) Unregister(ctx context.Context) error {
+	key := putioInstanceKeyPrefix + s.registration.Name
+	var registration InstanceRegistration
+	found, err := s.putioClient.Config.Get(ctx, key, &registration)
+	if err != nil {
+		return fmt.Errorf("failed to unregister instance: %w", classifyPutioError(err))
+	}
+	if !found || registration.ID != s.registration.ID {
+		return nil
+	}
+	if err := s.putioClient.Config.Del(ctx, key); err != nil {
+		return fmt.Errorf("failed to unregister instance: %w", classifyPutioError(err))
+	}
+	return nil
+}
+
+// Refreshes the registration of the instance, so the other instances know it's still running.
+func (s *PutioState) refresh(ctx context.Context) error {
+	s.registration.SeenAt = time.Now()
+	if err := s.putioClient.Config.Set(ctx, putioInstanceKeyPrefix+s.registration.Name, s.registration); err != nil {
+		return fmt.Errorf("failed to register instance: %w", classifyPutioError(err))
+	}
+	return nil
+}
+
+// RunAtInterval refreshes the registration of the instance until the context is done.
+func (s *PutioState) RunAtInterval(ctx context.Context) {
+	ticker := time.NewTicker(instanceHeartbeatInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.refresh(ctx); err != nil {
+					log.Println("failed to refresh instance registration:", err)
+				}
+			}
+		}
+	}()
+}
+
+// Instances returns the registrations of all the instances using the Put.io account, including stale ones, sorted by
+// name.
+func (s *PutioState) Instances(ctx context.Context) ([]InstanceRegistration, error) {
+	values, err := s.getAll(ctx, putioInstanceKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var result []InstanceRegistration
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		var registration InstanceRegistration
+		if err := json.Unmarshal(values[key], &registration); err != nil {
+			log.Printf("cannot decode instance registration `%s`, skipping it: %s", key, err)
+			continue
+		}
+		result = append(result, registration)
+	}
+	return result, nil
+}
+
+// Returns the config values whose key has the given prefix.
+func (s *PutioState) getAll(ctx context.Context, prefix string) (map[string]json.RawMessage, error) {
+	var values map[string]json.RawMessage
+	if err := s.putioClient.Config.GetAll(ctx, &values); err != nil {
+		return nil, fmt.Errorf("failed to get Put.io config: %w", classifyPutioError(err))
+	}
+	maps.DeleteFunc(values, func(key string, _ json.RawMessage) bool {
+		return !strings.HasPrefix(key, prefix)
+	})
+	return values, nil
+}
+
+// OpenPutioStore loads the store of the instance from the shared state. Writes to the store go to Put.io right away.
+func OpenPutioStore(ctx context.Context, state *PutioState) (*Store, error) {
+	backend := putioBackend{
+		state:       state,
+		prefix:      putioTransferKeyPrefix + state.registration.Name + ".",
+		lastHeldKey: putioHeldIDKeyPrefix + state.registration.Name,
+	}
+	store := &Store{
+		backend:   backend,
+		transfers: map[int64]*TransferMetadata{},
+	}
+
+	values, err := state.getAll(ctx, backend.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	for key, value := range values {
+		id, err := strconv.ParseInt(strings.TrimPrefix(key, backend.prefix), 10, 64)
+		if err != nil {
+			log.Printf("cannot parse transfer ID of `%s`, skipping it: %s", key, err)
+			continue
+		}
+		var metadata TransferMetadata
+		if err := json.Unmarshal(value, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata of transfer with ID `%d`: %w", id, err)
+		}
+		store.transfers[id] = &metadata
+	}
+
+	var lastHeldID int64
+	if _, err := state.putioClient.Config.Get(ctx, backend.lastHeldKey, &lastHeldID); err != nil {
+		return nil, fmt.Errorf("failed to read last held ID: %w", classifyPutioError(err))
+	}
+	store.setLastHeldID(lastHeldID)
+	return store, nil
+}
+
+// putioBackend persists the metadata of each transfer under its own key of the Put.io config service. Torrent files are
+// left out, since the config service is meant for small values; held transfers added with one are started with their
+// magnet link instead when the local disk is lost.
+type putioBackend struct {
+	state       *PutioState
+	prefix      string
+	lastHeldKey string
+}
+
+func (b putioBackend) prepare(transfers map[int64]*TransferMetadata, lastHeldID int64, changed ...int64) (func() error, error) {
+	// Encode the metadata now, since the store can change it as soon as it's unlocked. Deleted transfers have no value.
+	values := map[int64]json.RawMessage{}
+	for _, id := range changed {
+		metadata, ok := transfers[id]
+		if !ok {
+			values[id] = nil
+			continue
+		}
+		withoutTorrent := *metadata
+		withoutTorrent.Torrent = nil
+		value, err := json.Marshal(withoutTorrent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode metadata of transfer with ID `%d`: %w", id, err)
+		}
+		values[id] = value
+	}
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), putioStateTimeout)
+		defer cancel()
+
+		config := b.state.putioClient.Config
+		for _, id := range changed {
+			// Save the last held ID before the transfer held under it, so the ID is never handed out again.
+			if isHeldTransferID(id) && id == lastHeldID {
+				if err := config.Set(ctx, b.lastHeldKey, lastHeldID); err != nil {
+					return fmt.Errorf("failed to write last held ID: %w", classifyPutioError(err))
+				}
+			}
+			key := b.prefix + strconv.FormatInt(id, 10)
+			var err error
+			if value := values[id]; value != nil {
+				err = config.Set(ctx, key, value)
+			} else {
+				err = config.Del(ctx, key)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write metadata of transfer with ID `%d`: %w", id, classifyPutioError(err))
+			}
+		}
+		return nil
+	}, nil
+}
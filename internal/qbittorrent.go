@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"path"
+	"strings"
+)
+
+// QbitTorrent is a torrent as described by the qBittorrent WebUI API v2.
+type QbitTorrent struct {
+	Hash         string  `json:"hash"`
+	Name         string  `json:"name"`
+	Size         int64   `json:"size"`
+	TotalSize    int64   `json:"total_size"`
+	Progress     float64 `json:"progress"`
+	Downloaded   int64   `json:"downloaded"`
+	AmountLeft   int64   `json:"amount_left"`
+	DlSpeed      int64   `json:"dlspeed"`
+	UpSpeed      int64   `json:"upspeed"`
+	ETA          int64   `json:"eta"`
+	State        string  `json:"state"`
+	Category     string  `json:"category"`
+	Tags         string  `json:"tags"`
+	SavePath     string  `json:"save_path"`
+	ContentPath  string  `json:"content_path"`
+	Ratio        float64 `json:"ratio"`
+	RatioLimit   float64 `json:"ratio_limit"`
+	SeedingTime  int64   `json:"seeding_time"`
+	AddedOn      int64   `json:"added_on"`
+	CompletionOn int64   `json:"completion_on"`
+}
+
+// QbitCategory is a category as described by the qBittorrent WebUI API v2.
+type QbitCategory struct {
+	Name     string `json:"name"`
+	SavePath string `json:"savePath"`
+}
+
+// QbitPreferences holds the subset of the qBittorrent application preferences that clients rely on.
+type QbitPreferences struct {
+	SavePath              string  `json:"save_path"`
+	MaxRatioEnabled       bool    `json:"max_ratio_enabled"`
+	MaxRatio              float64 `json:"max_ratio"`
+	MaxSeedingTimeEnabled bool    `json:"max_seeding_time_enabled"`
+	MaxSeedingTime        int64   `json:"max_seeding_time"`
+	QueueingEnabled       bool    `json:"queueing_enabled"`
+	DHT                   bool    `json:"dht"`
+}
+
+const (
+	QbitAPIVersion = "2.9.3"
+	QbitVersion    = "v4.6.0"
+
+	// ETA reported by qBittorrent when it's unknown.
+	qbitInfiniteETA = 8640000
+)
+
+func convertToQbitTorrent(transfer Transfer, downloadDir string) QbitTorrent {
+	torrent := convertFromPutioTransfer(transfer)
+
+	progress := 0.0
+	if torrent.TotalSize > 0 {
+		progress = float64(torrent.TotalSize-torrent.LeftUntilDone) / float64(torrent.TotalSize)
+	} else if torrent.IsFinished {
+		progress = 1.0
+	}
+
+	eta := torrent.ETA
+	if eta <= 0 && !torrent.IsFinished {
+		eta = qbitInfiniteETA
+	}
+
+	result := QbitTorrent{
+		Hash:        *torrent.HashString,
+		Name:        torrent.Name,
+		Size:        torrent.TotalSize,
+		TotalSize:   torrent.TotalSize,
+		Progress:    progress,
+		Downloaded:  torrent.DownloadedEver,
+		AmountLeft:  torrent.LeftUntilDone,
+		DlSpeed:     int64(transfer.DownloadSpeed),
+		UpSpeed:     int64(transfer.UploadSpeed),
+		ETA:         eta,
+		State:       convertToQbitState(torrent),
+		Category:    categoryFromDir(transfer.DownloadDir, downloadDir),
+		Tags:        strings.Join(torrent.Labels, ","),
+		SavePath:    transfer.DownloadDir,
+		ContentPath: path.Join(transfer.DownloadDir, torrent.Name),
+		RatioLimit:  -2, // Use the global limit.
+		SeedingTime: int64(transfer.SecondsSeeding),
+	}
+	if transfer.CreatedAt != nil {
+		result.AddedOn = transfer.CreatedAt.Unix()
+	}
+	if transfer.FinishedAt != nil && torrent.IsFinished {
+		result.CompletionOn = transfer.FinishedAt.Unix()
+	}
+	return result
+}
+
+func convertToQbitState(torrent Torrent) string {
+	if torrent.ErrorString != nil && *torrent.ErrorString != "" {
+		return "error"
+	}
+	switch torrent.Status {
+	case TorrentStatusStopped:
+		if torrent.IsFinished {
+			return "pausedUP"
+		}
+		return "pausedDL"
+	case TorrentStatusCheckPending:
+		return "metaDL"
+	case TorrentStatusChecking:
+		if torrent.IsFinished {
+			return "checkingUP"
+		}
+		return "checkingDL"
+	case TorrentStatusDownloadPending:
+		return "queuedDL"
+	case TorrentStatusDownloading:
+		return "downloading"
+	case TorrentStatusSeedPending:
+		return "queuedUP"
+	case TorrentStatusSeeding:
+		return "uploading"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,394 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a qBittorrent session stays valid when it's not used, like qBittorrent's default.
+	qbitSessionTimeout = time.Hour
+
+	// Maximum size of the torrent files uploaded in a single request.
+	qbitMaxUploadSize = 32 << 20
+)
+
+// qbitSessions tracks the session IDs handed out by the qBittorrent login endpoint, along with their user and expiry.
+type qbitSessions struct {
+	mu       sync.Mutex
+	sessions map[string]qbitSession
+}
+
+type qbitSession struct {
+	user   string
+	expiry time.Time
+}
+
+func newQbitSessions() *qbitSessions {
+	return &qbitSessions{sessions: map[string]qbitSession{}}
+}
+
+func (s *qbitSessions) create(user string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = qbitSession{user: user, expiry: time.Now().Add(qbitSessionTimeout)}
+	return id, nil
+}
+
+// Returns the user of the session and whether the session is valid, and extends its expiry if it is.
+func (s *qbitSessions) validate(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(session.expiry) {
+		delete(s.sessions, id)
+		return "", false
+	}
+	session.expiry = time.Now().Add(qbitSessionTimeout)
+	s.sessions[id] = session
+	return session.user, true
+}
+
+func (s *qbitSessions) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// Returns the handler for the qBittorrent WebUI API v2, backed by the same Put.io proxy as the Transmission RPC.
+// Clients login with the Transmission credentials and then use the session cookie for subsequent requests.
+func newQbitHandler(config ConfigSource, auth *authenticator, limits *limiters, putioProxy *PutioProxy, downloader *Downloader) http.Handler {
+	sessions := newQbitSessions()
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/v2/auth/login", handleQbitLogin(config, auth, limits.logins, sessions))
+
+	api := http.NewServeMux()
+	api.Handle("POST /api/v2/auth/logout", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("SID"); err == nil {
+			sessions.remove(cookie.Value)
+		}
+	}))
+	api.Handle("/api/v2/app/version", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, QbitVersion)
+	}))
+	api.Handle("/api/v2/app/webapiVersion", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, QbitAPIVersion)
+	}))
+	api.Handle("/api/v2/app/preferences", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, QbitPreferences{SavePath: configFor(r.Context(), config).Transmission.DownloadDir})
+	}))
+	// The users restricted to some RPC methods are restricted to the matching endpoints.
+	api.Handle("POST /api/v2/torrents/add", qbitMethodMiddleware("torrent-add",
+		handleQbitAddTorrents(config, limits.adds, putioProxy)))
+	api.Handle("/api/v2/torrents/info", qbitMethodMiddleware("torrent-get",
+		handleQbitGetTorrents(config, putioProxy, downloader)))
+	api.Handle("POST /api/v2/torrents/delete", qbitMethodMiddleware("torrent-remove",
+		handleQbitDeleteTorrents(putioProxy, downloader)))
+	api.Handle("/api/v2/torrents/categories", qbitMethodMiddleware("torrent-get",
+		handleQbitGetCategories(config, putioProxy)))
+	api.Handle("POST /api/v2/torrents/createCategory", qbitMethodMiddleware("torrent-add",
+		handleQbitCreateCategory(config, putioProxy)))
+
+	mux.Handle("/api/v2/", qbitSessionMiddleware(config, sessions, api))
+	return mux
+}
+
+func handleQbitLogin(config ConfigSource, auth *authenticator, logins *loginLimiter, sessions *qbitSessions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := configFor(r.Context(), config)
+		client := clientIP(r, current.Server)
+		if wait := logins.wait(client, current.Server, time.Now()); wait > 0 {
+			// Like qBittorrent, clients that failed to log in too many times are banned for a while.
+			setRetryAfter(w, wait)
+			http.Error(w, "Your IP address has been banned after too many failed authentication attempts.",
+				http.StatusForbidden)
+			return
+		}
+
+		// Like qBittorrent, failed logins are reported in the response body rather than the status code.
+		user, ok := auth.authenticate(current.Transmission, r.FormValue("username"), r.FormValue("password"))
+		if !ok {
+			log.Printf("failed login for user `%s` from %s", r.FormValue("username"), client)
+			logins.fail(client, current.Server, time.Now())
+			io.WriteString(w, "Fails.")
+			return
+		}
+		logins.succeed(client)
+
+		id, err := sessions.create(user.Name)
+		if err != nil {
+			log.Println("failed to create session:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     "SID",
+			Value:    id,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		io.WriteString(w, "Ok.")
+	})
+}
+
+func handleQbitAddTorrents(config ConfigSource, adds *addLimiter, putioProxy *PutioProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := configFor(r.Context(), config)
+		downloadDir := current.Transmission.DownloadDir
+		// Clients send either a multipart form when uploading torrent files, or a URL encoded form.
+		err := r.ParseMultipartForm(qbitMaxUploadSize)
+		if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			log.Println("failed to parse form:", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		dir := dirFromCategory(r.FormValue("category"), downloadDir)
+		if savePath := r.FormValue("savepath"); savePath != "" {
+			dir = savePath
+		}
+		user := userFor(r.Context())
+		if !user.allowsDir(dir) {
+			log.Printf("user `%s` isn't allowed to add torrents to %s", user.Name, dir)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		metadata := TransferMetadata{Client: "qbittorrent", User: user.Name, Category: r.FormValue("category")}
+		for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				metadata.Labels = append(metadata.Labels, tag)
+			}
+		}
+
+		// Each torrent takes a token, so a request can't add more torrents than the user is allowed to.
+		added, limited := 0, false
+		allow := func() bool {
+			if !adds.allow(user.Name, current.Server, time.Now()) {
+				log.Printf("user `%s` is adding torrents too fast", user.Name)
+				limited = true
+				return false
+			}
+			return true
+		}
+		for _, link := range strings.Split(r.FormValue("urls"), "\n") {
+			link = strings.TrimSpace(link)
+			if link == "" || !allow() {
+				continue
+			}
+			if _, err := addLink(r.Context(), putioProxy, link, r.FormValue("cookie"), dir, metadata); err != nil {
+				log.Println("failed to add transfer to Put.io:", err)
+				continue
+			}
+			added++
+		}
+
+		if r.MultipartForm != nil {
+			for _, header := range r.MultipartForm.File["torrents"] {
+				file, err := header.Open()
+				if err != nil {
+					log.Println("failed to open uploaded torrent:", err)
+					continue
+				}
+				torrent, err := io.ReadAll(file)
+				file.Close()
+				if err != nil {
+					log.Println("failed to read uploaded torrent:", err)
+					continue
+				}
+				if !allow() {
+					continue
+				}
+				if _, err := putioProxy.UploadTorrent(r.Context(), torrent, dir, metadata); err != nil {
+					log.Println("failed to upload torrent to Put.io:", err)
+					continue
+				}
+				added++
+			}
+		}
+
+		if added == 0 && limited {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if added == 0 {
+			io.WriteString(w, "Fails.")
+			return
+		}
+		io.WriteString(w, "Ok.")
+	})
+}
+
+func handleQbitGetTorrents(config ConfigSource, putioProxy *PutioProxy, downloader *Downloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloadDir := configFor(r.Context(), config).Transmission.DownloadDir
+		if err := r.ParseForm(); err != nil {
+			log.Println("failed to parse form:", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		transfers, err := getTransfers(r.Context(), putioProxy, downloader)
+		if err != nil {
+			log.Println("failed to list Put.io transfers:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		var hashes []string
+		if r.Form.Has("hashes") {
+			hashes = strings.Split(strings.ToLower(r.Form.Get("hashes")), "|")
+		}
+
+		torrents := []QbitTorrent{}
+		for _, transfer := range transfers {
+			torrent := convertToQbitTorrent(transfer, downloadDir)
+			// An empty category selects the torrents without a category, so check whether it's set at all.
+			if r.Form.Has("category") && torrent.Category != r.Form.Get("category") {
+				continue
+			}
+			if hashes != nil && !slices.Contains(hashes, strings.ToLower(torrent.Hash)) {
+				continue
+			}
+			torrents = append(torrents, torrent)
+		}
+		writeJSON(w, torrents)
+	})
+}
+
+func handleQbitDeleteTorrents(putioProxy *PutioProxy, downloader *Downloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleteFiles := r.FormValue("deleteFiles") == "true"
+
+		var transferIDs []int64
+		if hashes := r.FormValue("hashes"); hashes == "all" {
+			transfers, err := getTransfers(r.Context(), putioProxy, nil)
+			if err != nil {
+				log.Println("failed to list Put.io transfers:", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			for _, transfer := range transfers {
+				transferIDs = append(transferIDs, transfer.ID)
+			}
+		} else {
+			for _, hash := range strings.Split(hashes, "|") {
+				transferID, err := putioProxy.ParseTorrentHash(r.Context(), hash)
+				if err != nil {
+					log.Println("failed to parse torrent hash:", err)
+					http.Error(w, "Bad request", http.StatusBadRequest)
+					return
+				}
+				transferIDs = append(transferIDs, transferID)
+			}
+		}
+
+		if err := removeTransfers(r.Context(), putioProxy, downloader, deleteFiles, transferIDs...); err != nil {
+			log.Println("failed to remove transfers:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func handleQbitGetCategories(config ConfigSource, putioProxy *PutioProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloadDir := configFor(r.Context(), config).Transmission.DownloadDir
+		categories, err := putioProxy.GetCategories(r.Context())
+		if err != nil {
+			log.Println("failed to list categories:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		result := map[string]QbitCategory{}
+		for _, category := range categories {
+			result[category] = QbitCategory{
+				Name:     category,
+				SavePath: dirFromCategory(category, downloadDir),
+			}
+		}
+		writeJSON(w, result)
+	})
+}
+
+func handleQbitCreateCategory(config ConfigSource, putioProxy *PutioProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		category := r.FormValue("category")
+		if category == "" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		downloadDir := configFor(r.Context(), config).Transmission.DownloadDir
+		if user := userFor(r.Context()); !user.allowsDir(dirFromCategory(category, downloadDir)) {
+			log.Printf("user `%s` isn't allowed to create category `%s`", user.Name, category)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err := putioProxy.CreateCategory(r.Context(), category); err != nil {
+			log.Println("failed to create category:", err)
+			http.Error(w, "Conflict", http.StatusConflict)
+			return
+		}
+	})
+}
+
+// QbitSessionMiddleware fails requests that don't have a valid session cookie, like qBittorrent does, and records the
+// user of the session in the context of the others. Sessions of users removed from the config are no longer valid.
+func qbitSessionMiddleware(config ConfigSource, sessions *qbitSessions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("SID")
+		if err != nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		name, ok := sessions.validate(cookie.Value)
+		users := configFor(r.Context(), config).Transmission.users()
+		i := slices.IndexFunc(users, func(user UserConfig) bool { return user.Name == name })
+		if !ok || i < 0 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withUser(r.Context(), users[i])))
+	})
+}
+
+// QbitMethodMiddleware fails requests from users that aren't allowed to call the equivalent Transmission RPC method.
+func qbitMethodMiddleware(method string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := userFor(r.Context()); !user.allowsMethod(method) {
+			log.Printf("user `%s` isn't allowed to call %s", user.Name, method)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("failed to encode response:", err)
+	}
+}
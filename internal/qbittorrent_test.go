@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/albertb/putarr/internal/fakes"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jackpal/bencode-go"
+)
+
+func TestQbitAPI_Login(t *testing.T) {
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    "azure",
+			Password:    "hunter2",
+			DownloadDir: "/putarr",
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	server := httptest.NewServer(NewServer(config,
+		NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
+	defer server.Close()
+
+	client := newQbitClient(t)
+
+	// Requests without a session are forbidden.
+	resp, err := client.Get(server.URL + "/api/v2/app/webapiVersion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusForbidden; got != want {
+		t.Fatalf("got status %v without a session, want %v", got, want)
+	}
+
+	// Logging in with the wrong credentials fails.
+	if got, want := doQbitForm(t, client, server.URL+"/api/v2/auth/login", url.Values{
+		"username": {"azure"},
+		"password": {"wrong"},
+	}), "Fails."; got != want {
+		t.Fatalf("got login response %q with the wrong password, want %q", got, want)
+	}
+
+	// Logging in with the right credentials sets a session cookie that's used for subsequent requests.
+	if got, want := doQbitForm(t, client, server.URL+"/api/v2/auth/login", url.Values{
+		"username": {"azure"},
+		"password": {"hunter2"},
+	}), "Ok."; got != want {
+		t.Fatalf("got login response %q, want %q", got, want)
+	}
+
+	if got, want := doQbitGet(t, client, server.URL+"/api/v2/app/webapiVersion"), QbitAPIVersion; got != want {
+		t.Fatalf("got API version %q, want %q", got, want)
+	}
+
+	var preferences QbitPreferences
+	if err := json.Unmarshal([]byte(doQbitGet(t, client, server.URL+"/api/v2/app/preferences")), &preferences); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := preferences.SavePath, "/putarr"; got != want {
+		t.Fatalf("got save path %q, want %q", got, want)
+	}
+
+	// After logging out, the session is no longer valid.
+	doQbitForm(t, client, server.URL+"/api/v2/auth/logout", nil)
+	resp, err = client.Get(server.URL + "/api/v2/app/webapiVersion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusForbidden; got != want {
+		t.Fatalf("got status %v after logging out, want %v", got, want)
+	}
+}
+
+func TestQbitAPI_TorrentAddInfoDelete(t *testing.T) {
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    "azure",
+			Password:    "hunter2",
+			DownloadDir: "/putarr",
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "transfers.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), store)
+	server := httptest.NewServer(NewServer(config, putioProxy, nil))
+	defer server.Close()
+
+	client := newQbitClient(t)
+	doQbitForm(t, client, server.URL+"/api/v2/auth/login", url.Values{
+		"username": {"azure"},
+		"password": {"hunter2"},
+	})
+
+	// Categories map to the sub-directories of the download directory.
+	doQbitForm(t, client, server.URL+"/api/v2/torrents/createCategory", url.Values{"category": {"radarr"}})
+
+	var categories map[string]QbitCategory
+	if err := json.Unmarshal([]byte(doQbitGet(t, client, server.URL+"/api/v2/torrents/categories")), &categories); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := categories, map[string]QbitCategory{"radarr": {Name: "radarr", SavePath: "/putarr/radarr"}}; !cmp.Equal(got, want) {
+		t.Fatalf("got categories %v, want %v", got, want)
+	}
+
+	// Add a magnet with a category and tags, and a torrent file without them.
+	if got, want := doQbitForm(t, client, server.URL+"/api/v2/torrents/add", url.Values{
+		"urls":     {"magnet:?xt=urn:btih:AAA&dn=movie"},
+		"category": {"radarr"},
+		"tags":     {"4k, remux"},
+	}), "Ok."; got != want {
+		t.Fatalf("got add response %q, want %q", got, want)
+	}
+
+	var torrent bytes.Buffer
+	if err := bencode.Marshal(&torrent, TorrentFile{
+		Announce: "example.org/tracker",
+		Info:     TorrentFileInfo{Name: "show", Length: 123, PieceLength: 16384},
+	}); err != nil {
+		t.Fatalf("failed to marshal torrent: %s", err)
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("torrents", "show.torrent")
+	part.Write(torrent.Bytes())
+	form.Close()
+	resp, err := client.Post(server.URL+"/api/v2/torrents/add", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got, want := string(added), "Ok."; got != want {
+		t.Fatalf("got add response %q, want %q", got, want)
+	}
+
+	// Torrent files at HTTP(S) URLs are fetched by Putarr, with the cookie.
+	tracker := newTorrentFileServer(t, "episode", "uid=42")
+	defer tracker.Close()
+	if got, want := doQbitForm(t, client, server.URL+"/api/v2/torrents/add", url.Values{
+		"urls":   {tracker.URL + "/episode.torrent"},
+		"cookie": {"uid=42"},
+	}), "Ok."; got != want {
+		t.Fatalf("got add response %q for a torrent file URL, want %q", got, want)
+	}
+
+	var torrents []QbitTorrent
+	if err := json.Unmarshal([]byte(doQbitGet(t, client, server.URL+"/api/v2/torrents/info")), &torrents); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, torrent := range torrents {
+		names = append(names, torrent.Name)
+	}
+	slices.Sort(names)
+	if got, want := names, []string{"episode", "movie", "show"}; !cmp.Equal(got, want) {
+		t.Fatalf("got torrents %v, want %v", got, want)
+	}
+
+	// Filter the torrents by category.
+	if err := json.Unmarshal([]byte(doQbitGet(t, client, server.URL+"/api/v2/torrents/info?category=radarr")), &torrents); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(torrents), 1; got != want {
+		t.Fatalf("got %d torrents in category, want %d", got, want)
+	}
+	movie := torrents[0]
+	if got, want := movie.Name, "movie"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	if got, want := movie.SavePath, "/putarr/radarr"; got != want {
+		t.Errorf("got save path %q, want %q", got, want)
+	}
+	if got, want := movie.Tags, "4k,remux"; got != want {
+		t.Errorf("got tags %q, want %q", got, want)
+	}
+	if got, want := movie.State, "downloading"; got != want {
+		t.Errorf("got state %q, want %q", got, want)
+	}
+
+	// Once the transfer completes, the torrent is finished.
+	id, _ := putioProxy.ParseTorrentHash(context.Background(), movie.Hash)
+	fakePutio.SetTransferCompleted(id)
+	if err := json.Unmarshal([]byte(doQbitGet(t, client, server.URL+"/api/v2/torrents/info?hashes="+url.QueryEscape(movie.Hash))), &torrents); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(torrents), 1; got != want {
+		t.Fatalf("got %d torrents for hash, want %d", got, want)
+	}
+	if got, want := torrents[0].State, "pausedUP"; got != want {
+		t.Errorf("got state %q, want %q", got, want)
+	}
+
+	// Delete the movie.
+	doQbitForm(t, client, server.URL+"/api/v2/torrents/delete", url.Values{
+		"hashes":      {movie.Hash},
+		"deleteFiles": {"true"},
+	})
+	if err := json.Unmarshal([]byte(doQbitGet(t, client, server.URL+"/api/v2/torrents/info")), &torrents); err != nil {
+		t.Fatal(err)
+	}
+	names = nil
+	for _, torrent := range torrents {
+		names = append(names, torrent.Name)
+	}
+	slices.Sort(names)
+	if got, want := names, []string{"episode", "show"}; !cmp.Equal(got, want) {
+		t.Fatalf("got torrents %v after delete, want %v", got, want)
+	}
+}
+
+func newQbitClient(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func doQbitGet(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("unexpected status code. got `%v`, want `%v`", got, want)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bytes.TrimSpace(body))
+}
+
+func doQbitForm(t *testing.T, client *http.Client, url string, form url.Values) string {
+	t.Helper()
+	resp, err := client.PostForm(url, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("unexpected status code. got `%v`, want `%v`", got, want)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiters are shared by the APIs, so clients can't get around them by switching from one API to another.
+type limiters struct {
+	logins *loginLimiter
+	adds   *addLimiter
+}
+
+func newLimiters() *limiters {
+	return &limiters{
+		logins: &loginLimiter{clients: map[netip.Addr]*loginFailures{}},
+		adds:   &addLimiter{buckets: map[string]*tokenBucket{}},
+	}
+}
+
+// loginLimiter slows down the clients that keep failing to log in, by making them wait before their next attempt, twice
+// as long after every failure, and locks them out after too many failures in a row.
+type loginLimiter struct {
+	mu      sync.Mutex
+	clients map[netip.Addr]*loginFailures
+}
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	retryAt     time.Time
+}
+
+// Returns how long the client must wait before it can try to log in again, or 0 if it can try now.
+func (l *loginLimiter) wait(client netip.Addr, config ServerConfig, now time.Time) time.Duration {
+	if config.LoginAttempts <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	failures, ok := l.clients[client]
+	if !ok || now.After(failures.retryAt) {
+		return 0
+	}
+	return failures.retryAt.Sub(now)
+}
+
+// Records a failed login of the client.
+func (l *loginLimiter) fail(client netip.Addr, config ServerConfig, now time.Time) {
+	if config.LoginAttempts <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Failures are forgotten once the client stops failing for as long as a lockout.
+	for addr, failures := range l.clients {
+		if now.Sub(failures.lastFailure) > config.LockoutDuration {
+			delete(l.clients, addr)
+		}
+	}
+
+	failures, ok := l.clients[client]
+	if !ok {
+		failures = &loginFailures{}
+		l.clients[client] = failures
+	}
+	failures.count++
+	failures.lastFailure = now
+	if failures.count >= config.LoginAttempts {
+		log.Printf("locking out %s for %s after %d failed logins", client, config.LockoutDuration, failures.count)
+		failures.retryAt = now.Add(config.LockoutDuration)
+		return
+	}
+	// A single mistake isn't worth a delay.
+	if failures.count > 1 {
+		backoff := min(time.Second<<min(failures.count-2, 30), config.LockoutDuration)
+		failures.retryAt = now.Add(backoff)
+	}
+}
+
+// Forgets the failed logins of the client, once it logs in successfully.
+func (l *loginLimiter) succeed(client netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, client)
+}
+
+// addLimiter limits how many torrents each user can add with a token bucket, so a runaway client doesn't flood Put.io
+// with transfers, while still allowing bursts, e.g., when an *arr grabs a season pack episode by episode.
+type addLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Takes a token from the bucket of the user, and returns whether there was one.
+func (l *addLimiter) allow(user string, config ServerConfig, now time.Time) bool {
+	if config.AddsPerMinute <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(config.AddBurst)
+	bucket, ok := l.buckets[user]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		l.buckets[user] = bucket
+	}
+	refill := now.Sub(bucket.updated).Minutes() * float64(config.AddsPerMinute)
+	bucket.tokens = math.Min(burst, bucket.tokens+refill)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Returns the IP address of the client that made the request. When the request comes from a trusted proxy, the client
+// is the last address of the X-Forwarded-For header that isn't a trusted proxy, since the proxies append the address
+// they received the request from, while the client controls the start of the header.
+func clientIP(r *http.Request, config ServerConfig) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	client, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	client = client.Unmap()
+
+	trusted, _ := parseTrustedProxies(config.TrustedProxies)
+	isTrusted := func(addr netip.Addr) bool {
+		for _, prefix := range trusted {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrusted(client); i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+	}
+	return client
+}
+
+// Parses the trusted proxies, which are either IP addresses or CIDR ranges.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Sets the Retry-After header of the response, in whole seconds.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/albertb/putarr/internal/fakes"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClientIP(t *testing.T) {
+	config := ServerConfig{TrustedProxies: []string{"10.0.0.0/8", "::1"}}
+
+	for _, tt := range []struct {
+		explanation string
+		remoteAddr  string
+		forwarded   []string
+		want        string
+	}{
+		{"the remote address of a direct request", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"an untrusted remote address can't spoof the header", "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"the address forwarded by a trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"the trusted proxies are skipped", "[::1]:1234", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"the addresses prepended by the client are ignored", "10.0.0.1:1234",
+			[]string{"203.0.113.1", "198.51.100.1"}, "198.51.100.1"},
+		{"a trusted proxy without the header", "10.0.0.1:1234", nil, "10.0.0.1"},
+	} {
+		t.Run(tt.explanation, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/transmission/rpc", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got, want := clientIP(r, config), netip.MustParseAddr(tt.want); got != want {
+				t.Fatalf("got client IP %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	config := ServerConfig{LoginAttempts: 4, LockoutDuration: time.Hour}
+	client, other := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	start := time.Now()
+
+	logins := newLimiters().logins
+	wantWait := func(at time.Duration, want time.Duration) {
+		t.Helper()
+		if got := logins.wait(client, config, start.Add(at)); got != want {
+			t.Fatalf("got wait %s after %s, want %s", got, at, want)
+		}
+	}
+
+	// The first failure is free, then the wait doubles, until the client is locked out.
+	logins.fail(client, config, start)
+	wantWait(0, 0)
+	logins.fail(client, config, start)
+	wantWait(0, time.Second)
+	wantWait(time.Second, 0)
+	logins.fail(client, config, start.Add(time.Second))
+	wantWait(time.Second, 2*time.Second)
+	logins.fail(client, config, start.Add(3*time.Second))
+	wantWait(3*time.Second, time.Hour)
+	if got := logins.wait(other, config, start); got != 0 {
+		t.Fatalf("got wait %s for another client, want none", got)
+	}
+
+	// The failures are forgotten after the lockout, or after a successful login.
+	logins.fail(other, config, start.Add(2*time.Hour))
+	logins.fail(client, config, start.Add(2*time.Hour))
+	wantWait(2*time.Hour, 0)
+	logins.fail(client, config, start.Add(2*time.Hour))
+	logins.succeed(client)
+	wantWait(2*time.Hour, 0)
+}
+
+func TestAddLimiter(t *testing.T) {
+	config := ServerConfig{AddsPerMinute: 60, AddBurst: 2}
+	start := time.Now()
+
+	adds := newLimiters().adds
+	for _, tt := range []struct {
+		explanation string
+		user        string
+		at          time.Duration
+		allowed     bool
+	}{
+		{"the burst is allowed", "radarr", 0, true},
+		{"the burst is allowed", "radarr", 0, true},
+		{"past the burst, adds are limited", "radarr", 0, false},
+		{"each user has their own limit", "sonarr", 0, true},
+		{"the bucket refills over time", "radarr", time.Second, true},
+		{"the bucket refills at the configured rate", "radarr", 1500 * time.Millisecond, false},
+	} {
+		if got, want := adds.allow(tt.user, config, start.Add(tt.at)), tt.allowed; got != want {
+			t.Fatalf("%s: got allowed %v, want %v", tt.explanation, got, want)
+		}
+	}
+}
+
+func TestTransmissionRPC_RateLimits(t *testing.T) {
+	config := &Config{
+		Server: ServerConfig{
+			LoginAttempts:   2,
+			LockoutDuration: time.Hour,
+			AddsPerMinute:   1,
+			AddBurst:        1,
+		},
+		Transmission: TransmissionConfig{
+			Username:    "admin",
+			Password:    "hunter2",
+			DownloadDir: "/putarr",
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	server := httptest.NewServer(NewServer(config, NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
+	defer server.Close()
+
+	// Users can only add torrents so fast.
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-add", map[string]any{
+		"filename": "magnet:?xt=urn:btih:AAA&dn=movie"})
+	doRPCAndExpectResult(t, config, server.URL, "torrent-add", map[string]any{
+		"filename": "magnet:?xt=urn:btih:BBB&dn=show"}, "user `admin` is adding torrents too fast, try again later")
+
+	// Clients are locked out after too many failed logins, even with the right credentials.
+	wrong := *config
+	wrong.Transmission.Password = "wrongpassword"
+	doRPCAndExpectCode[any](t, &wrong, server.URL, "session-get", nil, http.StatusUnauthorized)
+	doRPCAndExpectCode[any](t, &wrong, server.URL, "session-get", nil, http.StatusUnauthorized)
+	doRPCAndExpectCode[any](t, config, server.URL, "session-get", nil, http.StatusTooManyRequests)
+}
+
+func TestQbitAndSABnzbdAPI_RateLimits(t *testing.T) {
+	config := &Config{
+		Server: ServerConfig{
+			LoginAttempts:   2,
+			LockoutDuration: time.Hour,
+			AddsPerMinute:   1,
+			AddBurst:        2,
+		},
+		Transmission: TransmissionConfig{
+			Username:    "admin",
+			Password:    "hunter2",
+			DownloadDir: "/putarr",
+		},
+		SABnzbd: &SABnzbdConfig{APIKey: "secret"},
+	}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), nil)
+	server := httptest.NewServer(NewServer(config, putioProxy, nil))
+	defer server.Close()
+
+	// Each torrent of a qBittorrent request takes a token, not each request.
+	client := newQbitClient(t)
+	doQbitForm(t, client, server.URL+"/api/v2/auth/login", url.Values{"username": {"admin"}, "password": {"hunter2"}})
+	doQbitForm(t, client, server.URL+"/api/v2/torrents/add", url.Values{"urls": {
+		"magnet:?xt=urn:btih:AAA&dn=one\nmagnet:?xt=urn:btih:BBB&dn=two\nmagnet:?xt=urn:btih:CCC&dn=three"}})
+	transfers, err := putioProxy.GetTransfers(context.Background())
+	if err != nil {
+		t.Fatalf("failed to list transfers: %s", err)
+	}
+	if got, want := len(transfers), 2; got != want {
+		t.Fatalf("got %d transfers after adding three torrents, want %d", got, want)
+	}
+	resp, err := client.PostForm(server.URL+"/api/v2/torrents/add", url.Values{"urls": {"magnet:?xt=urn:btih:DDD&dn=four"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusTooManyRequests; got != want {
+		t.Fatalf("got status %v when adding too fast, want %v", got, want)
+	}
+
+	// The SABnzbd API takes tokens too.
+	sabnzbd := func(params url.Values) *http.Response {
+		t.Helper()
+		params.Set("output", "json")
+		resp, err := http.Get(server.URL + "/api?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	addurl := func(name string) sabnzbdStatus {
+		t.Helper()
+		resp := sabnzbd(url.Values{"mode": {"addurl"}, "apikey": {"secret"}, "name": {name}})
+		defer resp.Body.Close()
+		var status sabnzbdStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("failed to decode response: %s", err)
+		}
+		return status
+	}
+	addurl("magnet:?xt=urn:btih:EEE&dn=five")
+	addurl("magnet:?xt=urn:btih:FFF&dn=six")
+	if got, want := addurl("magnet:?xt=urn:btih:GGG&dn=seven"),
+		(sabnzbdStatus{Error: "Adding torrents too fast, try again later"}); !cmp.Equal(got, want) {
+		t.Fatalf("got %+v when adding too fast, want %+v", got, want)
+	}
+
+	// Wrong API keys count as failed logins.
+	sabnzbd(url.Values{"mode": {"queue"}, "apikey": {"wrong"}}).Body.Close()
+	sabnzbd(url.Values{"mode": {"queue"}, "apikey": {"wrong"}}).Body.Close()
+	resp = sabnzbd(url.Values{"mode": {"queue"}, "apikey": {"secret"}})
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusTooManyRequests; got != want {
+		t.Fatalf("got status %v after too many wrong API keys, want %v", got, want)
+	}
+}
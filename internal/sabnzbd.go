@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// SABnzbdQueueSlot is a job in the download queue as described by the SABnzbd API.
+type SABnzbdQueueSlot struct {
+	NzoID      string `json:"nzo_id"`
+	Filename   string `json:"filename"`
+	Category   string `json:"cat"`
+	MB         string `json:"mb"`
+	MBLeft     string `json:"mbleft"`
+	Percentage string `json:"percentage"`
+	Status     string `json:"status"`
+	TimeLeft   string `json:"timeleft"`
+	Priority   string `json:"priority"`
+}
+
+// SABnzbdHistorySlot is a job in the download history as described by the SABnzbd API.
+type SABnzbdHistorySlot struct {
+	NzoID        string `json:"nzo_id"`
+	Name         string `json:"name"`
+	Category     string `json:"category"`
+	Bytes        int64  `json:"bytes"`
+	Status       string `json:"status"`
+	Storage      string `json:"storage"`
+	FailMessage  string `json:"fail_message"`
+	DownloadTime int64  `json:"download_time"`
+	Completed    int64  `json:"completed"`
+}
+
+type SABnzbdQueue struct {
+	Paused bool               `json:"paused"`
+	Slots  []SABnzbdQueueSlot `json:"slots"`
+}
+
+type SABnzbdHistory struct {
+	Slots []SABnzbdHistorySlot `json:"slots"`
+}
+
+// SABnzbdCategory is a category as described by the SABnzbd configuration.
+type SABnzbdCategory struct {
+	Name     string `json:"name"`
+	Dir      string `json:"dir"`
+	Priority int    `json:"priority"`
+}
+
+// SABnzbdConfigMisc holds the subset of the SABnzbd miscellaneous configuration that clients rely on.
+type SABnzbdConfigMisc struct {
+	CompleteDir string `json:"complete_dir"`
+}
+
+type SABnzbdConfigResponse struct {
+	Misc       SABnzbdConfigMisc `json:"misc"`
+	Categories []SABnzbdCategory `json:"categories"`
+}
+
+// SABnzbdVersion is the version of SABnzbd reported to clients.
+const SABnzbdVersion = "4.2.3"
+
+// Whether the transfer belongs in the history rather than the queue.
+func isSABnzbdHistory(torrent Torrent) bool {
+	return torrent.IsFinished || (torrent.ErrorString != nil && *torrent.ErrorString != "")
+}
+
+func convertToSABnzbdQueueSlot(transfer Transfer, downloadDir string) SABnzbdQueueSlot {
+	torrent := convertFromPutioTransfer(transfer)
+
+	percentage := int64(0)
+	if torrent.TotalSize > 0 {
+		percentage = (torrent.TotalSize - torrent.LeftUntilDone) * 100 / torrent.TotalSize
+	}
+
+	status := "Downloading"
+	switch torrent.Status {
+	case TorrentStatusStopped:
+		status = "Paused"
+	case TorrentStatusCheckPending, TorrentStatusDownloadPending:
+		status = "Queued"
+	case TorrentStatusChecking:
+		status = "Checking"
+	}
+
+	eta := time.Duration(max(torrent.ETA, 0)) * time.Second
+	return SABnzbdQueueSlot{
+		NzoID:      *torrent.HashString,
+		Filename:   torrent.Name,
+		Category:   categoryFromDir(transfer.DownloadDir, downloadDir),
+		MB:         fmt.Sprintf("%.2f", float64(torrent.TotalSize)/(1<<20)),
+		MBLeft:     fmt.Sprintf("%.2f", float64(torrent.LeftUntilDone)/(1<<20)),
+		Percentage: fmt.Sprint(percentage),
+		Status:     status,
+		TimeLeft:   fmt.Sprintf("%d:%02d:%02d", int(eta.Hours()), int(eta.Minutes())%60, int(eta.Seconds())%60),
+		Priority:   "Normal",
+	}
+}
+
+func convertToSABnzbdHistorySlot(transfer Transfer, downloadDir string) SABnzbdHistorySlot {
+	torrent := convertFromPutioTransfer(transfer)
+
+	slot := SABnzbdHistorySlot{
+		NzoID:        *torrent.HashString,
+		Name:         torrent.Name,
+		Category:     categoryFromDir(transfer.DownloadDir, downloadDir),
+		Bytes:        torrent.TotalSize,
+		Status:       "Completed",
+		Storage:      path.Join(transfer.DownloadDir, torrent.Name),
+		DownloadTime: torrent.SecondsDownloading,
+	}
+	if torrent.ErrorString != nil && *torrent.ErrorString != "" {
+		slot.Status = "Failed"
+		slot.FailMessage = *torrent.ErrorString
+	}
+	if transfer.FinishedAt != nil {
+		slot.Completed = transfer.FinishedAt.Unix()
+	}
+	return slot
+}
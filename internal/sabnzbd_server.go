@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/albertb/putarr/internal/torrent"
+)
+
+// Maximum size of the NZB or torrent files uploaded in a single request.
+const sabnzbdMaxUploadSize = 32 << 20
+
+// The SABnzbd API isn't called by a user, so the torrents added through it are limited under this name.
+const sabnzbdAddLimiterKey = "sabnzbd"
+
+type sabnzbdStatus struct {
+	Status bool     `json:"status"`
+	NzoIDs []string `json:"nzo_ids,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// Returns the handler for the SABnzbd API. Jobs map onto Put.io transfers, which are tagged with the same callback URL
+// as the transfers added through the Transmission RPC, so the janitor cleans them up the same way.
+func newSABnzbdHandler(source ConfigSource, limits *limiters, putioProxy *PutioProxy, downloader *Downloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := configFor(r.Context(), source)
+		if config.SABnzbd == nil {
+			http.NotFound(w, r)
+			return
+		}
+		downloadDir := config.Transmission.DownloadDir
+
+		// Clients send either a multipart form when uploading files, or plain query parameters.
+		err := r.ParseMultipartForm(sabnzbdMaxUploadSize)
+		if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			log.Println("failed to parse form:", err)
+			writeJSON(w, sabnzbdStatus{Error: "Bad request"})
+			return
+		}
+
+		mode := r.FormValue("mode")
+
+		// Like SABnzbd, the version is available without an API key.
+		if mode == "version" {
+			writeJSON(w, map[string]string{"version": SABnzbdVersion})
+			return
+		}
+
+		// Wrong API keys count as failed logins, like wrong passwords on the other APIs.
+		client := clientIP(r, config.Server)
+		if wait := limits.logins.wait(client, config.Server, time.Now()); wait > 0 {
+			setRetryAfter(w, wait)
+			http.Error(w, "Too many failed logins", http.StatusTooManyRequests)
+			return
+		}
+		if !constantTimeEqual(r.FormValue("apikey"), config.SABnzbd.APIKey) {
+			// Clients make a first request without an API key to find out it's required, so it isn't a failure.
+			if r.FormValue("apikey") != "" {
+				log.Printf("failed login with an API key from %s", client)
+				limits.logins.fail(client, config.Server, time.Now())
+			}
+			writeJSON(w, sabnzbdStatus{Error: "API Key Incorrect"})
+			return
+		}
+		limits.logins.succeed(client)
+
+		switch mode {
+		case "get_config":
+			categories, err := putioProxy.GetCategories(r.Context())
+			if err != nil {
+				log.Println("failed to list categories:", err)
+				writeJSON(w, sabnzbdStatus{Error: "Failed to list categories"})
+				return
+			}
+			result := SABnzbdConfigResponse{
+				Misc:       SABnzbdConfigMisc{CompleteDir: downloadDir},
+				Categories: []SABnzbdCategory{{Name: "*"}},
+			}
+			for _, category := range categories {
+				result.Categories = append(result.Categories, SABnzbdCategory{Name: category, Dir: category})
+			}
+			writeJSON(w, map[string]SABnzbdConfigResponse{"config": result})
+		case "fullstatus":
+			writeJSON(w, map[string]any{"status": map[string]string{"completedir": downloadDir}})
+		case "addurl":
+			if !limits.adds.allow(sabnzbdAddLimiterKey, config.Server, time.Now()) {
+				log.Println("the SABnzbd API is adding torrents too fast")
+				writeJSON(w, sabnzbdStatus{Error: "Adding torrents too fast, try again later"})
+				return
+			}
+			category := sabnzbdCategory(r)
+			metadata := TransferMetadata{Client: "sabnzbd", Category: category}
+			link, dir := r.FormValue("name"), dirFromCategory(category, downloadDir)
+			transfer, err := addLink(r.Context(), putioProxy, link, "", dir, metadata)
+			if errors.Is(err, ErrInvalidTorrent) {
+				// The URL isn't a torrent file, e.g., it's an NZB file, so let Put.io fetch it.
+				transfer, err = putioProxy.AddTransfer(r.Context(), link, dir, metadata)
+			}
+			if err != nil {
+				log.Println("failed to add transfer to Put.io:", err)
+				writeJSON(w, sabnzbdStatus{Error: "Failed to add URL"})
+				return
+			}
+			writeJSON(w, sabnzbdStatus{Status: true, NzoIDs: []string{formatTransferHash(transfer)}})
+		case "addfile":
+			category := sabnzbdCategory(r)
+			file, err := readSABnzbdFile(r)
+			if err != nil {
+				log.Println("failed to read uploaded file:", err)
+				writeJSON(w, sabnzbdStatus{Error: err.Error()})
+				return
+			}
+			// Put.io fetches URLs and torrents, but it can't download the articles listed in an NZB file.
+			if _, err := torrent.Decode(file); err != nil {
+				writeJSON(w, sabnzbdStatus{Error: "Put.io cannot download NZB files; only URLs and torrent files are supported"})
+				return
+			}
+			if !limits.adds.allow(sabnzbdAddLimiterKey, config.Server, time.Now()) {
+				log.Println("the SABnzbd API is adding torrents too fast")
+				writeJSON(w, sabnzbdStatus{Error: "Adding torrents too fast, try again later"})
+				return
+			}
+			metadata := TransferMetadata{Client: "sabnzbd", Category: category}
+			transfer, err := putioProxy.UploadTorrent(r.Context(), file, dirFromCategory(category, downloadDir), metadata)
+			if err != nil {
+				log.Println("failed to upload torrent to Put.io:", err)
+				writeJSON(w, sabnzbdStatus{Error: "Failed to add file"})
+				return
+			}
+			writeJSON(w, sabnzbdStatus{Status: true, NzoIDs: []string{formatTransferHash(transfer)}})
+		case "queue", "history":
+			if r.FormValue("name") == "delete" {
+				handleSABnzbdDelete(w, r, mode == "queue", putioProxy, downloader)
+				return
+			}
+
+			transfers, err := getTransfers(r.Context(), putioProxy, downloader)
+			if err != nil {
+				log.Println("failed to list Put.io transfers:", err)
+				writeJSON(w, sabnzbdStatus{Error: "Failed to list transfers"})
+				return
+			}
+
+			category := r.FormValue("category")
+			queue := SABnzbdQueue{Slots: []SABnzbdQueueSlot{}}
+			history := SABnzbdHistory{Slots: []SABnzbdHistorySlot{}}
+			for _, transfer := range transfers {
+				if !isSABnzbdJob(transfer) {
+					continue
+				}
+				if category != "" && categoryFromDir(transfer.DownloadDir, downloadDir) != category {
+					continue
+				}
+				if isSABnzbdHistory(convertFromPutioTransfer(transfer)) {
+					history.Slots = append(history.Slots, convertToSABnzbdHistorySlot(transfer, downloadDir))
+				} else {
+					queue.Slots = append(queue.Slots, convertToSABnzbdQueueSlot(transfer, downloadDir))
+				}
+			}
+
+			if mode == "queue" {
+				writeJSON(w, map[string]SABnzbdQueue{"queue": queue})
+			} else {
+				writeJSON(w, map[string]SABnzbdHistory{"history": history})
+			}
+		case "delete":
+			handleSABnzbdDelete(w, r, false, putioProxy, downloader)
+		default:
+			log.Printf("unexpected mode: %s", mode)
+			writeJSON(w, sabnzbdStatus{Error: "Not implemented"})
+		}
+	})
+}
+
+// Returns whether the transfer was added through the SABnzbd API. The other transfers belong to the other clients, and
+// the *arrs configured with several clients would import them twice if they were listed as jobs too.
+func isSABnzbdJob(transfer Transfer) bool {
+	return transfer.Metadata != nil && transfer.Metadata.Client == "sabnzbd"
+}
+
+// Deletes the jobs listed in the value parameter, or all the SABnzbd jobs in the queue or the history. Queued jobs always
+// have their files deleted since they're incomplete, while the files of jobs in the history are only deleted when
+// requested.
+func handleSABnzbdDelete(w http.ResponseWriter, r *http.Request, queued bool, putioProxy *PutioProxy, downloader *Downloader) {
+	deleteFiles := queued || r.FormValue("del_files") == "1"
+
+	var transferIDs []int64
+	if value := r.FormValue("value"); value == "all" {
+		transfers, err := putioProxy.GetTransfers(r.Context())
+		if err != nil {
+			log.Println("failed to list Put.io transfers:", err)
+			writeJSON(w, sabnzbdStatus{Error: "Failed to list transfers"})
+			return
+		}
+		// Only the jobs the mode lists are deleted.
+		for _, transfer := range transfers {
+			if !isSABnzbdJob(transfer) || isSABnzbdHistory(convertFromPutioTransfer(transfer)) == queued {
+				continue
+			}
+			transferIDs = append(transferIDs, transfer.ID)
+		}
+	} else {
+		for _, nzoID := range strings.Split(value, ",") {
+			transferID, err := putioProxy.ParseTorrentHash(r.Context(), strings.TrimSpace(nzoID))
+			if err != nil {
+				log.Println("failed to parse job ID:", err)
+				writeJSON(w, sabnzbdStatus{Error: "Invalid job ID"})
+				return
+			}
+			transferIDs = append(transferIDs, transferID)
+		}
+	}
+
+	if err := removeTransfers(r.Context(), putioProxy, downloader, deleteFiles, transferIDs...); err != nil {
+		log.Println("failed to remove transfers:", err)
+		writeJSON(w, sabnzbdStatus{Error: "Failed to delete jobs"})
+		return
+	}
+	writeJSON(w, sabnzbdStatus{Status: true})
+}
+
+// Clients use either the cat or the category parameter.
+func sabnzbdCategory(r *http.Request) string {
+	category := r.FormValue("cat")
+	if category == "" {
+		category = r.FormValue("category")
+	}
+	// The default category is the download directory itself.
+	if category == "*" || category == "Default" {
+		return ""
+	}
+	return category
+}
+
+// Clients upload the file as either the name or the nzbfile form field.
+func readSABnzbdFile(r *http.Request) ([]byte, error) {
+	if r.MultipartForm == nil {
+		return nil, errors.New("missing file")
+	}
+	for _, field := range []string{"name", "nzbfile"} {
+		for _, header := range r.MultipartForm.File[field] {
+			file, err := header.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			return io.ReadAll(file)
+		}
+	}
+	return nil, errors.New("missing file")
+}
@@ -0,0 +1,297 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/albertb/putarr/internal/fakes"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSABnzbdAPI(t *testing.T) {
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    "azure",
+			Password:    "hunter2",
+			DownloadDir: "/putarr",
+		},
+		SABnzbd: &SABnzbdConfig{APIKey: "secret"},
+	}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+	if _, err := fakePutio.CreateFolder(folder.ID, "sonarr"); err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "transfers.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), store)
+	server := httptest.NewServer(NewServer(config, putioProxy, nil))
+	defer server.Close()
+
+	api := func(params url.Values, v any) {
+		t.Helper()
+		params.Set("output", "json")
+		body := doQbitGet(t, http.DefaultClient, server.URL+"/api?"+params.Encode())
+		if err := json.Unmarshal([]byte(body), v); err != nil {
+			t.Fatalf("failed to decode response %q: %s", body, err)
+		}
+	}
+
+	// The version is available without an API key, but nothing else is.
+	var version map[string]string
+	api(url.Values{"mode": {"version"}}, &version)
+	if got, want := version["version"], SABnzbdVersion; got != want {
+		t.Fatalf("got version %q, want %q", got, want)
+	}
+
+	var status sabnzbdStatus
+	api(url.Values{"mode": {"queue"}, "apikey": {"wrong"}}, &status)
+	if got, want := status, (sabnzbdStatus{Error: "API Key Incorrect"}); !cmp.Equal(got, want) {
+		t.Fatalf("got %+v with the wrong API key, want %+v", got, want)
+	}
+
+	var sabConfig map[string]SABnzbdConfigResponse
+	api(url.Values{"mode": {"get_config"}, "apikey": {"secret"}}, &sabConfig)
+	if diff := cmp.Diff(SABnzbdConfigResponse{
+		Misc:       SABnzbdConfigMisc{CompleteDir: "/putarr"},
+		Categories: []SABnzbdCategory{{Name: "*"}, {Name: "sonarr", Dir: "sonarr"}},
+	}, sabConfig["config"]); diff != "" {
+		t.Fatalf("unexpected config (-want +got):\n%s", diff)
+	}
+
+	// Add the URL of a torrent file, which Putarr fetches like the Transmission RPC does.
+	indexer := newTorrentFileServer(t, "show", "")
+	defer indexer.Close()
+	api(url.Values{
+		"mode":   {"addurl"},
+		"apikey": {"secret"},
+		"name":   {indexer.URL + "/get?id=123"},
+		"cat":    {"sonarr"},
+	}, &status)
+	if !status.Status || len(status.NzoIDs) != 1 {
+		t.Fatalf("failed to add URL: %+v", status)
+	}
+	nzoID := status.NzoIDs[0]
+
+	// NZB files can't be fetched by Put.io, so uploading one fails.
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("name", "show.nzb")
+	part.Write([]byte(`<?xml version="1.0"?><nzb></nzb>`))
+	form.Close()
+	resp, err := http.Post(server.URL+"/api?mode=addfile&apikey=secret", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = sabnzbdStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if status.Status || status.Error == "" {
+		t.Fatalf("got %+v when uploading an NZB file, want an error", status)
+	}
+
+	// The transfer is in the queue while it's downloading.
+	var queue map[string]SABnzbdQueue
+	api(url.Values{"mode": {"queue"}, "apikey": {"secret"}, "category": {"sonarr"}}, &queue)
+	if got, want := len(queue["queue"].Slots), 1; got != want {
+		t.Fatalf("got %d jobs in the queue, want %d", got, want)
+	}
+	slot := queue["queue"].Slots[0]
+	if diff := cmp.Diff(SABnzbdQueueSlot{
+		NzoID:      nzoID,
+		Filename:   "show",
+		Category:   "sonarr",
+		MB:         "0.00",
+		MBLeft:     "0.00",
+		Percentage: "0",
+		Status:     "Downloading",
+		TimeLeft:   "0:00:00",
+		Priority:   "Normal",
+	}, slot); diff != "" {
+		t.Fatalf("unexpected queue slot (-want +got):\n%s", diff)
+	}
+
+	// Once the transfer completes, it moves to the history.
+	id, _ := putioProxy.ParseTorrentHash(context.Background(), nzoID)
+	fakePutio.SetTransferCompleted(id)
+
+	api(url.Values{"mode": {"queue"}, "apikey": {"secret"}}, &queue)
+	if got, want := len(queue["queue"].Slots), 0; got != want {
+		t.Fatalf("got %d jobs in the queue after completion, want %d", got, want)
+	}
+
+	var history map[string]SABnzbdHistory
+	api(url.Values{"mode": {"history"}, "apikey": {"secret"}}, &history)
+	if got, want := len(history["history"].Slots), 1; got != want {
+		t.Fatalf("got %d jobs in the history, want %d", got, want)
+	}
+	if got, want := history["history"].Slots[0].Status, "Completed"; got != want {
+		t.Errorf("got status %q, want %q", got, want)
+	}
+
+	// Delete the job from the history.
+	api(url.Values{
+		"mode":      {"history"},
+		"apikey":    {"secret"},
+		"name":      {"delete"},
+		"value":     {nzoID},
+		"del_files": {"1"},
+	}, &status)
+	if !status.Status {
+		t.Fatalf("failed to delete job: %+v", status)
+	}
+
+	api(url.Values{"mode": {"history"}, "apikey": {"secret"}}, &history)
+	if got, want := len(history["history"].Slots), 0; got != want {
+		t.Fatalf("got %d jobs in the history after delete, want %d", got, want)
+	}
+}
+
+func TestSABnzbdAPI_DeleteAll(t *testing.T) {
+	config := &Config{
+		Transmission: TransmissionConfig{DownloadDir: "/putarr"},
+		SABnzbd:      &SABnzbdConfig{APIKey: "secret"},
+	}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "transfers.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), store)
+	server := httptest.NewServer(NewServer(config, putioProxy, nil))
+	defer server.Close()
+
+	add := func(name, client string) Transfer {
+		t.Helper()
+		transfer, err := putioProxy.AddTransfer(context.Background(), "magnet:?xt=urn:btih:"+name+"&dn="+name, "/putarr",
+			TransferMetadata{Client: client})
+		if err != nil {
+			t.Fatalf("failed to add transfer: %s", err)
+		}
+		return transfer
+	}
+	add("queued", "sabnzbd")
+	fakePutio.SetTransferCompleted(add("completed", "sabnzbd").ID)
+	add("other", "qbittorrent")
+	fakePutio.SetTransferCompleted(add("othercompleted", "qbittorrent").ID)
+
+	transferNames := func() []string {
+		t.Helper()
+		transfers, err := putioProxy.GetTransfers(context.Background())
+		if err != nil {
+			t.Fatalf("failed to list transfers: %s", err)
+		}
+		var names []string
+		for _, transfer := range transfers {
+			names = append(names, transfer.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+	deleteAll := func(mode string) {
+		t.Helper()
+		var status sabnzbdStatus
+		body := doQbitGet(t, http.DefaultClient, server.URL+"/api?"+url.Values{
+			"mode":   {mode},
+			"apikey": {"secret"},
+			"name":   {"delete"},
+			"value":  {"all"},
+			"output": {"json"},
+		}.Encode())
+		if err := json.Unmarshal([]byte(body), &status); err != nil || !status.Status {
+			t.Fatalf("failed to delete all the jobs in the %s: %s", mode, body)
+		}
+	}
+
+	// Only the jobs added through the SABnzbd API are listed, so the *arrs don't import the other torrents twice.
+	jobNames := func(mode string) []string {
+		t.Helper()
+		body := doQbitGet(t, http.DefaultClient, server.URL+"/api?"+url.Values{
+			"mode":   {mode},
+			"apikey": {"secret"},
+			"output": {"json"},
+		}.Encode())
+		var response struct {
+			Queue   SABnzbdQueue   `json:"queue"`
+			History SABnzbdHistory `json:"history"`
+		}
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			t.Fatalf("failed to decode response %q: %s", body, err)
+		}
+		var names []string
+		for _, slot := range response.Queue.Slots {
+			names = append(names, slot.Filename)
+		}
+		for _, slot := range response.History.Slots {
+			names = append(names, slot.Name)
+		}
+		return names
+	}
+	if diff := cmp.Diff([]string{"queued"}, jobNames("queue")); diff != "" {
+		t.Fatalf("unexpected jobs in the queue (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"completed"}, jobNames("history")); diff != "" {
+		t.Fatalf("unexpected jobs in the history (-want +got):\n%s", diff)
+	}
+
+	// Deleting all the jobs of the queue leaves the history, and the transfers of other clients, alone.
+	deleteAll("queue")
+	if diff := cmp.Diff([]string{"completed", "other", "othercompleted"}, transferNames()); diff != "" {
+		t.Fatalf("unexpected transfers after deleting the queue (-want +got):\n%s", diff)
+	}
+	deleteAll("history")
+	if diff := cmp.Diff([]string{"other", "othercompleted"}, transferNames()); diff != "" {
+		t.Fatalf("unexpected transfers after deleting the history (-want +got):\n%s", diff)
+	}
+}
+
+func TestSABnzbdAPI_Disabled(t *testing.T) {
+	config := &Config{
+		Transmission: TransmissionConfig{DownloadDir: "/putarr"},
+	}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	server := httptest.NewServer(NewServer(config,
+		NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api?mode=version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+		t.Fatalf("got status %v, want %v", got, want)
+	}
+}
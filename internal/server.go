@@ -1,32 +1,151 @@
 package internal
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
-func NewServer(config *Config, token string, putioProxy *PutioProxy) http.Handler {
+// transmissionSessions hands out the session IDs of the Transmission RPC, which protect it against CSRF since browsers
+// can't read the ID from the response to a cross-origin request. The ID is random, changes on every restart, and rotates
+// on the configured schedule. Previous IDs stay valid for the configured overlap so clients don't fail all at once.
+type transmissionSessions struct {
+	mu        sync.Mutex
+	current   string
+	createdAt time.Time
+	previous  map[string]time.Time // Previous IDs, and when they stop being accepted.
+}
+
+func newTransmissionSessions() *transmissionSessions {
+	return &transmissionSessions{previous: map[string]time.Time{}}
+}
+
+// Returns the current session ID, rotating it first if it's due, and whether the given ID is valid.
+func (s *transmissionSessions) validate(id string, config TransmissionConfig, now time.Time) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == "" || (config.SessionRotation > 0 && now.Sub(s.createdAt) >= config.SessionRotation) {
+		buf := make([]byte, 24)
+		if _, err := rand.Read(buf); err != nil {
+			return "", false, err
+		}
+		if s.current != "" {
+			s.previous[s.current] = now.Add(config.SessionOverlap)
+		}
+		s.current = hex.EncodeToString(buf)
+		s.createdAt = now
+	}
+
+	valid := subtle.ConstantTimeCompare([]byte(id), []byte(s.current)) == 1
+	for previous, expiry := range s.previous {
+		if now.After(expiry) {
+			delete(s.previous, previous)
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(id), []byte(previous)) == 1 {
+			valid = true
+		}
+	}
+	return s.current, valid, nil
+}
+
+// NewServer returns the handler for the Transmission RPC, the qBittorrent WebUI API, and the SABnzbd API when it's
+// enabled. The downloader is optional and should be nil when local downloading is disabled. Each request sees a
+// snapshot of the config taken when it starts, so the config can be reloaded while requests are in flight.
+func NewServer(config ConfigSource, putioProxy *PutioProxy, downloader *Downloader) http.Handler {
 	mux := http.NewServeMux()
 
-	mux.Handle("GET /transmission/rpc", http.HandlerFunc(
+	rpc := http.NewServeMux()
+	rpc.Handle("GET /transmission/rpc", http.HandlerFunc(
 		// No-op. This is called by the client to get the session ID token which is handled in the middleware.
 		func(w http.ResponseWriter, r *http.Request) {},
 	))
+	auth, limits := newAuthenticator(), newLimiters()
+	rpc.Handle("POST /transmission/rpc", handlePostRPC(config, limits.adds, putioProxy, downloader))
+
+	mux.Handle("/transmission/", basicAuthMiddleware(config, auth, limits.logins,
+		transmissionSessionMiddleware(config, newTransmissionSessions(), rpc)))
+
+	mux.Handle("/api/v2/", newQbitHandler(config, auth, limits, putioProxy, downloader))
+
+	// The SABnzbd API can be enabled and disabled by reloading the config, so its handler checks whether it's enabled.
+	sabnzbd := newSABnzbdHandler(config, limits, putioProxy, downloader)
+	mux.Handle("/api", sabnzbd)
+	mux.Handle("/sabnzbd/api", sabnzbd)
+
+	return configSnapshotMiddleware(config, mux)
+}
+
+// Lists the transfers the user can see, along with their local download progress when local downloading is enabled.
+func getTransfers(ctx context.Context, putioProxy *PutioProxy, downloader *Downloader) ([]Transfer, error) {
+	transfers, err := putioProxy.GetTransfers(ctx)
+	if err != nil {
+		return transfers, err
+	}
+	user := userFor(ctx)
+	transfers = slices.DeleteFunc(transfers, func(transfer Transfer) bool {
+		return !user.allowsDir(transfer.DownloadDir)
+	})
+	if downloader != nil {
+		downloader.AnnotateTransfers(transfers)
+	}
+	return transfers, nil
+}
 
-	mux.Handle("POST /transmission/rpc", handlePostRPC(config.Transmission.DownloadDir, putioProxy))
+// Removes the transfers, along with their local downloads when local downloading is enabled.
+func removeTransfers(ctx context.Context, putioProxy *PutioProxy, downloader *Downloader, removeFiles bool, ids ...int64) error {
+	if err := checkTransfersAllowed(ctx, putioProxy, ids); err != nil {
+		return err
+	}
+	if err := putioProxy.RemoveTransfers(ctx, removeFiles, ids...); err != nil {
+		return err
+	}
+	if downloader != nil {
+		for _, id := range ids {
+			if err := downloader.Remove(id, removeFiles); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	return basicAuthMiddleware(
-		config.Transmission.Username,
-		config.Transmission.Password,
-		dumbSessionMiddleware(token, mux))
+// Fails when some of the transfers are outside of the download directories the user is restricted to.
+func checkTransfersAllowed(ctx context.Context, putioProxy *PutioProxy, ids []int64) error {
+	user := userFor(ctx)
+	if len(user.DownloadDirs) == 0 {
+		return nil
+	}
+	transfers, err := getTransfers(ctx, putioProxy, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list Put.io transfers: %w", err)
+	}
+	for _, id := range ids {
+		if !slices.ContainsFunc(transfers, func(transfer Transfer) bool { return transfer.ID == id }) {
+			return fmt.Errorf("user `%s` isn't allowed to change the torrent with ID `%d`", user.Name, id)
+		}
+	}
+	return nil
 }
 
-func handlePostRPC(downloadDir string, putioProxy *PutioProxy) http.Handler {
+func handlePostRPC(config ConfigSource, adds *addLimiter, putioProxy *PutioProxy, downloader *Downloader) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := configFor(r.Context(), config)
+		downloadDir := current.Transmission.DownloadDir
+
 		var request Request
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			log.Println("failed to decode request:", err)
@@ -34,85 +153,22 @@ func handlePostRPC(downloadDir string, putioProxy *PutioProxy) http.Handler {
 			return
 		}
 
-		var err error
+		user := userFor(r.Context())
+		log.Println(request.Method, "by", user.Name)
 		var result any
-		switch request.Method {
-		case "session-get":
-			log.Println("session-get")
-			result = Session{
-				RPCVersion:  "18",
-				Version:     "14.0.0",
-				DownloadDir: downloadDir,
-			}
-		case "torrent-add":
-			log.Println("torrent-add")
-			// The download-dir argument is an optional string.
-			dir, ok := request.Arguments["download-dir"].(string)
-			if !ok {
-				// Use the default dir when one isn't specified in the request.
-				dir = downloadDir
-			}
-
-			var transfer Transfer
-			if filename, ok := request.Arguments["filename"].(string); ok {
-				// The filename argument is a string that contains a magnet URL.
-				transfer, err = putioProxy.AddTransfer(r.Context(), filename, dir)
-				if err != nil {
-					log.Println("failed to add transfer to Put.io:", err)
-					http.Error(w, "Internal server error", http.StatusInternalServerError)
-					return
-				}
-			} else if metainfo, ok := request.Arguments["metainfo"].(string); ok {
-				// The metainfo argument is a string that contains a Base64-encoded torrent file.
-				torrent, err := base64.StdEncoding.DecodeString(metainfo)
-				if err != nil {
-					log.Println("failed to decode metainfo:", err)
-					http.Error(w, "Internal server error", http.StatusInternalServerError)
-					return
-				}
-				transfer, err = putioProxy.UploadTorrent(r.Context(), torrent, dir)
-				if err != nil {
-					log.Println("failed to upload torrent to Put.io:", err)
-					http.Error(w, "Internal server error", http.StatusInternalServerError)
-					return
-				}
-			} else {
-				log.Printf("expected either filename or metainfo arguments. Request: %+v", request)
-				http.Error(w, "Bad request", http.StatusBadRequest)
-				return
-			}
-			result = convertFromPutioTransfer(transfer)
-		case "torrent-get":
-			log.Println("torrent-get")
-			transfers, err := putioProxy.GetTransfers(r.Context())
-			if err != nil {
-				log.Println("failed to list Put.io transfers:", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			torrents := []Torrent{}
-			for _, transfer := range transfers {
-				torrents = append(torrents, convertFromPutioTransfer(transfer))
-			}
-			result = map[string][]Torrent{"torrents": torrents}
-		case "torrent-remove":
-			log.Println("torrent-remove")
-			deleteFiles, transferIDs, err := parseTorrentRemoveArgs(request.Arguments)
-			if err != nil {
-				log.Println("failed to parse arguments:", err)
-				http.Error(w, "Bad request", http.StatusBadRequest)
-				return
-			}
-			err = putioProxy.RemoveTransfers(r.Context(), deleteFiles, transferIDs...)
-			if err != nil {
-				log.Println("failed to remove transfers on Put.io:", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
+		var rpcErr error
+		switch {
+		case !user.allowsMethod(request.Method):
+			rpcErr = fmt.Errorf("user `%s` isn't allowed to call %s", user.Name, request.Method)
+		case request.Method == "torrent-add" && !adds.allow(user.Name, current.Server, time.Now()):
+			rpcErr = fmt.Errorf("user `%s` is adding torrents too fast, try again later", user.Name)
 		default:
-			log.Printf("unexpected method: %+v", request)
-			http.Error(w, "Bad request", http.StatusBadRequest)
-			return
+			result, rpcErr = callRPCMethod(r.Context(), downloadDir, putioProxy, downloader, request)
+		}
+		if rpcErr != nil {
+			// Transmission reports errors in the result string rather than with an HTTP status.
+			log.Printf("%s failed: %s", request.Method, rpcErr)
+			result = nil
 		}
 
 		arguments, err := json.Marshal(result)
@@ -123,7 +179,7 @@ func handlePostRPC(downloadDir string, putioProxy *PutioProxy) http.Handler {
 		}
 
 		response := Response{
-			Result:    "success",
+			Result:    transmissionResult(rpcErr),
 			Arguments: arguments,
 		}
 
@@ -135,55 +191,423 @@ func handlePostRPC(downloadDir string, putioProxy *PutioProxy) http.Handler {
 	})
 }
 
-func parseTorrentRemoveArgs(args map[string]any) (bool, []int64, error) {
-	var transferIDs []int64
+// Calls the RPC method and returns the arguments of its response. Errors are reported to the client as the result
+// string of the response, so they should be descriptive.
+func callRPCMethod(ctx context.Context, downloadDir string, putioProxy *PutioProxy, downloader *Downloader, request Request) (any, error) {
+	switch request.Method {
+	case "session-get":
+		return Session{
+			RPCVersion:  "18",
+			Version:     "14.0.0",
+			DownloadDir: downloadDir,
+		}, nil
+	case "torrent-add":
+		logUnsupportedArguments(request, torrentAddArguments)
 
-	deleteFiles, ok := args["delete-local-data"].(bool)
-	if !ok {
-		return deleteFiles, transferIDs, errors.New("missing `delete-local-data` argument")
-	}
+		// The download-dir argument is an optional string.
+		dir, ok := request.Arguments["download-dir"].(string)
+		if !ok {
+			// Use the default dir when one isn't specified in the request.
+			dir = downloadDir
+		}
+		if user := userFor(ctx); !user.allowsDir(dir) {
+			return nil, fmt.Errorf("user `%s` isn't allowed to add torrents to %s", user.Name, dir)
+		}
 
-	ids, ok := args["ids"].([]any)
-	if !ok {
-		return deleteFiles, transferIDs, errors.New("missing `ids` argument")
-	}
+		metadata := TransferMetadata{
+			Client:   "transmission",
+			User:     userFor(ctx).Name,
+			Category: categoryFromDir(dir, downloadDir),
+		}
+		metadata.Paused, _ = request.Arguments["paused"].(bool)
+		metadata.Labels, _ = parseLabels(request.Arguments)
+		if priority, ok := request.Arguments["bandwidthPriority"].(float64); ok {
+			metadata.Priority = int(priority)
+		}
 
-	for _, id := range ids {
-		hash, ok := id.(string)
+		var transfer Transfer
+		var err error
+		if filename, ok := request.Arguments["filename"].(string); ok {
+			// The filename argument is a string that contains a magnet URL or the URL of a torrent file.
+			cookies, _ := request.Arguments["cookies"].(string)
+			transfer, err = addLink(ctx, putioProxy, filename, cookies, dir, metadata)
+		} else if metainfo, ok := request.Arguments["metainfo"].(string); ok {
+			// The metainfo argument is a string that contains a Base64-encoded torrent file.
+			torrent, decodeErr := base64.StdEncoding.DecodeString(metainfo)
+			if decodeErr != nil {
+				return nil, fmt.Errorf("%w: %w", ErrInvalidTorrent, decodeErr)
+			}
+			transfer, err = putioProxy.UploadTorrent(ctx, torrent, dir, metadata)
+		} else {
+			return nil, errors.New("invalid arguments: expected either filename or metainfo")
+		}
+		// Like Transmission, adding a torrent that was already added succeeds and returns the existing torrent.
+		if errors.Is(err, ErrDuplicateTorrent) && transfer.Transfer != nil {
+			log.Println("torrent-add of a duplicate torrent:", err)
+			return map[string]Torrent{"torrent-duplicate": convertFromPutioTransfer(transfer)}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string]Torrent{"torrent-added": convertFromPutioTransfer(transfer)}, nil
+	case "torrent-get":
+		fields, err := parseTorrentGetFields(request.Arguments)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arguments: %w", err)
+		}
+		ids, recentlyActive, err := parseTorrentIDs(ctx, putioProxy, request.Arguments)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arguments: %w", err)
+		}
+
+		transfers, err := getTransfers(ctx, putioProxy, downloader)
+		if err != nil {
+			return nil, err
+		}
+
+		// Listing the files takes extra Put.io requests, so only do it when they're requested.
+		withFiles := slices.Contains(fields, "files") || slices.Contains(fields, "fileStats")
+
+		torrents := []map[string]json.RawMessage{}
+		for _, transfer := range transfers {
+			if ids != nil && !slices.Contains(ids, transfer.ID) {
+				continue
+			}
+			torrent := convertFromPutioTransfer(transfer)
+			if recentlyActive && !isRecentlyActive(torrent) {
+				continue
+			}
+			if withFiles && transfer.FileID != 0 {
+				files, err := putioProxy.GetFiles(ctx, transfer.FileID)
+				if err != nil {
+					log.Printf("failed to list files of Put.io transfer with ID `%d`: %s", transfer.ID, err)
+				} else {
+					setTorrentFiles(&torrent, files)
+				}
+			}
+			selected, err := selectTorrentFields(torrent, fields)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode torrent: %w", err)
+			}
+			torrents = append(torrents, selected)
+		}
+
+		// Removed torrents aren't tracked, so there are never any to report.
+		if recentlyActive {
+			return map[string]any{"torrents": torrents, "removed": []int64{}}, nil
+		}
+		return map[string]any{"torrents": torrents}, nil
+	case "torrent-remove":
+		// Unlike the other methods, removing torrents requires explicit IDs, so a client can't remove all of them by
+		// mistake.
+		ids, recentlyActive, err := parseTorrentIDs(ctx, putioProxy, request.Arguments)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arguments: %w", err)
+		}
+		if ids == nil || recentlyActive {
+			return nil, errors.New("invalid arguments: missing `ids` argument")
+		}
+		deleteFiles, _ := request.Arguments["delete-local-data"].(bool)
+		return nil, removeTransfers(ctx, putioProxy, downloader, deleteFiles, ids...)
+	case "torrent-start", "torrent-start-now":
+		ids, err := resolveTorrentIDs(ctx, putioProxy, request.Arguments)
+		if err != nil {
+			return nil, err
+		}
+		// Put.io transfers can't be paused, so starting a torrent only does something when it was added paused, or when
+		// it failed.
+		return nil, putioProxy.StartTransfers(ctx, ids...)
+	case "torrent-stop":
+		// Stopping requires explicit IDs too, so a client can't stop all the torrents by mistake.
+		if _, ok := request.Arguments["ids"]; !ok {
+			return nil, errors.New("invalid arguments: missing `ids` argument")
+		}
+		ids, err := resolveTorrentIDs(ctx, putioProxy, request.Arguments)
+		if err != nil {
+			return nil, err
+		}
+		return nil, putioProxy.StopTransfers(ctx, ids...)
+	case "torrent-set":
+		ids, err := resolveTorrentIDs(ctx, putioProxy, request.Arguments)
+		if err != nil {
+			return nil, err
+		}
+		// Labels and bandwidth priorities are the only settings Putarr keeps track of. The others, e.g., speed limits,
+		// have no equivalent.
+		if labels, ok := parseLabels(request.Arguments); ok {
+			for _, id := range ids {
+				if err := putioProxy.SetLabels(id, labels); err != nil {
+					return nil, fmt.Errorf("failed to set labels: %w", err)
+				}
+			}
+		}
+		if priority, ok := request.Arguments["bandwidthPriority"].(float64); ok {
+			for _, id := range ids {
+				if err := putioProxy.SetBandwidthPriority(id, int(priority)); err != nil {
+					return nil, fmt.Errorf("failed to set bandwidth priority: %w", err)
+				}
+			}
+		}
+		return nil, nil
+	case "torrent-set-location":
+		location, ok := request.Arguments["location"].(string)
 		if !ok {
-			return deleteFiles, transferIDs, fmt.Errorf("unrecognied ID type: %v", hash)
+			return nil, errors.New("invalid arguments: missing `location` argument")
+		}
+		if user := userFor(ctx); !user.allowsDir(location) {
+			return nil, fmt.Errorf("user `%s` isn't allowed to move torrents to %s", user.Name, location)
 		}
-		transferID, err := ParseTorrentHash(hash)
+		ids, err := resolveTorrentIDs(ctx, putioProxy, request.Arguments)
 		if err != nil {
-			return deleteFiles, transferIDs, fmt.Errorf("failed to parse torrent hash: %w", err)
+			return nil, err
+		}
+		// Like Transmission, the files are only moved when asked to; otherwise only the recorded location changes.
+		move, _ := request.Arguments["move"].(bool)
+		return nil, putioProxy.MoveTransfers(ctx, location, move, ids...)
+	case "torrent-rename-path":
+		oldPath, _ := request.Arguments["path"].(string)
+		name, _ := request.Arguments["name"].(string)
+		ids, err := resolveTorrentIDs(ctx, putioProxy, request.Arguments)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) != 1 {
+			return nil, errors.New("invalid arguments: expected exactly one torrent ID")
+		}
+		if err := putioProxy.RenameTransferPath(ctx, ids[0], oldPath, name); err != nil {
+			return nil, err
+		}
+		return map[string]any{"id": ids[0], "path": oldPath, "name": name}, nil
+	case "session-set":
+		// The session settings are Put.io's to manage, so accept them and carry on.
+		return nil, nil
+	case "session-stats":
+		transfers, err := getTransfers(ctx, putioProxy, downloader)
+		if err != nil {
+			return nil, err
+		}
+		return computeSessionStats(transfers), nil
+	case "free-space":
+		dir, _ := request.Arguments["path"].(string)
+		avail, size, err := putioProxy.GetDiskSpace(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Every path is on Put.io, so they all share the disk quota of the account.
+		return FreeSpace{Path: dir, SizeBytes: avail, TotalSize: size}, nil
+	case "torrent-verify", "port-test", "blocklist-update":
+		return nil, fmt.Errorf("%s is not supported by Put.io", request.Method)
+	default:
+		return nil, errors.New("method name not recognized")
+	}
+}
+
+// Adds the magnet link, or the torrent file at the HTTP(S) URL. Put.io might not be able to reach the tracker or
+// authenticate to it, so torrent files are fetched by Putarr instead, with the cookies, if any.
+func addLink(ctx context.Context, putioProxy *PutioProxy, link, cookies, dir string, metadata TransferMetadata) (Transfer, error) {
+	if isHTTPURL(link) {
+		return putioProxy.AddTorrentURL(ctx, link, cookies, dir, metadata)
+	}
+	return putioProxy.AddTransfer(ctx, link, dir, metadata)
+}
+
+// Arguments of torrent-add that Putarr handles. Transmission supports a few more, e.g., peer-limit and files-wanted,
+// which have no equivalent on Put.io.
+var torrentAddArguments = []string{"filename", "metainfo", "download-dir", "paused", "labels", "cookies",
+	"bandwidthPriority"}
+
+// Logs the arguments of the request that Putarr doesn't handle, so they aren't silently dropped.
+func logUnsupportedArguments(request Request, supported []string) {
+	for name := range request.Arguments {
+		if !slices.Contains(supported, name) {
+			log.Printf("%s: ignoring unsupported argument `%s`", request.Method, name)
 		}
-		transferIDs = append(transferIDs, transferID)
 	}
+}
 
-	return deleteFiles, transferIDs, nil
+// Parses the labels argument, which is a list of strings. Returns false when the argument is missing.
+func parseLabels(args map[string]any) ([]string, bool) {
+	values, ok := args["labels"].([]any)
+	if !ok {
+		return nil, false
+	}
+	labels := []string{}
+	for _, value := range values {
+		if label, ok := value.(string); ok {
+			labels = append(labels, label)
+		}
+	}
+	return labels, true
 }
 
-// BasicAuthMiddleware fails requests that are missing the correct Basic Auth credentials.
-func basicAuthMiddleware(username, password string, next http.Handler) http.Handler {
+// BasicAuthMiddleware fails requests that are missing the Basic Auth credentials of a user, and records the user in
+// the context of the others. Clients that keep failing to log in have to wait, and are eventually locked out.
+func basicAuthMiddleware(config ConfigSource, auth *authenticator, logins *loginLimiter, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || user != username || pass != password {
+		current := configFor(r.Context(), config)
+		client := clientIP(r, current.Server)
+		if wait := logins.wait(client, current.Server, time.Now()); wait > 0 {
+			setRetryAfter(w, wait)
+			http.Error(w, "Too many failed logins", http.StatusTooManyRequests)
+			return
+		}
+
+		name, password, ok := r.BasicAuth()
+		user, authenticated := auth.authenticate(current.Transmission, name, password)
+		if !ok || !authenticated {
+			// Clients make a first request without credentials to find out they're required, so it isn't a failure.
+			if ok {
+				log.Printf("failed login for user `%s` from %s", name, client)
+				logins.fail(client, current.Server, time.Now())
+			}
 			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		next.ServeHTTP(w, r)
+		logins.succeed(client)
+		next.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
 	})
 }
 
-// DumbSessionMiddleware fails requests that are missing the specified token. The error specifies the expected token.
-func dumbSessionMiddleware(token string, next http.Handler) http.Handler {
+// TransmissionSessionMiddleware fails requests that don't have a valid session ID, like Transmission does. Every response
+// has the current session ID, so clients pick up a rotated ID on their next conflict.
+func transmissionSessionMiddleware(config ConfigSource, sessions *transmissionSessions, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("X-Transmission-Session-Id") != token {
-			w.Header().Add("X-Transmission-Session-Id", token)
+		transmission := configFor(r.Context(), config).Transmission
+		current, ok, err := sessions.validate(r.Header.Get("X-Transmission-Session-Id"), transmission, time.Now())
+		if err != nil {
+			log.Println("failed to create session ID:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Transmission-Session-Id", current)
+		if !ok {
 			http.Error(w, "Conflict", http.StatusConflict)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Returns the path of the directory relative to the download directory, which is empty for the download directory
+// itself. Only the download directory and the paths under it are in it, e.g., /putarr/movies but not /putarr-other.
+func cutDownloadDir(dir, downloadDir string) (string, bool) {
+	if dir == downloadDir {
+		return "", true
+	}
+	return strings.CutPrefix(dir, strings.TrimSuffix(downloadDir, "/")+"/")
+}
+
+// Categories map to the sub-directories of the download directory, so the category of a transfer is the first
+// sub-directory of its download directory, if any.
+func categoryFromDir(dir, downloadDir string) string {
+	subpath, ok := cutDownloadDir(dir, downloadDir)
+	if !ok {
+		return ""
+	}
+	category, _, _ := strings.Cut(subpath, "/")
+	return category
+}
+
+func dirFromCategory(category, downloadDir string) string {
+	if category == "" {
+		return downloadDir
+	}
+	return path.Join(downloadDir, category)
+}
+
+func parseTorrentGetFields(args map[string]any) ([]string, error) {
+	var fields []string
+	if args["fields"] == nil {
+		return fields, nil
+	}
+	values, ok := args["fields"].([]any)
+	if !ok {
+		return fields, errors.New("invalid `fields` argument")
+	}
+	for _, value := range values {
+		field, ok := value.(string)
+		if !ok {
+			return fields, fmt.Errorf("unrecognized field type: %v", value)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Parses the ids argument, which is either a single torrent ID, a list of torrent IDs and hashes, or the
+// "recently-active" string. Returns nil IDs when the argument is missing, which selects all the torrents.
+func parseTorrentIDs(ctx context.Context, putioProxy *PutioProxy, args map[string]any) ([]int64, bool, error) {
+	var ids []int64
+
+	switch value := args["ids"].(type) {
+	case nil:
+		return nil, false, nil
+	case string:
+		if value == "recently-active" {
+			return nil, true, nil
+		}
+		id, err := putioProxy.ParseTorrentHash(ctx, value)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse torrent hash: %w", err)
+		}
+		return []int64{id}, false, nil
+	case float64:
+		return []int64{putioProxy.resolveID(int64(value))}, false, nil
+	case []any:
+		for _, item := range value {
+			switch item := item.(type) {
+			case float64:
+				ids = append(ids, putioProxy.resolveID(int64(item)))
+			case string:
+				id, err := putioProxy.ParseTorrentHash(ctx, item)
+				if err != nil {
+					return nil, false, fmt.Errorf("failed to parse torrent hash: %w", err)
+				}
+				ids = append(ids, id)
+			default:
+				return nil, false, fmt.Errorf("unrecognized ID type: %v", item)
+			}
+		}
+		// An empty list selects no torrents, unlike a missing argument.
+		if ids == nil {
+			ids = []int64{}
+		}
+		return ids, false, nil
+	default:
+		return nil, false, fmt.Errorf("unrecognized ids argument: %v", value)
+	}
+}
+
+// Resolves the ids argument of the methods that act on torrents. Like Transmission, a missing argument selects all
+// the torrents.
+func resolveTorrentIDs(ctx context.Context, putioProxy *PutioProxy, args map[string]any) ([]int64, error) {
+	ids, recentlyActive, err := parseTorrentIDs(ctx, putioProxy, args)
+	if err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if ids != nil && !recentlyActive {
+		return ids, checkTransfersAllowed(ctx, putioProxy, ids)
+	}
+
+	transfers, err := getTransfers(ctx, putioProxy, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Put.io transfers: %w", err)
+	}
+	ids = []int64{}
+	for _, transfer := range transfers {
+		if recentlyActive && !isRecentlyActive(convertFromPutioTransfer(transfer)) {
+			continue
+		}
+		ids = append(ids, transfer.ID)
+	}
+	return ids, nil
+}
+
+// Torrents are recently active when they're still in progress, or finished within the last minute.
+func isRecentlyActive(torrent Torrent) bool {
+	if torrent.Status != TorrentStatusStopped {
+		return true
+	}
+	return torrent.DoneDate != 0 && time.Since(time.Unix(torrent.DoneDate, 0)) < time.Minute
+}
@@ -2,15 +2,21 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"maps"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/albertb/putarr/internal/fakes"
 	"github.com/google/go-cmp/cmp"
@@ -26,7 +32,6 @@ func TestTransmissionRPC_AuthAndSessionMiddleware(t *testing.T) {
 	var (
 		username = "azure"
 		password = "hunter2"
-		token    = "whatever"
 	)
 
 	config := &Config{
@@ -38,10 +43,15 @@ func TestTransmissionRPC_AuthAndSessionMiddleware(t *testing.T) {
 	fakePutio := fakes.NewFakePutio()
 	defer fakePutio.Close()
 
-	server := httptest.NewServer(NewServer(config, token,
-		NewPutioProxy(config, fakePutio.NewClient())))
+	server := httptest.NewServer(NewServer(config,
+		NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
 	defer server.Close()
 
+	token := getSessionID(t, config, server.URL)
+	if len(token) < 32 {
+		t.Fatalf("got session ID %q, want a random one", token)
+	}
+
 	for _, tt := range []struct {
 		explanation string
 		method      string
@@ -162,7 +172,6 @@ func TestTransmissionRPC_GetSession(t *testing.T) {
 	var (
 		username    = "azure"
 		password    = "hunter2"
-		token       = "whatever"
 		downloadDir = "/putarr"
 	)
 
@@ -176,11 +185,11 @@ func TestTransmissionRPC_GetSession(t *testing.T) {
 	fakePutio := fakes.NewFakePutio()
 	defer fakePutio.Close()
 
-	server := httptest.NewServer(NewServer(config, token,
-		NewPutioProxy(config, fakePutio.NewClient())))
+	server := httptest.NewServer(NewServer(config,
+		NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
 	defer server.Close()
 
-	got := doRPCAndExpectOK[Session](t, config, server.URL, token, "session-get", nil)
+	got := doRPCAndExpectOK[Session](t, config, server.URL, "session-get", nil)
 	want := Session{
 		RPCVersion:  "18",
 		Version:     "14.0.0",
@@ -196,7 +205,6 @@ func TestTransmissionRPC_TorrentAddWithBadDir(t *testing.T) {
 	var (
 		username    = "azure"
 		password    = "hunter2"
-		token       = "whatever"
 		downloadDir = "/putarr"
 	)
 
@@ -216,16 +224,20 @@ func TestTransmissionRPC_TorrentAddWithBadDir(t *testing.T) {
 	}
 	config.Putio.ParentDirID = folder.ID
 
-	server := httptest.NewServer(NewServer(config, token,
-		NewPutioProxy(config, fakePutio.NewClient())))
+	server := httptest.NewServer(NewServer(config,
+		NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
 	defer server.Close()
 
 	// Attempting to start a download with a download-dir that isn't a child of the configured download-dir should
-	// result in a failure.
-	doRPCAndExpectCode[Torrent](t, config, server.URL, token, "torrent-add", map[string]any{
+	// result in a failure. Like Transmission, the failure is reported in the result rather than with an HTTP status.
+	doRPCAndExpectResult(t, config, server.URL, "torrent-add", map[string]any{
 		"filename":     "magnet:?xt=urn:btih:AAA&dn=foo",
 		"download-dir": "/whatever"},
-		http.StatusInternalServerError)
+		"failed to create download directory: invalid download directory `/whatever`: must be a subdirectory of `/putarr`")
+	doRPCAndExpectResult(t, config, server.URL, "torrent-add", map[string]any{
+		"filename":     "magnet:?xt=urn:btih:AAA&dn=foo",
+		"download-dir": "/putarr-other"},
+		"failed to create download directory: invalid download directory `/putarr-other`: must be a subdirectory of `/putarr`")
 }
 
 func mapTorrentsByID(torrents []Torrent) map[int]*Torrent {
@@ -245,7 +257,6 @@ func TestTransmissionRPC_TorrentAddGetRemove(t *testing.T) {
 	var (
 		username    = "azure"
 		password    = "hunter2"
-		token       = "whatever"
 		downloadDir = "/putarr"
 	)
 
@@ -266,12 +277,12 @@ func TestTransmissionRPC_TorrentAddGetRemove(t *testing.T) {
 	}
 	config.Putio.ParentDirID = folder.ID
 
-	server := httptest.NewServer(NewServer(config, token,
-		NewPutioProxy(config, fakePutio.NewClient())))
+	server := httptest.NewServer(NewServer(config,
+		NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
 	defer server.Close()
 
 	// Initially the list of torrents is empty.
-	torrents := doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, token, "torrent-get", nil)
+	torrents := doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
 
 	_, ok := torrents["torrents"]
 	if got, want := ok, true; got != want {
@@ -282,18 +293,18 @@ func TestTransmissionRPC_TorrentAddGetRemove(t *testing.T) {
 	}
 
 	// Add three torrents.
-	torrent1 := doRPCAndExpectOK[Torrent](t, config, server.URL, token, "torrent-add", map[string]any{
+	torrent1 := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
 		"filename":     "magnet:?xt=urn:btih:AAA&dn=foo",
-		"download-dir": "/putarr/tv-sonarr"})
-	torrent2 := doRPCAndExpectOK[Torrent](t, config, server.URL, token, "torrent-add", map[string]any{
+		"download-dir": "/putarr/tv-sonarr"})["torrent-added"]
+	torrent2 := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
 		"filename":     "magnet:?xt=urn:btih:BBB&dn=bar",
-		"download-dir": "/putarr/tv-sonarr/whatever"})
-	torrent3 := doRPCAndExpectOK[Torrent](t, config, server.URL, token, "torrent-add", map[string]any{
+		"download-dir": "/putarr/tv-sonarr/whatever"})["torrent-added"]
+	torrent3 := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
 		"filename":     "magnet:?xt=urn:btih:CCC&dn=baz",
-		"download-dir": "/putarr/tv-sonarr"})
+		"download-dir": "/putarr/tv-sonarr"})["torrent-added"]
 
 	// We should get a list of three torrents back.
-	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, token, "torrent-get", nil)
+	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
 
 	if got, want := len(torrents["torrents"]), 3; got != want {
 		t.Fatalf("got a list of %v torrents, want %v", got, want)
@@ -333,7 +344,7 @@ func TestTransmissionRPC_TorrentAddGetRemove(t *testing.T) {
 	fileID, _ := fakePutio.SetTransferCompleted(int64(torrent2.ID))
 
 	// Get the list again, the second torrent should be completed.
-	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, token, "torrent-get", nil)
+	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
 
 	if got, want := len(torrents["torrents"]), 3; got != want {
 		t.Fatalf("got a list of %v torrents, want %v", got, want)
@@ -355,26 +366,26 @@ func TestTransmissionRPC_TorrentAddGetRemove(t *testing.T) {
 	}
 
 	// Remove the first torrent.
-	doRPCAndExpectOK[any](t, config, server.URL, token, "torrent-remove", map[string]any{
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-remove", map[string]any{
 		"delete-local-data": true,
 		"ids":               []string{*torrent1.HashString},
 	})
 
 	// Get the list again, it should now just have two torrents.
-	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, token, "torrent-get", nil)
+	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
 	torrentsByID = mapTorrentsByID(torrents["torrents"])
 	if got, want := slices.Collect(maps.Keys(torrentsByID)), []int{torrent2.ID, torrent3.ID}; !cmp.Equal(got, want, sliceOpts) {
 		t.Fatalf("got torrent IDs %v, want %v", got, want)
 	}
 
 	// Remove the last two torrents.
-	doRPCAndExpectOK[any](t, config, server.URL, token, "torrent-remove", map[string]any{
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-remove", map[string]any{
 		"delete-local-data": true,
 		"ids":               []string{*torrent2.HashString, *torrent3.HashString},
 	})
 
 	// Get the list again, it should now be empty.
-	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, token, "torrent-get", nil)
+	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
 	if got, want := len(torrents["torrents"]), 0; got != want {
 		t.Fatalf("got len(torrents) %v, want %v", got, want)
 	}
@@ -389,7 +400,6 @@ func TestTransmissionRPC_TorrentAddGetWithFriendToken(t *testing.T) {
 	var (
 		username = "azure"
 		password = "hunter2"
-		token    = "whatever"
 	)
 
 	fakePutio := fakes.NewFakePutio()
@@ -426,73 +436,94 @@ func TestTransmissionRPC_TorrentAddGetWithFriendToken(t *testing.T) {
 	configB.Putio.ParentDirID = folderB.ID
 
 	// Setup two putarr servers that share the same Put.io account, but use the two different friend tokens.
-	serverA := httptest.NewServer(NewServer(configA, token,
-		NewPutioProxy(configA, fakePutio.NewClient())))
+	serverA := httptest.NewServer(NewServer(configA,
+		NewPutioProxy(configA, fakePutio.NewClient(), nil), nil))
 	defer serverA.Close()
 
-	serverB := httptest.NewServer(NewServer(configB, token,
-		NewPutioProxy(configB, fakePutio.NewClient())))
+	serverB := httptest.NewServer(NewServer(configB,
+		NewPutioProxy(configB, fakePutio.NewClient(), nil), nil))
 	defer serverB.Close()
 
 	// Initially the list of torrents is empty for both servers.
-	torrentsA := doRPCAndExpectOK[map[string][]Torrent](t, configA, serverA.URL, token, "torrent-get", nil)
+	torrentsA := doRPCAndExpectOK[map[string][]Torrent](t, configA, serverA.URL, "torrent-get", nil)
 	if got, want := len(torrentsA["torrents"]), 0; got != want {
 		t.Fatalf("got %d torrents, want %d", got, want)
 	}
-	torrentsB := doRPCAndExpectOK[map[string][]Torrent](t, configB, serverB.URL, token, "torrent-get", nil)
+	torrentsB := doRPCAndExpectOK[map[string][]Torrent](t, configB, serverB.URL, "torrent-get", nil)
 	if got, want := len(torrentsB["torrents"]), 0; got != want {
 		t.Fatalf("got %d torrents, want %d", got, want)
 	}
 
 	// Add a torrent through serverA.
-	torrentA := doRPCAndExpectOK[Torrent](t, configA, serverA.URL, token, "torrent-add", map[string]any{
+	torrentA := doRPCAndExpectOK[map[string]Torrent](t, configA, serverA.URL, "torrent-add", map[string]any{
 		"filename":     "magnet:?xt=urn:btih:AAA&dn=foo",
-		"download-dir": "/aaa/tv-sonarr"})
+		"download-dir": "/aaa/tv-sonarr"})["torrent-added"]
 
 	// Make sure serverA lists the new torrent.
-	torrentsA = doRPCAndExpectOK[map[string][]Torrent](t, configA, serverA.URL, token, "torrent-get", nil)
+	torrentsA = doRPCAndExpectOK[map[string][]Torrent](t, configA, serverA.URL, "torrent-get", nil)
 	if got, want := slices.Collect(maps.Keys(mapTorrentsByID(torrentsA["torrents"]))), []int{torrentA.ID}; !cmp.Equal(got, want, sliceOpts) {
 		t.Fatalf("got torrents with IDs %v, want %v", got, want)
 	}
 
 	// ServerB is still empty.
-	torrentsB = doRPCAndExpectOK[map[string][]Torrent](t, configB, serverB.URL, token, "torrent-get", nil)
+	torrentsB = doRPCAndExpectOK[map[string][]Torrent](t, configB, serverB.URL, "torrent-get", nil)
 	if got, want := len(torrentsB["torrents"]), 0; got != want {
 		t.Fatalf("got %d torrents, want %d", got, want)
 	}
 
 	// Next add a torrent through serverB.
-	torrentB := doRPCAndExpectOK[Torrent](t, configB, serverB.URL, token, "torrent-add", map[string]any{
+	torrentB := doRPCAndExpectOK[map[string]Torrent](t, configB, serverB.URL, "torrent-add", map[string]any{
 		"filename":     "magnet:?xt=urn:btih:BBB&dn=foo",
-		"download-dir": "/bbb/tv-sonarr"})
+		"download-dir": "/bbb/tv-sonarr"})["torrent-added"]
 
 	// ServerA should only list its own torrent.
-	torrentsA = doRPCAndExpectOK[map[string][]Torrent](t, configA, serverA.URL, token, "torrent-get", nil)
+	torrentsA = doRPCAndExpectOK[map[string][]Torrent](t, configA, serverA.URL, "torrent-get", nil)
 	if got, want := slices.Collect(maps.Keys(mapTorrentsByID(torrentsA["torrents"]))), []int{torrentA.ID}; !cmp.Equal(got, want, sliceOpts) {
 		t.Fatalf("got torrents with IDs %v, want %v", got, want)
 	}
 
 	// And ServerB should list the new torrent.
-	torrentsB = doRPCAndExpectOK[map[string][]Torrent](t, configB, serverB.URL, token, "torrent-get", nil)
+	torrentsB = doRPCAndExpectOK[map[string][]Torrent](t, configB, serverB.URL, "torrent-get", nil)
 	if got, want := slices.Collect(maps.Keys(mapTorrentsByID(torrentsB["torrents"]))), []int{torrentB.ID}; !cmp.Equal(got, want, sliceOpts) {
 		t.Fatalf("got torrents with IDs %v, want %v", got, want)
 	}
 }
 
+// Returns a server of the torrent file with the given name, like the one of a tracker. When a cookie is given, e.g.,
+// uid=42, the file is only served to the clients that send it.
+func newTorrentFileServer(t *testing.T, name, cookie string) *httptest.Server {
+	t.Helper()
+	var torrent bytes.Buffer
+	if err := bencode.Marshal(&torrent, TorrentFile{Info: TorrentFileInfo{Name: name, Length: 123, PieceLength: 16384}}); err != nil {
+		t.Fatalf("failed to marshal torrent: %s", err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie != "" {
+			name, value, _ := strings.Cut(cookie, "=")
+			if got, err := r.Cookie(name); err != nil || got.Value != value {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		w.Write(torrent.Bytes())
+	}))
+}
+
 type TorrentFile struct {
 	Announce string          `bencode:"announce"`
 	Info     TorrentFileInfo `bencode:"info"`
 }
 type TorrentFileInfo struct {
-	Name   string `bencode:"name"`
-	Length int64  `bencode:"length"`
+	Name        string `bencode:"name"`
+	Length      int64  `bencode:"length"`
+	PieceLength int64  `bencode:"piece length"`
+	Pieces      string `bencode:"pieces"`
 }
 
 func TestTransmissionRPC_TorrentAddWithTorrentFile(t *testing.T) {
 	var (
 		username    = "azure"
 		password    = "hunter2"
-		token       = "whatever"
 		downloadDir = "/putarr"
 	)
 
@@ -513,16 +544,17 @@ func TestTransmissionRPC_TorrentAddWithTorrentFile(t *testing.T) {
 	config.Putio.ParentDirID = folder.ID
 
 	server := httptest.NewServer(
-		NewServer(config, token,
-			NewPutioProxy(config, fakePutio.NewClient())))
+		NewServer(config,
+			NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
 	defer server.Close()
 
 	// A minimal torrent file.
 	torrent := TorrentFile{
 		Announce: "example.org/tracker",
 		Info: TorrentFileInfo{
-			Name:   "example.filename",
-			Length: 123456,
+			Name:        "example.filename",
+			Length:      123456,
+			PieceLength: 16384,
 		},
 	}
 
@@ -532,9 +564,9 @@ func TestTransmissionRPC_TorrentAddWithTorrentFile(t *testing.T) {
 		t.Fatalf("failed to marshal torrent: %s", err)
 	}
 
-	added := doRPCAndExpectOK[Torrent](t, config, server.URL, token, "torrent-add", map[string]any{
+	added := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
 		"metainfo":     base64.StdEncoding.EncodeToString(buf.Bytes()),
-		"download-dir": "/putarr/tv-sonarr"})
+		"download-dir": "/putarr/tv-sonarr"})["torrent-added"]
 
 	// There's not much we can easily test at this level, but at least make sure the name and length of the transfer on
 	// Put.io after all the conversions matches the ones in the torrent file.
@@ -546,14 +578,426 @@ func TestTransmissionRPC_TorrentAddWithTorrentFile(t *testing.T) {
 	}
 }
 
-func doRPCAndExpectOK[T any](t *testing.T, config *Config, baseURL string, token string, method string, args map[string]any) T {
+func TestTransmissionRPC_TorrentAddUploadsTorrentFile(t *testing.T) {
+	const (
+		username    = "admin"
+		password    = "hunter2"
+		downloadDir = "/putarr"
+	)
+
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    username,
+			Password:    password,
+			DownloadDir: downloadDir,
+		},
+		Putio: PutioConfig{
+			UploadTorrents: UploadTorrentsConfig{
+				DownloadDirs: []string{"/putarr/private/"},
+				Labels:       []string{"private"},
+			},
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "transfers.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	putioClient := fakePutio.NewClient()
+	server := httptest.NewServer(NewServer(config, NewPutioProxy(config, putioClient, store), nil))
+	defer server.Close()
+
+	addTorrent := func(name, dir string, labels []string) ([]byte, map[string]Torrent) {
+		t.Helper()
+		var buf bytes.Buffer
+		err := bencode.Marshal(&buf, TorrentFile{
+			Announce: "https://tracker.example.org/announce?passkey=secret",
+			Info:     TorrentFileInfo{Name: name, Length: 123, PieceLength: 16384},
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal torrent: %s", err)
+		}
+		added := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+			"metainfo":     base64.StdEncoding.EncodeToString(buf.Bytes()),
+			"download-dir": dir,
+			"labels":       labels})
+		return buf.Bytes(), added
+	}
+
+	// Torrents are uploaded as is when they're in a configured download directory or have a configured label.
+	tests := []struct {
+		name     string
+		dir      string
+		labels   []string
+		uploaded bool
+	}{
+		{"in-private-dir", "/putarr/private/sonarr", nil, true},
+		{"with-private-label", "/putarr/radarr", []string{"hd", "private"}, true},
+		{"public", "/putarr/privateer", []string{"hd"}, false},
+	}
+	added := map[int]Torrent{}
+	for _, tt := range tests {
+		file, result := addTorrent(tt.name, tt.dir, tt.labels)
+		torrent := result["torrent-added"]
+		torrent.DownloadDir = tt.dir
+		added[torrent.ID] = torrent
+
+		// The torrent file isn't needed once the transfer is on Put.io, so it's not kept in the store.
+		if metadata, _ := store.Get(int64(torrent.ID)); metadata.Torrent != nil {
+			t.Errorf("%s: the torrent file was kept in the store", tt.name)
+		}
+
+		transfer, err := putioClient.Transfers.Get(context.Background(), int64(torrent.ID))
+		if err != nil {
+			t.Fatalf("failed to get Put.io transfer: %s", err)
+		}
+		uploaded, ok := fakePutio.GetUploadedTorrent(int64(torrent.ID))
+		if got, want := ok, tt.uploaded; got != want {
+			t.Fatalf("%s: got uploaded %v, want %v", tt.name, got, want)
+		}
+		if !tt.uploaded {
+			continue
+		}
+		if !bytes.Equal(uploaded, file) {
+			t.Errorf("%s: the uploaded torrent doesn't match the original one", tt.name)
+		}
+		if got, want := transfer.CallbackURL, ""; got != want {
+			t.Errorf("%s: got callback URL %q, want %q", tt.name, got, want)
+		}
+		if got, want := transfer.SaveParentID, folder.ID; got == want {
+			t.Errorf("%s: got parent ID %d, want a sub-directory of %d", tt.name, got, want)
+		}
+	}
+
+	// The uploaded torrents are listed like the others, with their download directory and info hash.
+	torrents := mapTorrentsByID(doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get",
+		nil)["torrents"])
+	if got, want := len(torrents), len(tests); got != want {
+		t.Fatalf("got %d torrents, want %d", got, want)
+	}
+	for id, want := range added {
+		got, ok := torrents[id]
+		if !ok {
+			t.Fatalf("missing torrent with ID %d", id)
+		}
+		if got, want := got.DownloadDir, want.DownloadDir; got != want {
+			t.Errorf("got download dir %q for torrent %d, want %q", got, id, want)
+		}
+		if got, want := got.HashString, want.HashString; !cmp.Equal(got, want) {
+			t.Errorf("got hash %v for torrent %d, want %v", *got, id, *want)
+		}
+	}
+
+	// Adding an uploaded torrent again is a duplicate, and it can be removed.
+	_, result := addTorrent("in-private-dir", "/putarr/private/sonarr", nil)
+	if _, ok := result["torrent-duplicate"]; !ok {
+		t.Fatalf("got %v, want a duplicate torrent", result)
+	}
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-remove", map[string]any{
+		"delete-local-data": true,
+		"ids":               []string{*result["torrent-duplicate"].HashString},
+	})
+	torrents = mapTorrentsByID(doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get",
+		nil)["torrents"])
+	if got, want := len(torrents), len(tests)-1; got != want {
+		t.Fatalf("got %d torrents after removing one, want %d", got, want)
+	}
+}
+
+func TestTransmissionRPC_TorrentAddDuplicate(t *testing.T) {
+	const (
+		username    = "admin"
+		password    = "hunter2"
+		downloadDir = "/putarr"
+	)
+
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    username,
+			Password:    password,
+			DownloadDir: downloadDir,
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	server := httptest.NewServer(
+		NewServer(config,
+			NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
+	defer server.Close()
+
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	added := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"filename":     "magnet:?xt=urn:btih:" + hash + "&dn=foo",
+		"download-dir": "/putarr/tv-sonarr"})["torrent-added"]
+
+	// Adding the same info hash again, even in its base32 form, returns the existing transfer.
+	decoded, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatalf("failed to decode hash: %s", err)
+	}
+	response := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"filename":     "magnet:?xt=urn:btih:" + base32.StdEncoding.EncodeToString(decoded) + "&dn=foo",
+		"download-dir": "/putarr/tv-sonarr"})
+	if _, ok := response["torrent-added"]; ok {
+		t.Fatalf("got torrent-added for a duplicate magnet, want torrent-duplicate")
+	}
+	if got, want := response["torrent-duplicate"].ID, added.ID; got != want {
+		t.Fatalf("got duplicate torrent ID %d, want %d", got, want)
+	}
+
+	// The info hash of a torrent file is computed from its info dictionary.
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, TorrentFile{Info: TorrentFileInfo{Name: "example.filename", Length: 123456, PieceLength: 16384}})
+	if err != nil {
+		t.Fatalf("failed to marshal torrent: %s", err)
+	}
+	metainfo := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	uploaded := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"metainfo": metainfo})["torrent-added"]
+	if uploaded.ID == added.ID {
+		t.Fatalf("got the same ID %d for different torrents", uploaded.ID)
+	}
+	response = doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"metainfo": metainfo})
+	if got, want := response["torrent-duplicate"].ID, uploaded.ID; got != want {
+		t.Fatalf("got duplicate torrent ID %d, want %d", got, want)
+	}
+
+	// Only two transfers were created on Put.io.
+	torrents := doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
+	if got, want := len(torrents["torrents"]), 2; got != want {
+		t.Fatalf("got %d torrents, want %d", got, want)
+	}
+}
+
+func TestTransmissionRPC_InfoHashes(t *testing.T) {
+	const (
+		username    = "admin"
+		password    = "hunter2"
+		downloadDir = "/putarr"
+	)
+
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    username,
+			Password:    password,
+			DownloadDir: downloadDir,
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), nil)
+	server := httptest.NewServer(NewServer(config, putioProxy, nil))
+	defer server.Close()
+
+	// Transfers added before Putarr reported info hashes only know their download directory, and keep their Putarr ID.
+	callbackURL, err := putioProxy.formatCallbackURL(extraState{DownloadDir: downloadDir})
+	if err != nil {
+		t.Fatalf("failed to format callback URL: %s", err)
+	}
+	legacy, err := fakePutio.NewClient().Transfers.Add(context.Background(),
+		"magnet:?xt=urn:btih:89abcdef0123456789abcdef0123456789abcdef&dn=legacy", folder.ID, callbackURL)
+	if err != nil {
+		t.Fatalf("failed to add legacy transfer: %s", err)
+	}
+
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	added := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"filename": "magnet:?xt=urn:btih:" + strings.ToUpper(hash) + "&dn=foo"})["torrent-added"]
+	if got, want := *added.HashString, hash; got != want {
+		t.Fatalf("got hashString %s, want %s", got, want)
+	}
+
+	torrents := doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
+	torrentsByID := mapTorrentsByID(torrents["torrents"])
+	for id, want := range map[int]string{
+		added.ID:       hash,
+		int(legacy.ID): FormatTorrentHash(legacy.ID),
+	} {
+		if got := *torrentsByID[id].HashString; got != want {
+			t.Errorf("got torrent[%d].HashString = %s, want %s", id, got, want)
+		}
+	}
+
+	// Both forms of hashes select torrents, whatever their case.
+	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", map[string]any{
+		"ids": []any{strings.ToUpper(hash), FormatTorrentHash(legacy.ID)}})
+	if got, want := slices.Collect(maps.Keys(mapTorrentsByID(torrents["torrents"]))), []int{added.ID, int(legacy.ID)}; !cmp.Equal(got, want, sliceOpts) {
+		t.Fatalf("got torrent IDs %v, want %v", got, want)
+	}
+
+	// After a restart, the info hashes are looked up in the transfers.
+	restarted := NewPutioProxy(config, fakePutio.NewClient(), nil)
+	if id, err := restarted.ParseTorrentHash(context.Background(), hash); err != nil || id != int64(added.ID) {
+		t.Fatalf("got ID %d and error %v parsing the hash after a restart, want %d", id, err, added.ID)
+	}
+
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-remove", map[string]any{
+		"delete-local-data": false,
+		"ids":               []string{hash},
+	})
+	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
+	if got, want := slices.Collect(maps.Keys(mapTorrentsByID(torrents["torrents"]))), []int{int(legacy.ID)}; !cmp.Equal(got, want) {
+		t.Fatalf("got torrent IDs %v, want %v", got, want)
+	}
+
+	// The hash of the removed torrent is forgotten.
+	if _, err := putioProxy.ParseTorrentHash(context.Background(), hash); err == nil {
+		t.Fatalf("got no error parsing the hash of a removed torrent")
+	}
+}
+
+func TestTransmissionRPC_TorrentAddArguments(t *testing.T) {
+	const (
+		username    = "admin"
+		password    = "hunter2"
+		downloadDir = "/putarr"
+	)
+
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    username,
+			Password:    password,
+			DownloadDir: downloadDir,
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "transfers.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	putioClient := fakePutio.NewClient()
+	server := httptest.NewServer(NewServer(config, NewPutioProxy(config, putioClient, store), nil))
+	defer server.Close()
+
+	// A paused torrent is held back from Put.io, but it's listed along with its labels and priority.
+	paused := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"filename":          "magnet:?xt=urn:btih:AAA&dn=movie",
+		"download-dir":      "/putarr/radarr",
+		"paused":            true,
+		"labels":            []string{"4k"},
+		"bandwidthPriority": 1,
+		"peer-limit":        10})["torrent-added"]
+
+	transfers, err := putioClient.Transfers.List(context.Background())
+	if err != nil {
+		t.Fatalf("failed to list Put.io transfers: %s", err)
+	}
+	if got, want := len(transfers), 0; got != want {
+		t.Fatalf("got %d Put.io transfers, want %d", got, want)
+	}
+
+	torrents := doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
+	want := []Torrent{{
+		ID:                paused.ID,
+		Name:              "movie",
+		DownloadDir:       "/putarr/radarr",
+		Status:            TorrentStatusStopped,
+		Labels:            []string{"4k"},
+		BandwidthPriority: 1,
+	}}
+	onlyFields := cmpopts.IgnoreFields(Torrent{}, "HashString", "ETA", "SecondsDownloading", "ErrorString",
+		"FileCount", "AddedDate", "MagnetLink", "Files", "FileStats")
+	if diff := cmp.Diff(want, torrents["torrents"], onlyFields); diff != "" {
+		t.Fatalf("unexpected torrents (-want +got):\n%s", diff)
+	}
+
+	// Starting the torrent adds it to Put.io, and it keeps its labels and priority.
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-start", map[string]any{"ids": []int{paused.ID}})
+
+	transfers, err = putioClient.Transfers.List(context.Background())
+	if err != nil {
+		t.Fatalf("failed to list Put.io transfers: %s", err)
+	}
+	if got, want := len(transfers), 1; got != want {
+		t.Fatalf("got %d Put.io transfers, want %d", got, want)
+	}
+	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", nil)
+	want[0].ID = int(transfers[0].ID)
+	want[0].Status = ConvertFromPutioStatus(transfers[0].Status)
+	if diff := cmp.Diff(want, torrents["torrents"], onlyFields); diff != "" {
+		t.Fatalf("unexpected torrents (-want +got):\n%s", diff)
+	}
+
+	// Clients can keep using the ID they got when they added the paused torrent.
+	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", map[string]any{
+		"ids": []int{paused.ID}})
+	if diff := cmp.Diff(want, torrents["torrents"], onlyFields); diff != "" {
+		t.Fatalf("unexpected torrents for the held ID (-want +got):\n%s", diff)
+	}
+
+	// The tracker only serves its torrent files with the right cookies, which Putarr sends along.
+	tracker := newTorrentFileServer(t, "show", "uid=42")
+	defer tracker.Close()
+
+	added := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"filename": tracker.URL + "/show.torrent",
+		"cookies":  "uid=42; pass=secret"})["torrent-added"]
+	if got, want := added.Name, "show"; got != want {
+		t.Fatalf("got torrent name %s, want %s", got, want)
+	}
+}
+
+func doRPCAndExpectOK[T any](t *testing.T, config *Config, baseURL string, method string, args map[string]any) T {
+	t.Helper()
+	return doRPCAndExpectCode[T](t, config, baseURL, method, args, http.StatusOK)
+}
+
+func doRPCAndExpectCode[T any](t *testing.T, config *Config, baseURL string, method string, args map[string]any, code int) T {
+	t.Helper()
+	return doRPC[T](t, config, baseURL, method, args, code, "success")
+}
+
+// Expects the RPC to fail with the given result string, which Transmission uses to report errors.
+func doRPCAndExpectResult(t *testing.T, config *Config, baseURL string, method string, args map[string]any, result string) {
 	t.Helper()
-	return doRPCAndExpectCode[T](t, config, baseURL, token, method, args, http.StatusOK)
+	doRPC[any](t, config, baseURL, method, args, http.StatusOK, result)
 }
 
-func doRPCAndExpectCode[T any](t *testing.T, config *Config, baseURL string, token string, method string, args map[string]any, code int) T {
+func doRPC[T any](t *testing.T, config *Config, baseURL string, method string, args map[string]any, code int, result string) T {
 	t.Helper()
 
+	// Getting a session ID fails with a conflict, unless the credentials are already rejected.
+	sessionID, status := getSession(t, config, baseURL)
+	if status != http.StatusConflict {
+		if got, want := status, code; got != want {
+			t.Fatalf("unexpected status code. got `%v`, want `%v`", got, want)
+		}
+		var v T
+		return v
+	}
+
 	request := Request{
 		Method:    method,
 		Arguments: args,
@@ -570,7 +1014,7 @@ func doRPCAndExpectCode[T any](t *testing.T, config *Config, baseURL string, tok
 	}
 
 	req.SetBasicAuth(config.Transmission.Username, config.Transmission.Password)
-	req.Header.Add("X-Transmission-Session-ID", token)
+	req.Header.Add("X-Transmission-Session-ID", sessionID)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -593,9 +1037,13 @@ func doRPCAndExpectCode[T any](t *testing.T, config *Config, baseURL string, tok
 		t.Fatal(err)
 	}
 
-	if got, want := response.Result, "success"; got != want {
+	if got, want := response.Result, result; got != want {
 		t.Fatalf("unexpected response result. got `%v`, want `%v`", response, want)
 	}
+	if result != "success" {
+		var v T
+		return v
+	}
 
 	var v T
 	err = json.Unmarshal(response.Arguments, &v)
@@ -605,3 +1053,411 @@ func doRPCAndExpectCode[T any](t *testing.T, config *Config, baseURL string, tok
 
 	return v
 }
+
+// Returns the current session ID, which the server sends along with its response to any authenticated request.
+func getSessionID(t *testing.T, config *Config, baseURL string) string {
+	t.Helper()
+	id, _ := getSession(t, config, baseURL)
+	return id
+}
+
+// Returns the current session ID, and the status code of the request that got it.
+func getSession(t *testing.T, config *Config, baseURL string) (string, int) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", baseURL+"/transmission/rpc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(config.Transmission.Username, config.Transmission.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	return resp.Header.Get("X-Transmission-Session-Id"), resp.StatusCode
+}
+
+func TestTransmissionSessions_Rotation(t *testing.T) {
+	config := TransmissionConfig{SessionRotation: time.Hour, SessionOverlap: time.Minute}
+	start := time.Now()
+
+	sessions := newTransmissionSessions()
+	first, _, err := sessions.validate("", config, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		explanation string
+		id          string
+		at          time.Duration
+		valid       bool
+		rotated     bool
+	}{
+		{"the current ID is valid", first, 0, true, false},
+		{"a made up ID is invalid", "wrongtoken", time.Minute, false, false},
+		{"the ID rotates on schedule, but the previous one is still valid", first, time.Hour, true, true},
+		{"the previous ID is valid until the end of the overlap", first, time.Hour + time.Minute, true, true},
+		{"the previous ID is invalid after the overlap", first, time.Hour + 2*time.Minute, false, true},
+	} {
+		t.Run(tt.explanation, func(t *testing.T) {
+			current, valid, err := sessions.validate(tt.id, config, start.Add(tt.at))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := valid, tt.valid; got != want {
+				t.Errorf("got valid %v, want %v", got, want)
+			}
+			if got, want := current != first, tt.rotated; got != want {
+				t.Errorf("got rotated %v, want %v", got, want)
+			}
+		})
+	}
+
+	// The session IDs are different for every server, so they change on restart.
+	restarted, _, err := newTransmissionSessions().validate("", config, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted == first {
+		t.Errorf("got the same session ID %q after a restart", restarted)
+	}
+}
+
+func TestTransmissionRPC_TorrentGetFieldsAndIDs(t *testing.T) {
+	var (
+		username    = "azure"
+		password    = "hunter2"
+		downloadDir = "/putarr"
+	)
+
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    username,
+			Password:    password,
+			DownloadDir: downloadDir,
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	server := httptest.NewServer(NewServer(config,
+		NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
+	defer server.Close()
+
+	movie := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"filename": "magnet:?xt=urn:btih:AAA&dn=movie"})["torrent-added"]
+	show := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"filename": "magnet:?xt=urn:btih:BBB&dn=show"})["torrent-added"]
+
+	// The movie completes with a folder of two files.
+	movieFolder, err := fakePutio.CreateFolder(folder.ID, "movie")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	if _, err := fakePutio.CreateFile(movieFolder.ID, "movie.mkv", []byte("movie")); err != nil {
+		t.Fatalf("failed to create new Put.io file: %s", err)
+	}
+	if _, err := fakePutio.CreateFile(movieFolder.ID, "movie.srt", []byte("subs")); err != nil {
+		t.Fatalf("failed to create new Put.io file: %s", err)
+	}
+	if err := fakePutio.SetTransferCompletedWithFile(int64(movie.ID), movieFolder.ID); err != nil {
+		t.Fatalf("failed to complete transfer: %s", err)
+	}
+
+	// Only the requested fields of the requested torrents are returned.
+	torrents := doRPCAndExpectOK[map[string][]map[string]any](t, config, server.URL, "torrent-get", map[string]any{
+		"ids":    []any{*movie.HashString},
+		"fields": []string{"id", "name", "percentDone", "files", "fileStats"},
+	})
+	if got, want := len(torrents["torrents"]), 1; got != want {
+		t.Fatalf("got %d torrents, want %d", got, want)
+	}
+	if diff := cmp.Diff(map[string]any{
+		"id":          float64(movie.ID),
+		"name":        "movie",
+		"percentDone": float64(1),
+		"files": []any{
+			map[string]any{"name": "movie/movie.mkv", "length": float64(5), "bytesCompleted": float64(5)},
+			map[string]any{"name": "movie/movie.srt", "length": float64(4), "bytesCompleted": float64(4)},
+		},
+		"fileStats": []any{
+			map[string]any{"bytesCompleted": float64(5), "wanted": true, "priority": float64(0)},
+			map[string]any{"bytesCompleted": float64(4), "wanted": true, "priority": float64(0)},
+		},
+	}, torrents["torrents"][0]); diff != "" {
+		t.Fatalf("unexpected torrent (-want +got):\n%s", diff)
+	}
+
+	// Numeric IDs work too.
+	torrents = doRPCAndExpectOK[map[string][]map[string]any](t, config, server.URL, "torrent-get", map[string]any{
+		"ids":    show.ID,
+		"fields": []string{"name"},
+	})
+	if diff := cmp.Diff([]map[string]any{{"name": "show"}}, torrents["torrents"]); diff != "" {
+		t.Fatalf("unexpected torrents (-want +got):\n%s", diff)
+	}
+
+	// Both torrents are recently active: the show is still downloading and the movie just finished.
+	torrents = doRPCAndExpectOK[map[string][]map[string]any](t, config, server.URL, "torrent-get", map[string]any{
+		"ids":    "recently-active",
+		"fields": []string{"id"},
+	})
+	if got, want := len(torrents["torrents"]), 2; got != want {
+		t.Fatalf("got %d recently active torrents, want %d", got, want)
+	}
+	if _, ok := torrents["removed"]; !ok {
+		t.Error("missing `removed` key in response")
+	}
+}
+
+func TestTransmissionRPC_OtherMethods(t *testing.T) {
+	var (
+		username    = "azure"
+		password    = "hunter2"
+		downloadDir = "/putarr"
+	)
+
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    username,
+			Password:    password,
+			DownloadDir: downloadDir,
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+	fakePutio.SetDiskSize(1000)
+
+	folder, err := fakePutio.CreateFolder(0, "putarr")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	config.Putio.ParentDirID = folder.ID
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "transfers.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	server := httptest.NewServer(NewServer(config,
+		NewPutioProxy(config, fakePutio.NewClient(), store), nil))
+	defer server.Close()
+
+	movie := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"filename": "magnet:?xt=urn:btih:AAA&dn=movie", "download-dir": "/putarr/radarr"})["torrent-added"]
+	show := doRPCAndExpectOK[map[string]Torrent](t, config, server.URL, "torrent-add", map[string]any{
+		"filename": "magnet:?xt=urn:btih:BBB&dn=show"})["torrent-added"]
+
+	movieFolder, err := fakePutio.CreateFolder(folder.ID, "movie")
+	if err != nil {
+		t.Fatalf("failed to create new Put.io folder: %s", err)
+	}
+	movieFile, err := fakePutio.CreateFile(movieFolder.ID, "movie.mkv", []byte("movie"))
+	if err != nil {
+		t.Fatalf("failed to create new Put.io file: %s", err)
+	}
+	if err := fakePutio.SetTransferCompletedWithFile(int64(movie.ID), movieFolder.ID); err != nil {
+		t.Fatalf("failed to complete transfer: %s", err)
+	}
+
+	// Setting the location moves the files of the transfer on Put.io.
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-set-location", map[string]any{
+		"ids": []any{movie.ID}, "location": "/putarr/radarr-4k", "move": true})
+	moved, _ := fakePutio.GetFile(movieFolder.ID)
+	destination, _ := fakePutio.GetFile(moved.ParentID)
+	if got, want := destination.Name, "radarr-4k"; got != want {
+		t.Errorf("got files moved to %q, want %q", got, want)
+	}
+
+	// Renaming a path renames the file on Put.io.
+	renamed := doRPCAndExpectOK[map[string]any](t, config, server.URL, "torrent-rename-path", map[string]any{
+		"ids": []any{movie.ID}, "path": "movie/movie.mkv", "name": "Movie (2024).mkv"})
+	if got, want := renamed["name"], "Movie (2024).mkv"; got != want {
+		t.Errorf("got renamed name %v, want %v", got, want)
+	}
+	if file, _ := fakePutio.GetFile(movieFile.ID); file.Name != "Movie (2024).mkv" {
+		t.Errorf("file wasn't renamed, got %q", file.Name)
+	}
+
+	// Labels are recorded in the store.
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-set", map[string]any{
+		"ids": []any{movie.ID}, "labels": []any{"4k"}, "downloadLimit": 100})
+
+	torrents := doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", map[string]any{
+		"ids": []any{movie.ID}})
+	if got, want := torrents["torrents"][0].DownloadDir, "/putarr/radarr-4k"; got != want {
+		t.Errorf("got download dir %q, want %q", got, want)
+	}
+	if got, want := torrents["torrents"][0].Labels, []string{"4k"}; !cmp.Equal(got, want) {
+		t.Errorf("got labels %v, want %v", got, want)
+	}
+
+	// Without `move`, only the recorded location changes and the files stay where they are.
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-set-location", map[string]any{
+		"ids": []any{movie.ID}, "location": "/putarr/radarr"})
+	if moved, _ := fakePutio.GetFile(movieFolder.ID); moved.ParentID != destination.ID {
+		t.Errorf("got files moved to the folder with ID %d, want them left in %d", moved.ParentID, destination.ID)
+	}
+	torrents = doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", map[string]any{
+		"ids": []any{movie.ID}})
+	if got, want := torrents["torrents"][0].DownloadDir, "/putarr/radarr"; got != want {
+		t.Errorf("got download dir %q, want %q", got, want)
+	}
+
+	// Starting a failed torrent retries it.
+	if err := fakePutio.SetTransferError(int64(show.ID), "tracker is gone"); err != nil {
+		t.Fatalf("failed to fail transfer: %s", err)
+	}
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-start", map[string]any{"ids": []any{show.ID}})
+	if transfer, _ := fakePutio.GetTransfer(int64(show.ID)); transfer.Status != "IN_QUEUE" {
+		t.Errorf("transfer wasn't retried, got status %q", transfer.Status)
+	}
+
+	stats := doRPCAndExpectOK[SessionStats](t, config, server.URL, "session-stats", nil)
+	if got, want := stats.TorrentCount, 2; got != want {
+		t.Errorf("got %d torrents, want %d", got, want)
+	}
+	if got, want := stats.ActiveTorrentCount, 1; got != want {
+		t.Errorf("got %d active torrents, want %d", got, want)
+	}
+
+	// Free space is the disk quota of the Put.io account.
+	space := doRPCAndExpectOK[FreeSpace](t, config, server.URL, "free-space", map[string]any{"path": "/putarr"})
+	if diff := cmp.Diff(FreeSpace{Path: "/putarr", SizeBytes: 995, TotalSize: 1000}, space); diff != "" {
+		t.Errorf("unexpected free space (-want +got):\n%s", diff)
+	}
+
+	doRPCAndExpectOK[any](t, config, server.URL, "session-set", map[string]any{"speed-limit-down": 100})
+
+	// Stopping a torrent keeps its transfer, and reports it as stopped until it's started again.
+	showStatus := func() TorrentStatus {
+		t.Helper()
+		return doRPCAndExpectOK[map[string][]Torrent](t, config, server.URL, "torrent-get", map[string]any{
+			"ids": []any{show.ID}})["torrents"][0].Status
+	}
+	doRPCAndExpectResult(t, config, server.URL, "torrent-stop", nil, "invalid arguments: missing `ids` argument")
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-stop", map[string]any{"ids": []any{show.ID}})
+	if _, ok := fakePutio.GetTransfer(int64(show.ID)); !ok {
+		t.Error("transfer was cancelled")
+	}
+	if got, want := showStatus(), TorrentStatusStopped; got != want {
+		t.Errorf("got status %v after stopping, want %v", got, want)
+	}
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-start", map[string]any{"ids": []any{show.ID}})
+	if got, want := showStatus(), TorrentStatusDownloadPending; got != want {
+		t.Errorf("got status %v after starting, want %v", got, want)
+	}
+
+	// Removing torrents requires explicit IDs, which can be numbers.
+	doRPCAndExpectResult(t, config, server.URL, "torrent-remove", nil, "invalid arguments: missing `ids` argument")
+	doRPCAndExpectOK[any](t, config, server.URL, "torrent-remove", map[string]any{"ids": []any{movie.ID}})
+	if _, ok := fakePutio.GetTransfer(int64(movie.ID)); ok {
+		t.Error("transfer wasn't removed")
+	}
+
+	for _, method := range []string{"torrent-verify", "port-test", "blocklist-update"} {
+		doRPCAndExpectResult(t, config, server.URL, method, nil, method+" is not supported by Put.io")
+	}
+}
+
+func TestTransmissionRPC_ErrorResults(t *testing.T) {
+	var (
+		username    = "azure"
+		password    = "hunter2"
+		downloadDir = "/putarr"
+	)
+
+	config := &Config{
+		Transmission: TransmissionConfig{
+			Username:    username,
+			Password:    password,
+			DownloadDir: downloadDir,
+		}}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	server := httptest.NewServer(NewServer(config,
+		NewPutioProxy(config, fakePutio.NewClient(), nil), nil))
+	defer server.Close()
+
+	magnet := map[string]any{"filename": "magnet:?xt=urn:btih:AAA&dn=foo"}
+
+	for _, tt := range []struct {
+		explanation string
+		status      int
+		errorType   string
+		method      string
+		args        map[string]any
+		result      string
+	}{
+		{
+			"Put.io server errors are transient",
+			http.StatusServiceUnavailable, "",
+			"torrent-add", magnet,
+			"Put.io is temporarily unavailable, try again later",
+		},
+		{
+			"rate limiting is transient too",
+			http.StatusTooManyRequests, "",
+			"torrent-get", nil,
+			"Put.io is temporarily unavailable, try again later",
+		},
+		{
+			"a rejected token means the configuration needs fixing",
+			http.StatusUnauthorized, "invalid_grant",
+			"torrent-get", nil,
+			"Put.io rejected the OAuth token, check putio.oauth_token in the Putarr configuration",
+		},
+		{
+			"a full disk is reported as such",
+			http.StatusBadRequest, "STORAGE_LIMIT",
+			"torrent-add", magnet,
+			"not enough free space on Put.io",
+		},
+		{
+			"duplicates are reported as such",
+			http.StatusBadRequest, "Alreadyadded",
+			"torrent-add", magnet,
+			"duplicate torrent",
+		},
+		{
+			"bad magnets are rejected before reaching Put.io",
+			0, "",
+			"torrent-add", map[string]any{"filename": "magnet:?dn=foo"},
+			"invalid magnet link or URL: missing exact topic",
+		},
+		{
+			"corrupt torrent files are rejected before reaching Put.io",
+			0, "",
+			"torrent-add", map[string]any{"metainfo": base64.StdEncoding.EncodeToString([]byte("garbage"))},
+			"invalid or corrupt torrent file",
+		},
+		{
+			"bad arguments are reported",
+			0, "",
+			"torrent-get", map[string]any{"ids": true},
+			"invalid arguments: unrecognized ids argument: true",
+		},
+		{
+			"unknown methods are reported",
+			0, "",
+			"torrent-whatever", nil,
+			"method name not recognized",
+		},
+	} {
+		t.Run(tt.explanation, func(t *testing.T) {
+			fakePutio.FailRequests(tt.status, tt.errorType)
+			defer fakePutio.FailRequests(0, "")
+			doRPCAndExpectResult(t, config, server.URL, tt.method, tt.args, tt.result)
+		})
+	}
+}
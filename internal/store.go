@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TransferMetadata is what Putarr knows about a transfer beyond what Put.io reports.
+type TransferMetadata struct {
+	Source      string      `json:"source"`              // Magnet link or URL the transfer was added with.
+	Torrent     []byte      `json:"torrent,omitempty"`   // Original torrent file, when the transfer was added with one.
+	InfoHash    string      `json:"info_hash,omitempty"` // Lowercase hex info hash, when it's known.
+	Name        string      `json:"name,omitempty"`      // Name of the transfer, in case Put.io doesn't report it.
+	DownloadDir string      `json:"download_dir"`
+	Category    string      `json:"category,omitempty"`
+	Client      string      `json:"client,omitempty"` // API the transfer was added with, e.g., transmission.
+	User        string      `json:"user,omitempty"`   // User who added the transfer, when the API has users.
+	Labels      []string    `json:"labels,omitempty"`
+	Priority    int         `json:"priority,omitempty"`   // Bandwidth priority requested by the client, from -1 to 1.
+	Paused      bool        `json:"paused,omitempty"`     // Held back from Put.io until it's started.
+	Stopped     bool        `json:"stopped,omitempty"`    // Stopped by the client after it was added to Put.io.
+	StartedID   int64       `json:"started_id,omitempty"` // ID of the Put.io transfer a held transfer was started as.
+	HeldID      int64       `json:"held_id,omitempty"`    // ID the transfer was held under before it was started.
+	Uploaded    bool        `json:"uploaded,omitempty"`   // Torrent file uploaded as is, so the transfer has no callback URL.
+	AddedAt     time.Time   `json:"added_at"`
+	Local       *LocalState `json:"local,omitempty"` // State of the local download, when local downloading is enabled.
+}
+
+// LocalState is the persisted outcome of a local download.
+type LocalState struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Done  bool   `json:"done"`
+	Error string `json:"error,omitempty"`
+}
+
+// Store persists the metadata of transfers to a JSON file or to the Put.io ConfigService, keyed by transfer ID. The
+// Put.io callback URL still establishes the ownership of most transfers; the store only holds the details Put.io
+// doesn't keep for us, and the ownership of uploaded torrents which have no callback URL.
+type Store struct {
+	backend storeBackend
+
+	mu         sync.Mutex
+	transfers  map[int64]*TransferMetadata
+	lastHeldID int64 // Only goes down, so the IDs of deleted held transfers aren't reused.
+
+	// Held while writing to the backend, which is taken over from mu so the writes happen in the order of the changes,
+	// without holding up the readers.
+	writeMu sync.Mutex
+}
+
+// storeBackend persists the metadata of transfers on behalf of the store.
+type storeBackend interface {
+	// Encodes the metadata of the changed transfers while the store is locked, and returns the function that writes
+	// it once the store is unlocked. The changed transfers that are missing from the map were deleted, and a changed
+	// held ID equal to the last held ID was just handed out.
+	prepare(transfers map[int64]*TransferMetadata, lastHeldID int64, changed ...int64) (func() error, error)
+}
+
+// storeFile is the format of the file of the file backend.
+type storeFile struct {
+	Transfers  map[int64]*TransferMetadata `json:"transfers"`
+	LastHeldID int64                       `json:"last_held_id,omitempty"`
+}
+
+// OpenStore loads the store from the given file, which is created on the first write if it doesn't exist yet.
+func OpenStore(path string) (*Store, error) {
+	store := &Store{
+		backend:   fileBackend{path: path},
+		transfers: map[int64]*TransferMetadata{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	var file storeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode store: %w", err)
+	}
+	// Stores written before the last held ID was kept are just the transfers.
+	if file.Transfers == nil {
+		if err := json.Unmarshal(data, &file.Transfers); err != nil {
+			return nil, fmt.Errorf("failed to decode store: %w", err)
+		}
+	}
+	store.transfers = file.Transfers
+	store.setLastHeldID(file.LastHeldID)
+	return store, nil
+}
+
+// Sets the last held ID once the store is loaded, or lower if the store holds lower IDs.
+func (s *Store) setLastHeldID(lastHeldID int64) {
+	s.lastHeldID = min(lastHeldID, 0)
+	for id := range s.transfers {
+		s.lastHeldID = min(s.lastHeldID, id)
+	}
+}
+
+// Get returns a copy of the metadata of the transfer, if there's any.
+func (s *Store) Get(id int64) (TransferMetadata, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metadata, ok := s.transfers[id]
+	if !ok {
+		return TransferMetadata{}, false
+	}
+	return *metadata, true
+}
+
+// Put sets the metadata of the transfer.
+func (s *Store) Put(id int64, metadata TransferMetadata) error {
+	s.mu.Lock()
+	s.transfers[id] = &metadata
+	return s.save(id)
+}
+
+// Update modifies the metadata of the transfer in place. The metadata is created when there's none yet, e.g., for
+// transfers added before the store was.
+func (s *Store) Update(id int64, fn func(metadata *TransferMetadata)) error {
+	s.mu.Lock()
+	metadata, ok := s.transfers[id]
+	if !ok {
+		metadata = &TransferMetadata{}
+		s.transfers[id] = metadata
+	}
+	fn(metadata)
+	return s.save(id)
+}
+
+// Hold stores the metadata of a transfer that isn't on Put.io yet, and returns the ID it's held under. Held transfers
+// have negative IDs so they never collide with the IDs of Put.io transfers, and the IDs are never reused so a client
+// holding on to the ID of a deleted transfer doesn't get another one.
+func (s *Store) Hold(metadata TransferMetadata) (int64, error) {
+	s.mu.Lock()
+	s.lastHeldID--
+	id := s.lastHeldID
+	s.transfers[id] = &metadata
+	return id, s.save(id)
+}
+
+// Held returns a copy of the metadata of the held transfers that weren't started yet, keyed by ID.
+func (s *Store) Held() map[int64]TransferMetadata {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := map[int64]TransferMetadata{}
+	for id, metadata := range s.transfers {
+		if isHeldTransferID(id) && metadata.StartedID == 0 {
+			result[id] = *metadata
+		}
+	}
+	return result
+}
+
+// Delete removes the metadata of the transfers.
+func (s *Store) Delete(ids ...int64) error {
+	s.mu.Lock()
+	for _, id := range ids {
+		delete(s.transfers, id)
+	}
+	return s.save(ids...)
+}
+
+// Prune removes the metadata of the transfers that were added before the given time and aren't in the keep set, e.g.,
+// because they were cancelled from the Put.io website. Newer transfers are kept since they might not be listed yet, and
+// so are held transfers since they're not on Put.io at all, until the transfer they were started as is gone.
+func (s *Store) Prune(keep map[int64]bool, before time.Time) error {
+	s.mu.Lock()
+	var pruned []int64
+	for id, metadata := range s.transfers {
+		listed := keep[id]
+		if isHeldTransferID(id) {
+			listed = metadata.StartedID == 0 || keep[metadata.StartedID]
+		}
+		if !listed && metadata.AddedAt.Before(before) {
+			delete(s.transfers, id)
+			pruned = append(pruned, id)
+		}
+	}
+	if len(pruned) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	return s.save(pruned...)
+}
+
+// Persists the changed transfers. It's called with the store locked, and unlocks it before writing to the backend.
+func (s *Store) save(changed ...int64) error {
+	write, err := s.backend.prepare(s.transfers, s.lastHeldID, changed...)
+	s.writeMu.Lock()
+	s.mu.Unlock()
+	defer s.writeMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return write()
+}
+
+// Held transfers are the ones added paused, which Putarr keeps to itself until they're started.
+func isHeldTransferID(id int64) bool {
+	return id < 0
+}
+
+// fileBackend persists the whole store to a single JSON file.
+type fileBackend struct {
+	path string
+}
+
+// Writes the store to a temporary file first so a crash never leaves a truncated store behind.
+func (b fileBackend) prepare(transfers map[int64]*TransferMetadata, lastHeldID int64, changed ...int64) (func() error, error) {
+	data, err := json.Marshal(storeFile{Transfers: transfers, LastHeldID: lastHeldID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode store: %w", err)
+	}
+	return func() error {
+		if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+			return fmt.Errorf("failed to create store directory: %w", err)
+		}
+		if err := os.WriteFile(b.path+".tmp", data, 0644); err != nil {
+			return fmt.Errorf("failed to write store: %w", err)
+		}
+		return os.Rename(b.path+".tmp", b.path)
+	}, nil
+}
@@ -0,0 +1,425 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/albertb/putarr/internal/fakes"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transfers.json")
+
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	addedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	metadata := TransferMetadata{
+		Source:      "magnet:?xt=urn:btih:AAA&dn=movie",
+		DownloadDir: "/putarr/radarr",
+		Category:    "radarr",
+		Client:      "qbittorrent",
+		Labels:      []string{"4k"},
+		AddedAt:     addedAt,
+	}
+	if err := store.Put(1, metadata); err != nil {
+		t.Fatalf("failed to put metadata: %s", err)
+	}
+	if err := store.Put(2, TransferMetadata{Source: "magnet:?xt=urn:btih:BBB", AddedAt: addedAt}); err != nil {
+		t.Fatalf("failed to put metadata: %s", err)
+	}
+	if err := store.Update(1, func(metadata *TransferMetadata) {
+		metadata.Local = &LocalState{Path: "/downloads/radarr/movie", Size: 123, Done: true}
+	}); err != nil {
+		t.Fatalf("failed to update metadata: %s", err)
+	}
+	metadata.Local = &LocalState{Path: "/downloads/radarr/movie", Size: 123, Done: true}
+
+	// The metadata survives reopening the store.
+	store, err = OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	got, ok := store.Get(1)
+	if !ok {
+		t.Fatal("missing metadata after reopening the store")
+	}
+	if diff := cmp.Diff(metadata, got); diff != "" {
+		t.Fatalf("unexpected metadata (-want +got):\n%s", diff)
+	}
+
+	// Pruning only removes the old transfers that aren't kept.
+	if err := store.Prune(map[int64]bool{1: true}, addedAt.Add(time.Second)); err != nil {
+		t.Fatalf("failed to prune store: %s", err)
+	}
+	if _, ok := store.Get(1); !ok {
+		t.Error("kept metadata was pruned")
+	}
+	if _, ok := store.Get(2); ok {
+		t.Error("metadata wasn't pruned")
+	}
+
+	// Updating a transfer without metadata, e.g., one added before the store was, creates its metadata.
+	if err := store.Update(3, func(metadata *TransferMetadata) { metadata.Stopped = true }); err != nil {
+		t.Fatalf("failed to update metadata: %s", err)
+	}
+	if got, ok := store.Get(3); !ok || !got.Stopped {
+		t.Errorf("got metadata %+v, %v after updating a missing transfer, want it stopped", got, ok)
+	}
+
+	if err := store.Delete(1); err != nil {
+		t.Fatalf("failed to delete metadata: %s", err)
+	}
+	if _, ok := store.Get(1); ok {
+		t.Error("metadata wasn't deleted")
+	}
+}
+
+func TestStore_Held(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "transfers.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	addedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	first, err := store.Hold(TransferMetadata{Source: "magnet:?xt=urn:btih:AAA", Paused: true, AddedAt: addedAt})
+	if err != nil {
+		t.Fatalf("failed to hold transfer: %s", err)
+	}
+	second, err := store.Hold(TransferMetadata{Source: "magnet:?xt=urn:btih:BBB", Paused: true, AddedAt: addedAt})
+	if err != nil {
+		t.Fatalf("failed to hold transfer: %s", err)
+	}
+	if err := store.Put(1, TransferMetadata{Source: "magnet:?xt=urn:btih:CCC", AddedAt: addedAt}); err != nil {
+		t.Fatalf("failed to put metadata: %s", err)
+	}
+
+	// Held transfers get distinct negative IDs, and they're never pruned since they aren't on Put.io.
+	if first >= 0 || second >= 0 || first == second {
+		t.Fatalf("got held IDs %d and %d, want distinct negative IDs", first, second)
+	}
+	if err := store.Prune(map[int64]bool{}, addedAt.Add(time.Second)); err != nil {
+		t.Fatalf("failed to prune store: %s", err)
+	}
+	if got, want := slices.Sorted(maps.Keys(store.Held())), []int64{second, first}; !cmp.Equal(got, want) {
+		t.Fatalf("got held IDs %v, want %v", got, want)
+	}
+	if _, ok := store.Get(1); ok {
+		t.Error("metadata wasn't pruned")
+	}
+
+	// Started held transfers aren't held anymore, but they're kept until the transfer they were started as is gone.
+	if err := store.Update(first, func(metadata *TransferMetadata) { metadata.StartedID = 2 }); err != nil {
+		t.Fatalf("failed to update metadata: %s", err)
+	}
+	if got, want := slices.Sorted(maps.Keys(store.Held())), []int64{second}; !cmp.Equal(got, want) {
+		t.Fatalf("got held IDs %v, want %v", got, want)
+	}
+	if err := store.Prune(map[int64]bool{2: true}, addedAt.Add(time.Second)); err != nil {
+		t.Fatalf("failed to prune store: %s", err)
+	}
+	if _, ok := store.Get(first); !ok {
+		t.Error("started held transfer was pruned while its transfer exists")
+	}
+	if err := store.Prune(map[int64]bool{}, addedAt.Add(time.Second)); err != nil {
+		t.Fatalf("failed to prune store: %s", err)
+	}
+	if _, ok := store.Get(first); ok {
+		t.Error("started held transfer wasn't pruned after its transfer was gone")
+	}
+}
+
+func TestStore_HeldIDsAreNeverReused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transfers.json")
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	first, err := store.Hold(TransferMetadata{Source: "magnet:?xt=urn:btih:AAA", Paused: true})
+	if err != nil {
+		t.Fatalf("failed to hold transfer: %s", err)
+	}
+	if err := store.Delete(first); err != nil {
+		t.Fatalf("failed to delete metadata: %s", err)
+	}
+
+	// The lowest held ID is gone, but its ID still isn't handed out again.
+	second, err := store.Hold(TransferMetadata{Source: "magnet:?xt=urn:btih:BBB", Paused: true})
+	if err != nil {
+		t.Fatalf("failed to hold transfer: %s", err)
+	}
+	if second >= first {
+		t.Fatalf("got held ID %d after deleting %d, want a lower ID", second, first)
+	}
+	if err := store.Delete(second); err != nil {
+		t.Fatalf("failed to delete metadata: %s", err)
+	}
+
+	// Nor after reopening the store.
+	store, err = OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %s", err)
+	}
+	third, err := store.Hold(TransferMetadata{Source: "magnet:?xt=urn:btih:CCC", Paused: true})
+	if err != nil {
+		t.Fatalf("failed to hold transfer: %s", err)
+	}
+	if third >= second {
+		t.Fatalf("got held ID %d after reopening the store, want one lower than %d", third, second)
+	}
+}
+
+func TestStore_OpenLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transfers.json")
+	if err := os.WriteFile(path, []byte(`{"1":{"source":"magnet:?xt=urn:btih:AAA"},"-3":{"source":"magnet:?xt=urn:btih:BBB","paused":true}}`), 0o600); err != nil {
+		t.Fatalf("failed to write store: %s", err)
+	}
+
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	if got, ok := store.Get(1); !ok || got.Source != "magnet:?xt=urn:btih:AAA" {
+		t.Errorf("got metadata %+v (found: %t), want the stored metadata", got, ok)
+	}
+	id, err := store.Hold(TransferMetadata{Source: "magnet:?xt=urn:btih:CCC", Paused: true})
+	if err != nil {
+		t.Fatalf("failed to hold transfer: %s", err)
+	}
+	if id >= -3 {
+		t.Errorf("got held ID %d, want one lower than the stored held IDs", id)
+	}
+}
+
+func TestPutioProxy_Metadata(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		Transmission: TransmissionConfig{DownloadDir: "/putarr"},
+	}
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "transfers.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	putioProxy := NewPutioProxy(config, fakePutio.NewClient(), store)
+
+	magnet := "magnet:?xt=urn:btih:AAA&dn=movie"
+	added, err := putioProxy.AddTransfer(ctx, magnet, "/putarr/radarr",
+		TransferMetadata{Client: "transmission", Category: "radarr", Labels: []string{"hd"}})
+	if err != nil {
+		t.Fatalf("failed to add transfer: %s", err)
+	}
+
+	transfers, err := putioProxy.GetTransfers(ctx)
+	if err != nil {
+		t.Fatalf("failed to get transfers: %s", err)
+	}
+	if got, want := len(transfers), 1; got != want {
+		t.Fatalf("got %d transfers, want %d", got, want)
+	}
+	metadata := transfers[0].Metadata
+	if metadata == nil {
+		t.Fatal("missing transfer metadata")
+	}
+	if got, want := metadata.Source, magnet; got != want {
+		t.Errorf("got source %q, want %q", got, want)
+	}
+	if got, want := metadata.Client, "transmission"; got != want {
+		t.Errorf("got client %q, want %q", got, want)
+	}
+
+	// The labels make it to the Transmission API.
+	torrent := convertFromPutioTransfer(transfers[0])
+	if got, want := torrent.Labels, []string{"hd"}; !cmp.Equal(got, want) {
+		t.Errorf("got labels %v, want %v", got, want)
+	}
+	if got, want := torrent.AddedDate, metadata.AddedAt.Unix(); got != want {
+		t.Errorf("got added date %v, want %v", got, want)
+	}
+
+	// Removing the transfer removes its metadata too.
+	if err := putioProxy.RemoveTransfers(ctx, true, added.ID); err != nil {
+		t.Fatalf("failed to remove transfer: %s", err)
+	}
+	if _, ok := store.Get(added.ID); ok {
+		t.Error("metadata wasn't deleted along with the transfer")
+	}
+}
+
+func TestPutioStore(t *testing.T) {
+	ctx := context.Background()
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+	putioClient := fakePutio.NewClient()
+
+	openStore := func(instance string) *Store {
+		t.Helper()
+		config := &Config{Store: StoreConfig{Backend: "putio", Instance: instance}}
+		state, err := NewPutioState(config, putioClient)
+		if err != nil {
+			t.Fatalf("failed to create state: %s", err)
+		}
+		store, err := OpenPutioStore(ctx, state)
+		if err != nil {
+			t.Fatalf("failed to open store: %s", err)
+		}
+		return store
+	}
+
+	addedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	metadata := TransferMetadata{Source: "magnet:?xt=urn:btih:AAA", DownloadDir: "/putarr/radarr", AddedAt: addedAt}
+	store := openStore("hd")
+	if err := store.Put(1, metadata); err != nil {
+		t.Fatalf("failed to put metadata: %s", err)
+	}
+	// Torrent files are too big for the Put.io config service, so they're left out.
+	withTorrent := metadata
+	withTorrent.Torrent = []byte("d4:infod4:name5:movieee")
+	if err := store.Put(2, withTorrent); err != nil {
+		t.Fatalf("failed to put metadata: %s", err)
+	}
+	held, err := store.Hold(metadata)
+	if err != nil {
+		t.Fatalf("failed to hold transfer: %s", err)
+	}
+	if err := openStore("4k").Put(1, TransferMetadata{Source: "magnet:?xt=urn:btih:BBB", AddedAt: addedAt}); err != nil {
+		t.Fatalf("failed to put metadata: %s", err)
+	}
+
+	// The metadata survives losing the local disk, and every instance only sees its own transfers.
+	store = openStore("hd")
+	for _, id := range []int64{1, 2, held} {
+		got, ok := store.Get(id)
+		if !ok {
+			t.Fatalf("missing metadata of transfer %d after reopening the store", id)
+		}
+		if diff := cmp.Diff(metadata, got); diff != "" {
+			t.Fatalf("unexpected metadata of transfer %d (-want +got):\n%s", id, diff)
+		}
+	}
+
+	// Pruned and deleted transfers are removed from Put.io too.
+	if err := store.Prune(map[int64]bool{1: true}, addedAt.Add(time.Second)); err != nil {
+		t.Fatalf("failed to prune store: %s", err)
+	}
+	if err := store.Delete(held); err != nil {
+		t.Fatalf("failed to delete metadata: %s", err)
+	}
+	store = openStore("hd")
+	if _, ok := store.Get(1); !ok {
+		t.Error("kept metadata was pruned")
+	}
+	for _, id := range []int64{2, held} {
+		if _, ok := store.Get(id); ok {
+			t.Errorf("metadata of transfer %d wasn't removed", id)
+		}
+	}
+	if got, ok := openStore("4k").Get(1); !ok || got.Source != "magnet:?xt=urn:btih:BBB" {
+		t.Errorf("got metadata %+v of the other instance, want it untouched", got)
+	}
+
+	// The deleted held ID isn't handed out again.
+	next, err := store.Hold(metadata)
+	if err != nil {
+		t.Fatalf("failed to hold transfer: %s", err)
+	}
+	if next >= held {
+		t.Errorf("got held ID %d after deleting %d, want a lower ID", next, held)
+	}
+}
+
+func TestPutioState_Register(t *testing.T) {
+	ctx := context.Background()
+
+	fakePutio := fakes.NewFakePutio()
+	defer fakePutio.Close()
+	putioClient := fakePutio.NewClient()
+
+	newState := func(instance, friendToken string) *PutioState {
+		t.Helper()
+		config := &Config{
+			Putio: PutioConfig{FriendToken: friendToken},
+			Store: StoreConfig{Backend: "putio", Instance: instance},
+		}
+		state, err := NewPutioState(config, putioClient)
+		if err != nil {
+			t.Fatalf("failed to create state: %s", err)
+		}
+		return state
+	}
+
+	hd := newState("hd", "aaa")
+	if err := hd.Register(ctx); err != nil {
+		t.Fatalf("failed to register instance: %s", err)
+	}
+	// Registering again, e.g., to refresh the registration, is fine.
+	if err := hd.Register(ctx); err != nil {
+		t.Fatalf("failed to register instance again: %s", err)
+	}
+
+	// A crashed instance stops being live once it hasn't refreshed its registration for a while.
+	crashed := InstanceRegistration{Name: "sd", ID: "1234", FriendToken: "ccc", SeenAt: time.Now().Add(-instanceTTL)}
+	if err := putioClient.Config.Set(ctx, putioInstanceKeyPrefix+"sd", crashed); err != nil {
+		t.Fatalf("failed to set registration: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		instance    string
+		friendToken string
+		wantErr     bool
+	}{
+		{"same name", "hd", "bbb", true},
+		{"same friend token", "4k", "aaa", true},
+		{"other instance", "4k", "bbb", false},
+		{"friend token of a crashed instance", "uhd", "ccc", false},
+	} {
+		err := newState(tc.instance, tc.friendToken).Register(ctx)
+		if got, want := errors.Is(err, ErrInstanceConflict), tc.wantErr; got != want {
+			t.Errorf("%s: got error %v, want conflict %v", tc.name, err, want)
+		}
+	}
+
+	instances, err := hd.Instances(ctx)
+	if err != nil {
+		t.Fatalf("failed to get instances: %s", err)
+	}
+	var names []string
+	for _, instance := range instances {
+		names = append(names, instance.Name)
+	}
+	if got, want := names, []string{"4k", "hd", "sd", "uhd"}; !cmp.Equal(got, want) {
+		t.Fatalf("got instances %v, want %v", got, want)
+	}
+
+	// Once unregistered, an instance by the same name can start right away.
+	if err := hd.Unregister(ctx); err != nil {
+		t.Fatalf("failed to unregister instance: %s", err)
+	}
+	replacement := newState("hd", "aaa")
+	if err := replacement.Register(ctx); err != nil {
+		t.Fatalf("failed to register instance after the previous one stopped: %s", err)
+	}
+
+	// An instance that shuts down late doesn't remove the registration of the instance that replaced it.
+	if err := hd.Unregister(ctx); err != nil {
+		t.Fatalf("failed to unregister instance: %s", err)
+	}
+	if err := newState("hd", "aaa").Register(ctx); !errors.Is(err, ErrInstanceConflict) {
+		t.Fatalf("got error %v registering over the replacement instance, want a conflict", err)
+	}
+}
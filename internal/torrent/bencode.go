@@ -0,0 +1,177 @@
+package torrent
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Nesting limit of lists and dictionaries, so malicious files can't exhaust the stack.
+const maxDepth = 256
+
+// Decode decodes the bencoded value that spans all of the data. Integers are decoded as int64, strings as string,
+// lists as []any, and dictionaries as map[string]any.
+func Decode(data []byte) (any, error) {
+	d := &decoder{data: data}
+	value, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, d.errorf("trailing data")
+	}
+	return value, nil
+}
+
+type decoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (d *decoder) errorf(format string, args ...any) error {
+	return fmt.Errorf("bencode: %s at offset %d", fmt.Sprintf(format, args...), d.pos)
+}
+
+func (d *decoder) value() (any, error) {
+	if d.pos >= len(d.data) {
+		return nil, d.errorf("unexpected end of data")
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		return d.integer()
+	case c >= '0' && c <= '9':
+		return d.string()
+	case c == 'l':
+		return d.list()
+	case c == 'd':
+		dict, _, err := d.dict()
+		return dict, err
+	default:
+		return nil, d.errorf("unexpected character %q", c)
+	}
+}
+
+// Decodes an integer, e.g., i42e. Leading zeros and negative zero aren't allowed, so every integer has exactly one
+// encoding.
+func (d *decoder) integer() (int64, error) {
+	d.pos++ // Skip the i.
+	start := d.pos
+	for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+		d.pos++
+	}
+	if d.pos >= len(d.data) {
+		return 0, d.errorf("unterminated integer")
+	}
+	digits := string(d.data[start:d.pos])
+	unsigned := digits
+	if len(unsigned) > 0 && unsigned[0] == '-' {
+		unsigned = unsigned[1:]
+	}
+	if unsigned == "" || (unsigned[0] == '0' && len(digits) > 1) || !isDigits(unsigned) {
+		return 0, fmt.Errorf("bencode: invalid integer %q at offset %d", digits, start)
+	}
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bencode: invalid integer %q at offset %d: %w", digits, start, err)
+	}
+	d.pos++ // Skip the e.
+	return value, nil
+}
+
+// Decodes a byte string, e.g., 4:spam.
+func (d *decoder) string() (string, error) {
+	start := d.pos
+	for d.pos < len(d.data) && d.data[d.pos] != ':' {
+		d.pos++
+	}
+	if d.pos >= len(d.data) {
+		return "", fmt.Errorf("bencode: unterminated string length at offset %d", start)
+	}
+	digits := string(d.data[start:d.pos])
+	if !isDigits(digits) || (digits[0] == '0' && len(digits) > 1) {
+		return "", fmt.Errorf("bencode: invalid string length %q at offset %d", digits, start)
+	}
+	length, err := strconv.Atoi(digits)
+	if err != nil || length > len(d.data)-d.pos-1 {
+		return "", fmt.Errorf("bencode: string length %s at offset %d exceeds the data", digits, start)
+	}
+	d.pos++ // Skip the colon.
+	value := string(d.data[d.pos : d.pos+length])
+	d.pos += length
+	return value, nil
+}
+
+func (d *decoder) list() ([]any, error) {
+	if d.depth++; d.depth > maxDepth {
+		return nil, d.errorf("nesting is too deep")
+	}
+	defer func() { d.depth-- }()
+
+	d.pos++ // Skip the l.
+	list := []any{}
+	for {
+		if d.pos >= len(d.data) {
+			return nil, d.errorf("unterminated list")
+		}
+		if d.data[d.pos] == 'e' {
+			d.pos++
+			return list, nil
+		}
+		value, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+}
+
+// Decodes a dictionary, along with the raw encoding of each of its values. The info hash of a torrent is computed
+// from the raw encoding of its info dictionary, since encoding it again might not give back the same bytes.
+func (d *decoder) dict() (map[string]any, map[string][]byte, error) {
+	if d.depth++; d.depth > maxDepth {
+		return nil, nil, d.errorf("nesting is too deep")
+	}
+	defer func() { d.depth-- }()
+
+	d.pos++ // Skip the d.
+	dict := map[string]any{}
+	raw := map[string][]byte{}
+	for {
+		if d.pos >= len(d.data) {
+			return nil, nil, d.errorf("unterminated dictionary")
+		}
+		if d.data[d.pos] == 'e' {
+			d.pos++
+			return dict, raw, nil
+		}
+		if c := d.data[d.pos]; c < '0' || c > '9' {
+			return nil, nil, d.errorf("dictionary key isn't a string")
+		}
+		key, err := d.string()
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := dict[key]; ok {
+			return nil, nil, d.errorf("duplicate dictionary key %q", key)
+		}
+		start := d.pos
+		value, err := d.value()
+		if err != nil {
+			return nil, nil, err
+		}
+		dict[key] = value
+		raw[key] = d.data[start:d.pos]
+	}
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		want any
+		err  string
+	}{
+		{"i42e", int64(42), ""},
+		{"i-42e", int64(-42), ""},
+		{"i0e", int64(0), ""},
+		{"4:spam", "spam", ""},
+		{"0:", "", ""},
+		{"l4:spami42ee", []any{"spam", int64(42)}, ""},
+		{"le", []any{}, ""},
+		{"d3:cow3:moo4:spaml1:a1:bee", map[string]any{"cow": "moo", "spam": []any{"a", "b"}}, ""},
+		{"de", map[string]any{}, ""},
+		{"", nil, "unexpected end of data"},
+		{"ie", nil, "invalid integer"},
+		{"i-0e", nil, "invalid integer"},
+		{"i03e", nil, "invalid integer"},
+		{"i1x2e", nil, "invalid integer"},
+		{"i42", nil, "unterminated integer"},
+		{"i99999999999999999999e", nil, "invalid integer"},
+		{"5:spam", nil, "exceeds the data"},
+		{"04:spam", nil, "invalid string length"},
+		{"4spam", nil, "unterminated string length"},
+		{"4x:spam", nil, "invalid string length"},
+		{"l4:spam", nil, "unterminated list"},
+		{"d3:cow3:moo", nil, "unterminated dictionary"},
+		{"di1e3:mooe", nil, "dictionary key isn't a string"},
+		{"d3:cow3:moo3:cow3:baae", nil, "duplicate dictionary key"},
+		{"i42ei43e", nil, "trailing data"},
+		{"x", nil, "unexpected character"},
+		{strings.Repeat("l", maxDepth+1) + strings.Repeat("e", maxDepth+1), nil, "nesting is too deep"},
+	} {
+		t.Run(tt.data, func(t *testing.T) {
+			got, err := Decode([]byte(tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to decode: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{"i42e", "4:spam", "l4:spami42ee", "d3:cow3:moo4:spaml1:a1:bee", "d1:ad1:bl1:ceee"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, err := Decode(data)
+		if err != nil {
+			return
+		}
+		// Every value has a single encoding, apart from the order of dictionary keys, so encoding the value again and
+		// decoding it gives back the same value.
+		encoded := encode(value)
+		again, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("failed to decode %q, the encoding of %q: %s", encoded, data, err)
+		}
+		if !reflect.DeepEqual(value, again) {
+			t.Fatalf("got %#v after encoding again, want %#v", again, value)
+		}
+	})
+}
+
+// Encodes the decoded value, with the dictionary keys in sorted order.
+func encode(value any) []byte {
+	var buf bytes.Buffer
+	switch value := value.(type) {
+	case int64:
+		fmt.Fprintf(&buf, "i%de", value)
+	case string:
+		fmt.Fprintf(&buf, "%d:%s", len(value), value)
+	case []any:
+		buf.WriteByte('l')
+		for _, item := range value {
+			buf.Write(encode(item))
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		buf.WriteByte('d')
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			buf.Write(encode(key))
+			buf.Write(encode(value[key]))
+		}
+		buf.WriteByte('e')
+	}
+	return buf.Bytes()
+}
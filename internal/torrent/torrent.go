@@ -0,0 +1,302 @@
+// Package torrent parses torrent files and converts them to magnet links.
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Metainfo is the content of a torrent file that's relevant to a magnet link.
+type Metainfo struct {
+	Name       string
+	Length     int64      // Total size of the files, without the padding files of hybrid torrents.
+	InfoHashV1 string     // Hex SHA-1 of the info dictionary, for v1 and hybrid torrents.
+	InfoHashV2 string     // Hex SHA-256 of the info dictionary, for v2 and hybrid torrents.
+	Trackers   [][]string // Tiers of tracker URLs, in order of preference.
+	WebSeeds   []string
+}
+
+// Parse decodes and validates the torrent file. Both v1 and v2 torrents are supported, as well as hybrid torrents that
+// are both.
+func Parse(data []byte) (*Metainfo, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, errors.New("torrent: not a dictionary")
+	}
+	d := &decoder{data: data}
+	root, raw, err := d.dict()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, d.errorf("trailing data")
+	}
+
+	info, ok := root["info"].(map[string]any)
+	if !ok {
+		return nil, errors.New("torrent: missing info dictionary")
+	}
+	var metainfo Metainfo
+	if metainfo.Name, ok = info["name"].(string); !ok || metainfo.Name == "" {
+		return nil, errors.New("torrent: missing name")
+	}
+	if pieceLength, ok := info["piece length"].(int64); !ok || pieceLength <= 0 {
+		return nil, errors.New("torrent: missing or invalid piece length")
+	}
+
+	version, ok := info["meta version"].(int64)
+	if !ok {
+		version = 1
+	}
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("torrent: unsupported meta version %d", version)
+	}
+	// Hybrid torrents have a meta version of 2, along with the fields of v1 torrents.
+	_, hasPieces := info["pieces"]
+	isV1 := version == 1 || hasPieces
+	isV2 := version == 2
+
+	if isV1 {
+		length, err := parseV1Files(info)
+		if err != nil {
+			return nil, err
+		}
+		metainfo.Length = length
+		sum := sha1.Sum(raw["info"])
+		metainfo.InfoHashV1 = hex.EncodeToString(sum[:])
+	}
+	if isV2 {
+		tree, ok := info["file tree"].(map[string]any)
+		if !ok {
+			return nil, errors.New("torrent: missing file tree")
+		}
+		length, err := parseFileTree(tree, "")
+		if err != nil {
+			return nil, err
+		}
+		metainfo.Length = length
+		sum := sha256.Sum256(raw["info"])
+		metainfo.InfoHashV2 = hex.EncodeToString(sum[:])
+	}
+
+	if metainfo.Trackers, err = parseTrackers(root); err != nil {
+		return nil, err
+	}
+	if metainfo.WebSeeds, err = parseWebSeeds(root); err != nil {
+		return nil, err
+	}
+	return &metainfo, nil
+}
+
+// Validates the pieces and files of a v1 info dictionary, and returns the total size of the files. Single-file
+// torrents have a length, and multi-file torrents have a list of files instead.
+func parseV1Files(info map[string]any) (int64, error) {
+	pieces, ok := info["pieces"].(string)
+	if !ok || len(pieces)%sha1.Size != 0 {
+		return 0, errors.New("torrent: missing or invalid pieces")
+	}
+
+	length, hasLength := info["length"]
+	files, hasFiles := info["files"]
+	switch {
+	case hasLength && hasFiles:
+		return 0, errors.New("torrent: has both a length and files")
+	case hasLength:
+		length, ok := length.(int64)
+		if !ok || length < 0 {
+			return 0, errors.New("torrent: invalid length")
+		}
+		return length, nil
+	case hasFiles:
+		files, ok := files.([]any)
+		if !ok {
+			return 0, errors.New("torrent: invalid files")
+		}
+		total := int64(0)
+		for i, file := range files {
+			file, ok := file.(map[string]any)
+			if !ok {
+				return 0, fmt.Errorf("torrent: file %d isn't a dictionary", i)
+			}
+			length, ok := file["length"].(int64)
+			if !ok || length < 0 {
+				return 0, fmt.Errorf("torrent: file %d has an invalid length", i)
+			}
+			path, ok := file["path"].([]any)
+			if !ok || len(path) == 0 {
+				return 0, fmt.Errorf("torrent: file %d has an invalid path", i)
+			}
+			for _, part := range path {
+				if _, ok := part.(string); !ok {
+					return 0, fmt.Errorf("torrent: file %d has an invalid path", i)
+				}
+			}
+			// Padding files align the files of hybrid torrents on piece boundaries, and aren't part of the content.
+			if attr, _ := file["attr"].(string); strings.Contains(attr, "p") {
+				continue
+			}
+			if total += length; total < 0 {
+				return 0, errors.New("torrent: total length overflows")
+			}
+		}
+		return total, nil
+	default:
+		return 0, errors.New("torrent: missing length or files")
+	}
+}
+
+// Validates the file tree of a v2 info dictionary, and returns the total size of the files. Files are the
+// dictionaries with an empty key, and the other keys are the names of files and directories.
+func parseFileTree(tree map[string]any, path string) (int64, error) {
+	if len(tree) == 0 {
+		return 0, fmt.Errorf("torrent: empty directory %q in file tree", path)
+	}
+	total := int64(0)
+	for name, node := range tree {
+		node, ok := node.(map[string]any)
+		if !ok {
+			return 0, fmt.Errorf("torrent: invalid entry %q in file tree", joinPath(path, name))
+		}
+		var length int64
+		if name == "" {
+			length, ok = node["length"].(int64)
+			if !ok || length < 0 {
+				return 0, fmt.Errorf("torrent: file %q has an invalid length", path)
+			}
+			if root, _ := node["pieces root"].(string); length > 0 && len(root) != sha256.Size {
+				return 0, fmt.Errorf("torrent: file %q has an invalid pieces root", path)
+			}
+		} else {
+			var err error
+			if length, err = parseFileTree(node, joinPath(path, name)); err != nil {
+				return 0, err
+			}
+		}
+		if total += length; total < 0 {
+			return 0, errors.New("torrent: total length overflows")
+		}
+	}
+	return total, nil
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// Returns the tiers of trackers from the announce list, or the single tracker of the announce URL when there's no
+// announce list.
+func parseTrackers(root map[string]any) ([][]string, error) {
+	tiers := [][]string{}
+	if list, ok := root["announce-list"]; ok {
+		list, ok := list.([]any)
+		if !ok {
+			return nil, errors.New("torrent: invalid announce list")
+		}
+		for _, tier := range list {
+			tier, ok := tier.([]any)
+			if !ok {
+				return nil, errors.New("torrent: invalid announce list tier")
+			}
+			urls := []string{}
+			for _, tracker := range tier {
+				tracker, ok := tracker.(string)
+				if !ok {
+					return nil, errors.New("torrent: invalid tracker in announce list")
+				}
+				if tracker != "" {
+					urls = append(urls, tracker)
+				}
+			}
+			if len(urls) > 0 {
+				tiers = append(tiers, urls)
+			}
+		}
+	}
+	if len(tiers) > 0 {
+		return tiers, nil
+	}
+
+	if announce, ok := root["announce"]; ok {
+		announce, ok := announce.(string)
+		if !ok {
+			return nil, errors.New("torrent: invalid announce URL")
+		}
+		if announce != "" {
+			tiers = append(tiers, []string{announce})
+		}
+	}
+	return tiers, nil
+}
+
+// Returns the web seeds of the URL list, which is either a single URL or a list of them.
+func parseWebSeeds(root map[string]any) ([]string, error) {
+	switch list := root["url-list"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if list == "" {
+			return nil, nil
+		}
+		return []string{list}, nil
+	case []any:
+		var seeds []string
+		for _, seed := range list {
+			seed, ok := seed.(string)
+			if !ok {
+				return nil, errors.New("torrent: invalid web seed")
+			}
+			if seed != "" {
+				seeds = append(seeds, seed)
+			}
+		}
+		return seeds, nil
+	default:
+		return nil, errors.New("torrent: invalid URL list")
+	}
+}
+
+// InfoHash returns the hex info hash BitTorrent clients know the torrent by. That's the v1 info hash when there's one,
+// or the v2 info hash truncated to the size of a v1 info hash otherwise.
+func (m *Metainfo) InfoHash() string {
+	if m.InfoHashV1 != "" {
+		return m.InfoHashV1
+	}
+	return m.InfoHashV2[:2*sha1.Size]
+}
+
+// Magnet returns the magnet link of the torrent, with every tracker and web seed.
+func (m *Metainfo) Magnet() string {
+	var params []string
+	if m.InfoHashV1 != "" {
+		params = append(params, "xt=urn:btih:"+m.InfoHashV1)
+	}
+	if m.InfoHashV2 != "" {
+		// The v2 info hash is a multihash, prefixed with the SHA-256 code and digest length.
+		params = append(params, "xt=urn:btmh:1220"+m.InfoHashV2)
+	}
+	params = append(params, "dn="+url.QueryEscape(m.Name), fmt.Sprintf("xl=%d", m.Length))
+
+	var trackers []string
+	for _, tier := range m.Trackers {
+		for _, tracker := range tier {
+			if !slices.Contains(trackers, tracker) {
+				trackers = append(trackers, tracker)
+			}
+		}
+	}
+	for _, tracker := range trackers {
+		params = append(params, "tr="+url.QueryEscape(tracker))
+	}
+	for _, seed := range m.WebSeeds {
+		params = append(params, "ws="+url.QueryEscape(seed))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
@@ -0,0 +1,234 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	pieces := strings.Repeat("x", sha1.Size)
+	root := strings.Repeat("r", sha256.Size)
+
+	singleFile := map[string]any{"name": "movie.mkv", "piece length": int64(16384), "pieces": pieces, "length": int64(123)}
+	multiFile := map[string]any{"name": "show", "piece length": int64(16384), "pieces": pieces, "files": []any{
+		map[string]any{"length": int64(100), "path": []any{"s01e01.mkv"}},
+		map[string]any{"length": int64(50), "path": []any{".pad", "50"}, "attr": "p"},
+		map[string]any{"length": int64(200), "path": []any{"extras", "s01e02.mkv"}},
+	}}
+	fileTree := map[string]any{
+		"s01e01.mkv": map[string]any{"": map[string]any{"length": int64(100), "pieces root": root}},
+		"extras": map[string]any{
+			"s01e02.mkv": map[string]any{"": map[string]any{"length": int64(200), "pieces root": root}},
+		},
+	}
+	v2 := map[string]any{"name": "show", "piece length": int64(16384), "meta version": int64(2), "file tree": fileTree}
+	hybrid := map[string]any{}
+	for key, value := range multiFile {
+		hybrid[key] = value
+	}
+	hybrid["meta version"] = int64(2)
+	hybrid["file tree"] = fileTree
+
+	sha1Hex := func(info map[string]any) string {
+		sum := sha1.Sum(encode(info))
+		return hex.EncodeToString(sum[:])
+	}
+	sha256Hex := func(info map[string]any) string {
+		sum := sha256.Sum256(encode(info))
+		return hex.EncodeToString(sum[:])
+	}
+
+	for _, tt := range []struct {
+		explanation string
+		torrent     map[string]any
+		want        *Metainfo
+	}{
+		{
+			"single-file v1 torrents have a single tracker",
+			map[string]any{"announce": "http://tracker.test/announce", "info": singleFile},
+			&Metainfo{
+				Name:       "movie.mkv",
+				Length:     123,
+				InfoHashV1: sha1Hex(singleFile),
+				Trackers:   [][]string{{"http://tracker.test/announce"}},
+			},
+		},
+		{
+			"multi-file v1 torrents add up the files, except the padding, and prefer the announce list",
+			map[string]any{
+				"announce":      "http://tracker.test/announce",
+				"announce-list": []any{[]any{"http://a.test/announce", "http://b.test/announce"}, []any{"udp://c.test:80"}},
+				"url-list":      []any{"http://seed.test/show/"},
+				"info":          multiFile,
+			},
+			&Metainfo{
+				Name:       "show",
+				Length:     300,
+				InfoHashV1: sha1Hex(multiFile),
+				Trackers:   [][]string{{"http://a.test/announce", "http://b.test/announce"}, {"udp://c.test:80"}},
+				WebSeeds:   []string{"http://seed.test/show/"},
+			},
+		},
+		{
+			"v2 torrents add up the file tree",
+			map[string]any{"url-list": "http://seed.test/show/", "info": v2},
+			&Metainfo{
+				Name:       "show",
+				Length:     300,
+				InfoHashV2: sha256Hex(v2),
+				Trackers:   [][]string{},
+				WebSeeds:   []string{"http://seed.test/show/"},
+			},
+		},
+		{
+			"hybrid torrents have both info hashes",
+			map[string]any{"info": hybrid},
+			&Metainfo{
+				Name:       "show",
+				Length:     300,
+				InfoHashV1: sha1Hex(hybrid),
+				InfoHashV2: sha256Hex(hybrid),
+				Trackers:   [][]string{},
+			},
+		},
+	} {
+		t.Run(tt.explanation, func(t *testing.T) {
+			got, err := Parse(encode(tt.torrent))
+			if err != nil {
+				t.Fatalf("failed to parse torrent: %s", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("unexpected metainfo (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParse_Malformed(t *testing.T) {
+	pieces := strings.Repeat("x", sha1.Size)
+	info := func(fields map[string]any) map[string]any {
+		result := map[string]any{"name": "movie.mkv", "piece length": int64(16384), "pieces": pieces, "length": int64(123)}
+		for key, value := range fields {
+			if value == nil {
+				delete(result, key)
+			} else {
+				result[key] = value
+			}
+		}
+		return result
+	}
+
+	for _, tt := range []struct {
+		explanation string
+		torrent     any
+		err         string
+	}{
+		{"not a dictionary", []any{}, "not a dictionary"},
+		{"no info", map[string]any{"announce": "http://tracker.test"}, "missing info dictionary"},
+		{"no name", map[string]any{"info": info(map[string]any{"name": nil})}, "missing name"},
+		{"no piece length", map[string]any{"info": info(map[string]any{"piece length": nil})}, "invalid piece length"},
+		{"truncated pieces", map[string]any{"info": info(map[string]any{"pieces": "xyz"})}, "invalid pieces"},
+		{"no length", map[string]any{"info": info(map[string]any{"length": nil})}, "missing length or files"},
+		{"negative length", map[string]any{"info": info(map[string]any{"length": int64(-1)})}, "invalid length"},
+		{"length and files", map[string]any{"info": info(map[string]any{"files": []any{}})}, "both a length and files"},
+		{
+			"file without a path",
+			map[string]any{"info": info(map[string]any{"length": nil, "files": []any{map[string]any{"length": int64(1)}}})},
+			"file 0 has an invalid path",
+		},
+		{"unknown meta version", map[string]any{"info": info(map[string]any{"meta version": int64(3)})}, "unsupported meta version 3"},
+		{"v2 without a file tree", map[string]any{"info": info(map[string]any{"meta version": int64(2)})}, "missing file tree"},
+		{
+			"v2 file without a pieces root",
+			map[string]any{"info": info(map[string]any{"meta version": int64(2), "file tree": map[string]any{
+				"movie.mkv": map[string]any{"": map[string]any{"length": int64(123)}}}})},
+			`file "movie.mkv" has an invalid pieces root`,
+		},
+		{
+			"invalid announce list",
+			map[string]any{"announce-list": []any{"http://tracker.test"}, "info": info(nil)},
+			"invalid announce list tier",
+		},
+		{"invalid web seeds", map[string]any{"url-list": int64(1), "info": info(nil)}, "invalid URL list"},
+	} {
+		t.Run(tt.explanation, func(t *testing.T) {
+			_, err := Parse(encode(tt.torrent))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMetainfo_Magnet(t *testing.T) {
+	v1 := strings.Repeat("ab", sha1.Size)
+	v2 := strings.Repeat("cd", sha256.Size)
+
+	metainfo := Metainfo{
+		Name:       "Some Show S01",
+		Length:     300,
+		InfoHashV1: v1,
+		InfoHashV2: v2,
+		Trackers:   [][]string{{"http://a.test/announce?passkey=1", "http://b.test/announce"}, {"http://a.test/announce?passkey=1"}},
+		WebSeeds:   []string{"http://seed.test/show/"},
+	}
+	link, err := url.Parse(metainfo.Magnet())
+	if err != nil {
+		t.Fatalf("failed to parse magnet link: %s", err)
+	}
+	want := url.Values{
+		"xt": {"urn:btih:" + v1, "urn:btmh:1220" + v2},
+		"dn": {"Some Show S01"},
+		"xl": {"300"},
+		"tr": {"http://a.test/announce?passkey=1", "http://b.test/announce"},
+		"ws": {"http://seed.test/show/"},
+	}
+	if diff := cmp.Diff(want, link.Query()); diff != "" {
+		t.Fatalf("unexpected magnet link parameters (-want +got):\n%s", diff)
+	}
+	if got, want := metainfo.InfoHash(), v1; got != want {
+		t.Errorf("got info hash %s, want %s", got, want)
+	}
+
+	// Without a v1 info hash, clients use the truncated v2 info hash.
+	metainfo.InfoHashV1 = ""
+	if got, want := metainfo.InfoHash(), v2[:40]; got != want {
+		t.Errorf("got info hash %s, want %s", got, want)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("d8:announce20:http://tracker.test/4:infod6:lengthi123e4:name9:movie.mkv12:piece lengthi16384e6:pieces20:xxxxxxxxxxxxxxxxxxxxee"))
+	f.Add([]byte("d4:infod9:file treed4:showd0:d6:lengthi0eeee12:meta versioni2e4:name4:show12:piece lengthi16384eee"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metainfo, err := Parse(data)
+		if err != nil {
+			return
+		}
+		if metainfo.Length < 0 {
+			t.Fatalf("got negative length %d", metainfo.Length)
+		}
+		if got := magnetInfoHashes(t, metainfo.Magnet()); got == 0 {
+			t.Fatalf("got magnet link without an info hash: %s", metainfo.Magnet())
+		}
+		if got := len(metainfo.InfoHash()); got != 40 {
+			t.Fatalf("got info hash of length %d, want 40", got)
+		}
+	})
+}
+
+// Returns the number of info hashes in the magnet link.
+func magnetInfoHashes(t *testing.T, magnet string) int {
+	t.Helper()
+	link, err := url.Parse(magnet)
+	if err != nil {
+		t.Fatalf("failed to parse magnet link %s: %s", magnet, err)
+	}
+	return len(link.Query()["xt"])
+}
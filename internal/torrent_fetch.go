@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Limits on fetching torrent files. Torrent files are small, so anything bigger is most likely not a torrent file.
+const (
+	maxTorrentFileSize  = 10 << 20
+	maxTorrentRedirects = 10
+	torrentFetchTimeout = 30 * time.Second
+)
+
+// Fetches the torrent file at the HTTP(S) URL, sending along the cookies, if any. Indexers sometimes redirect to a
+// magnet link instead of serving a torrent file, in which case the magnet link is returned instead of a file.
+func fetchTorrent(ctx context.Context, link, cookies string) ([]byte, string, error) {
+	var magnet string
+	client := &http.Client{
+		Timeout: torrentFetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme == "magnet" {
+				magnet = req.URL.String()
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= maxTorrentRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxTorrentRedirects)
+			}
+			return nil
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrBadMagnet, err)
+	}
+	if cookies != "" {
+		// The cookies are only sent to the host of the URL, and the hosts it redirects to on the same domain.
+		req.Header.Set("Cookie", cookies)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch torrent: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if magnet != "" {
+		return nil, magnet, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch torrent: unexpected status %s", resp.Status)
+	}
+	if resp.ContentLength > maxTorrentFileSize {
+		return nil, "", fmt.Errorf("failed to fetch torrent: file is larger than %d bytes", maxTorrentFileSize)
+	}
+
+	file, err := io.ReadAll(io.LimitReader(resp.Body, maxTorrentFileSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch torrent: %w", err)
+	}
+	if len(file) > maxTorrentFileSize {
+		return nil, "", fmt.Errorf("failed to fetch torrent: file is larger than %d bytes", maxTorrentFileSize)
+	}
+	return file, "", nil
+}
+
+// Returns whether the link is an HTTP(S) URL, as opposed to a magnet link.
+func isHTTPURL(link string) bool {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
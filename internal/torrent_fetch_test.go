@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchTorrent(t *testing.T) {
+	ctx := context.Background()
+	torrent := []byte("d4:infod6:lengthi123e4:name4:showee")
+
+	// The tracker stub serves torrent files to the users with the right cookie, and redirects like indexers do.
+	tracker := http.NewServeMux()
+	tracker.HandleFunc("/show.torrent", func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("uid"); err != nil || cookie.Value != "42" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write(torrent)
+	})
+	tracker.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/show.torrent", http.StatusFound)
+	})
+	tracker.HandleFunc("/magnet", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "magnet:?xt=urn:btih:AAA&dn=show", http.StatusFound)
+	})
+	tracker.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	tracker.HandleFunc("/huge.torrent", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), maxTorrentFileSize+1))
+	})
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		explanation string
+		path        string
+		cookies     string
+		file        []byte
+		magnet      string
+		err         string
+	}{
+		{
+			"torrent files are fetched with the cookies",
+			"/show.torrent",
+			"uid=42; pass=secret",
+			torrent,
+			"",
+			"",
+		},
+		{
+			"the cookies are sent along when redirected",
+			"/download",
+			"uid=42",
+			torrent,
+			"",
+			"",
+		},
+		{
+			"torrent files that require cookies fail without them",
+			"/show.torrent",
+			"",
+			nil,
+			"",
+			"unexpected status 403 Forbidden",
+		},
+		{
+			"redirects to magnet links return the magnet link",
+			"/magnet",
+			"",
+			nil,
+			"magnet:?xt=urn:btih:AAA&dn=show",
+			"",
+		},
+		{
+			"redirects are limited",
+			"/loop",
+			"",
+			nil,
+			"",
+			"stopped after 10 redirects",
+		},
+		{
+			"files that are too large fail",
+			"/huge.torrent",
+			"",
+			nil,
+			"",
+			"file is larger than",
+		},
+	} {
+		t.Run(tt.explanation, func(t *testing.T) {
+			file, magnet, err := fetchTorrent(ctx, server.URL+tt.path, tt.cookies)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to fetch torrent: %s", err)
+			}
+			if got, want := file, tt.file; !bytes.Equal(got, want) {
+				t.Errorf("got file %q, want %q", got, want)
+			}
+			if got, want := magnet, tt.magnet; got != want {
+				t.Errorf("got magnet %q, want %q", got, want)
+			}
+		})
+	}
+}
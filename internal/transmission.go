@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -26,26 +27,107 @@ type Session struct {
 	DownloadDir string `json:"download-dir"`
 }
 
+type SessionStats struct {
+	ActiveTorrentCount int          `json:"activeTorrentCount"`
+	DownloadSpeed      int64        `json:"downloadSpeed"`
+	PausedTorrentCount int          `json:"pausedTorrentCount"`
+	TorrentCount       int          `json:"torrentCount"`
+	UploadSpeed        int64        `json:"uploadSpeed"`
+	CumulativeStats    SessionTotal `json:"cumulative-stats"`
+	CurrentStats       SessionTotal `json:"current-stats"`
+}
+
+type SessionTotal struct {
+	UploadedBytes   int64 `json:"uploadedBytes"`
+	DownloadedBytes int64 `json:"downloadedBytes"`
+	FilesAdded      int   `json:"filesAdded"`
+	SessionCount    int   `json:"sessionCount"`
+	SecondsActive   int64 `json:"secondsActive"`
+}
+
+type FreeSpace struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size-bytes"`
+	TotalSize int64  `json:"total_size"`
+}
+
+// Computes the session statistics from the transfers. Putarr doesn't keep any history, so the cumulative statistics
+// only cover the current torrents.
+func computeSessionStats(transfers []Transfer) SessionStats {
+	stats := SessionStats{TorrentCount: len(transfers)}
+	for _, transfer := range transfers {
+		torrent := convertFromPutioTransfer(transfer)
+		if torrent.Status == TorrentStatusStopped {
+			stats.PausedTorrentCount++
+		} else {
+			stats.ActiveTorrentCount++
+		}
+		stats.DownloadSpeed += torrent.RateDownload
+		stats.UploadSpeed += torrent.RateUpload
+		stats.CurrentStats.DownloadedBytes += torrent.DownloadedEver
+		stats.CurrentStats.UploadedBytes += transfer.Uploaded
+		stats.CurrentStats.FilesAdded += torrent.FileCount
+	}
+	stats.CurrentStats.SessionCount = 1
+	stats.CumulativeStats = stats.CurrentStats
+	return stats
+}
+
 type Torrent struct {
-	ID                 int           `json:"id"`
-	HashString         *string       `json:"hashString"`
-	Name               string        `json:"name"`
-	DownloadDir        string        `json:"downloadDir"`
-	TotalSize          int64         `json:"totalSize"`
-	LeftUntilDone      int64         `json:"leftUntilDone"`
-	IsFinished         bool          `json:"isFinished"`
-	ETA                int64         `json:"eta"`
-	Status             TorrentStatus `json:"status"`
-	SecondsDownloading int64         `json:"secondsDownloading"`
-	ErrorString        *string       `json:"errorString"`
-	DownloadedEver     int64         `json:"downloadedEver"`
-	SeedRatioLimit     float32       `json:"seedRatioLimit"`
-	SeedRatioMode      int           `json:"seedRatioMode"`
-	SeedIdleLimit      int64         `json:"seedIdleLimit"`
-	SeedIdleMode       int           `json:"seedIdleMode"`
-	FileCount          int           `json:"fileCount"`
+	ID                 int                `json:"id"`
+	HashString         *string            `json:"hashString"`
+	Name               string             `json:"name"`
+	DownloadDir        string             `json:"downloadDir"`
+	TotalSize          int64              `json:"totalSize"`
+	LeftUntilDone      int64              `json:"leftUntilDone"`
+	IsFinished         bool               `json:"isFinished"`
+	ETA                int64              `json:"eta"`
+	Status             TorrentStatus      `json:"status"`
+	SecondsDownloading int64              `json:"secondsDownloading"`
+	ErrorString        *string            `json:"errorString"`
+	DownloadedEver     int64              `json:"downloadedEver"`
+	SeedRatioLimit     float32            `json:"seedRatioLimit"`
+	SeedRatioMode      int                `json:"seedRatioMode"`
+	SeedIdleLimit      int64              `json:"seedIdleLimit"`
+	SeedIdleMode       int                `json:"seedIdleMode"`
+	FileCount          int                `json:"fileCount"`
+	AddedDate          int64              `json:"addedDate"`
+	DoneDate           int64              `json:"doneDate"`
+	Labels             []string           `json:"labels"`
+	BandwidthPriority  int                `json:"bandwidthPriority"`
+	MagnetLink         string             `json:"magnetLink"`
+	Files              []TorrentFileEntry `json:"files"`
+	FileStats          []TorrentFileStat  `json:"fileStats"`
+	PercentDone        float64            `json:"percentDone"`
+	RateDownload       int64              `json:"rateDownload"`
+	RateUpload         int64              `json:"rateUpload"`
+	PeersConnected     int                `json:"peersConnected"`
+	UploadRatio        float64            `json:"uploadRatio"`
+	Error              TorrentError       `json:"error"`
+}
+
+// TorrentFileEntry is a file of a torrent, with its path relative to the download directory.
+type TorrentFileEntry struct {
+	Name           string `json:"name"`
+	Length         int64  `json:"length"`
+	BytesCompleted int64  `json:"bytesCompleted"`
 }
 
+type TorrentFileStat struct {
+	BytesCompleted int64 `json:"bytesCompleted"`
+	Wanted         bool  `json:"wanted"`
+	Priority       int   `json:"priority"`
+}
+
+type TorrentError int
+
+const (
+	TorrentErrorNone TorrentError = iota
+	TorrentErrorTrackerWarning
+	TorrentErrorTrackerError
+	TorrentErrorLocalError
+)
+
 type TorrentStatus int64
 
 const (
@@ -59,14 +141,14 @@ const (
 )
 
 func convertFromPutioTransfer(transfer Transfer) Torrent {
-	hash := FormatTorrentHash(transfer.ID)
+	hash := formatTransferHash(transfer)
 
 	createdAt := time.Now()
 	if transfer.CreatedAt != nil {
 		createdAt = transfer.CreatedAt.Time
 	}
 
-	return Torrent{
+	torrent := Torrent{
 		ID:                 int(transfer.ID),
 		HashString:         &hash,
 		Name:               transfer.Name,
@@ -84,12 +166,127 @@ func convertFromPutioTransfer(transfer Transfer) Torrent {
 		SeedIdleLimit:      0,
 		SeedIdleMode:       0,
 		FileCount:          1,
+		AddedDate:          createdAt.Unix(),
+		Labels:             []string{},
+		MagnetLink:         transfer.MagnetURI,
+		Files:              []TorrentFileEntry{},
+		FileStats:          []TorrentFileStat{},
+		RateDownload:       int64(transfer.DownloadSpeed),
+		RateUpload:         int64(transfer.UploadSpeed),
+		PeersConnected:     transfer.PeersConnected,
+	}
+	if transfer.FinishedAt != nil {
+		torrent.DoneDate = transfer.FinishedAt.Unix()
+	}
+	if transfer.Size > 0 {
+		torrent.UploadRatio = float64(transfer.Uploaded) / float64(transfer.Size)
+	}
+
+	// Prefer the metadata recorded when the transfer was added, since Put.io doesn't keep everything.
+	if metadata := transfer.Metadata; metadata != nil {
+		if !metadata.AddedAt.IsZero() {
+			torrent.AddedDate = metadata.AddedAt.Unix()
+		}
+		if metadata.Labels != nil {
+			torrent.Labels = metadata.Labels
+		}
+		torrent.BandwidthPriority = metadata.Priority
+		if strings.HasPrefix(metadata.Source, "magnet:") {
+			torrent.MagnetLink = metadata.Source
+		}
+	}
+
+	// Once the transfer is completed on Put.io, report the progress of the local download instead. This way clients
+	// only import the files once they're on local disk.
+	if local := transfer.Local; local != nil {
+		torrent.TotalSize = local.Size
+		torrent.LeftUntilDone = local.Size - local.Downloaded
+		torrent.DownloadedEver = local.Downloaded
+		torrent.IsFinished = local.Done
+		torrent.ETA = -1
+		torrent.Status = TorrentStatusDownloading
+		if local.Verifying {
+			torrent.Status = TorrentStatusChecking
+		}
+		if local.Done {
+			torrent.Status = TorrentStatusStopped
+		}
+		if local.Err != nil {
+			message := local.Err.Error()
+			torrent.ErrorString = &message
+			torrent.Status = TorrentStatusStopped
+		}
+		torrent.RateDownload = 0
+	}
+
+	// Put.io carries on with stopped transfers, but clients expect them to sit still until they're started again.
+	if metadata := transfer.Metadata; metadata != nil && metadata.Stopped {
+		torrent.Status = TorrentStatusStopped
+		torrent.RateDownload = 0
+		torrent.RateUpload = 0
+	}
+
+	if torrent.TotalSize > 0 {
+		torrent.PercentDone = float64(torrent.TotalSize-torrent.LeftUntilDone) / float64(torrent.TotalSize)
+	} else if torrent.IsFinished {
+		torrent.PercentDone = 1
+	}
+	if torrent.ErrorString != nil && *torrent.ErrorString != "" {
+		torrent.Error = TorrentErrorLocalError
+	}
+	return torrent
+}
+
+// Sets the files of the torrent from the listing of the transfer on Put.io. Put.io doesn't report the progress of
+// individual files, so the files are only completed once the whole torrent is.
+func setTorrentFiles(torrent *Torrent, files []remoteFile) {
+	torrent.Files = []TorrentFileEntry{}
+	torrent.FileStats = []TorrentFileStat{}
+	for _, file := range files {
+		completed := int64(0)
+		if torrent.IsFinished {
+			completed = file.Size
+		}
+		torrent.Files = append(torrent.Files, TorrentFileEntry{
+			Name:           filepath.ToSlash(file.Path),
+			Length:         file.Size,
+			BytesCompleted: completed,
+		})
+		torrent.FileStats = append(torrent.FileStats, TorrentFileStat{
+			BytesCompleted: completed,
+			Wanted:         true,
+		})
+	}
+	torrent.FileCount = len(files)
+}
+
+// Returns the requested fields of the torrent, or all of them when no fields are requested. Unknown fields are
+// ignored, like Transmission does.
+func selectTorrentFields(torrent Torrent, fields []string) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(torrent)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return all, nil
 	}
+
+	result := map[string]json.RawMessage{}
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			result[field] = value
+		}
+	}
+	return result, nil
 }
 
 func ConvertFromPutioStatus(status string) TorrentStatus {
 	switch strings.ToUpper(status) {
-	case "COMPLETED", "ERROR":
+	case "COMPLETED", "ERROR", heldTransferStatus:
 		return TorrentStatusStopped
 	case "PREPARING_DOWNLOAD":
 		return TorrentStatusCheckPending
@@ -113,10 +310,30 @@ func FormatTorrentHash(id int64) string {
 	return fmt.Sprintf("putarr;%d", id)
 }
 
-func ParseTorrentHash(key string) (int64, error) {
-	// Clients (e.g., Sonarr/Radarr) sometimes make the hash uppercase.
-	key = strings.ToLower(key)
+// Returns the hash clients know the transfer by: its real info hash when it's known, or its Putarr ID otherwise. The
+// transfers added before Putarr reported info hashes keep their Putarr ID, since clients already track them by it.
+func formatTransferHash(transfer Transfer) string {
+	if transfer.InfoHash != "" {
+		return transfer.InfoHash
+	}
+	return FormatTorrentHash(transfer.ID)
+}
+
+// Returns every hash clients may know the transfer by: its info hash, its Putarr ID, and the Putarr ID it was held under
+// when it was added paused, since the transfer got a new ID when it was started.
+func transferHashes(transfer Transfer) []string {
+	hashes := []string{FormatTorrentHash(transfer.ID)}
+	if transfer.InfoHash != "" {
+		hashes = append(hashes, transfer.InfoHash)
+	}
+	if transfer.Metadata != nil && transfer.Metadata.HeldID != 0 {
+		hashes = append(hashes, FormatTorrentHash(transfer.Metadata.HeldID))
+	}
+	return hashes
+}
 
+// Returns the transfer ID of the Putarr ID, e.g., putarr;123.
+func parsePutarrID(key string) (int64, error) {
 	s, ok := strings.CutPrefix(key, "putarr;")
 	if !ok {
 		return 0, errors.New("invalid transfer key: " + key)